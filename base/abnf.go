@@ -0,0 +1,89 @@
+package base
+
+import "strings"
+
+// Character classes from the SIP grammar (RFC 3261 s. 25.1).
+// These are exported so that custom header parsers can classify characters exactly as gossip does.
+
+// Characters which may appear in a token, other than alphanumerics.
+const c_TOKEN_CHARS = "-.!%*_+`'~"
+
+// Characters which separate tokens, and so may only appear in quoted strings; also whitespace.
+const c_SEPARATORS = "()<>@,;:\\\"/[]?={} \t"
+
+// Characters which may appear in a word, as used in Call-IDs, other than alphanumerics.
+const c_WORD_CHARS = "-.!%*_+`'~()<>:\\\"/[]?{}"
+
+// The 'mark' characters: those which, with alphanumerics, may always appear unescaped in a URI.
+const c_MARK = "-_.!~*'()"
+
+// Characters with a special meaning in URIs, which must be escaped where that meaning isn't intended.
+const c_RESERVED = ";/?:@&=+$,"
+
+// Characters which may appear unescaped in the user part of a SIP URI, besides unreserved characters.
+const c_USER_UNRESERVED = "&=+$,;?/"
+
+// Determine if the given character is linear whitespace: a space or a horizontal tab (WSP).
+func IsWhitespace(char byte) bool {
+	return strings.IndexByte(c_ABNF_WS, char) != -1
+}
+
+// Determine if the given character is an ASCII letter or digit (alphanum).
+func IsAlphanumeric(char byte) bool {
+	return (char >= '0' && char <= '9') || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+}
+
+// Determine if the given character is a hexadecimal digit, in either case (HEXDIG).
+func IsHexDigit(char byte) bool {
+	return ('0' <= char && char <= '9') || ('a' <= char && char <= 'f') || ('A' <= char && char <= 'F')
+}
+
+// Determine if the given character may appear in a token, such as a method, a header name or a param name.
+func IsTokenChar(char byte) bool {
+	return IsAlphanumeric(char) || strings.IndexByte(c_TOKEN_CHARS, char) != -1
+}
+
+// Determine if the given character is a separator, which cannot appear in a token (including SP and HTAB).
+func IsSeparator(char byte) bool {
+	return strings.IndexByte(c_SEPARATORS, char) != -1
+}
+
+// Determine if the given character may appear in a word, the more permissive relative of a token
+// which is used for the Call-ID.
+func IsWordChar(char byte) bool {
+	return IsAlphanumeric(char) || strings.IndexByte(c_WORD_CHARS, char) != -1
+}
+
+// Determine if the given character is a mark character.
+func IsMark(char byte) bool {
+	return strings.IndexByte(c_MARK, char) != -1
+}
+
+// Determine if the given character is unreserved; that is, alphanumeric or a mark character.
+func IsUnreserved(char byte) bool {
+	return IsAlphanumeric(char) || IsMark(char)
+}
+
+// Determine if the given character is reserved in URIs.
+func IsReserved(char byte) bool {
+	return strings.IndexByte(c_RESERVED, char) != -1
+}
+
+// Determine if the given character may appear unescaped in the user part of a SIP URI:
+// that is, if it is unreserved or one of the user-unreserved characters.
+func IsUserChar(char byte) bool {
+	return IsUnreserved(char) || strings.IndexByte(c_USER_UNRESERVED, char) != -1
+}
+
+// Determine if the given string is a token; i.e. if it can be used unquoted as a param value.
+func isToken(text string) bool {
+	if len(text) == 0 {
+		return false
+	}
+	for idx := 0; idx < len(text); idx++ {
+		if !IsTokenChar(text[idx]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package base
+
+import (
+	"testing"
+)
+
+func TestCharacterClasses(t *testing.T) {
+	tests := []struct {
+		name      string
+		predicate func(byte) bool
+		in        string
+		out       string
+	}{
+		{"IsWhitespace", IsWhitespace, " \t", "\r\nA\x00"},
+		{"IsAlphanumeric", IsAlphanumeric, "09azAZ", "/:@[`{-\x80"},
+		{"IsHexDigit", IsHexDigit, "09afAF", "/:@G`g"},
+		{"IsTokenChar", IsTokenChar, "aZ09-.!%*_+`'~", "()<>@,;:\\\"/[]?={} \t\x7f\x80"},
+		{"IsSeparator", IsSeparator, "()<>@,;:\\\"/[]?={} \t", "aZ09-.!%*_+`'~"},
+		{"IsWordChar", IsWordChar, "aZ09-.!%*_+`'~()<>:\\\"/[]?{}", "@,;= \t\x80"},
+		{"IsMark", IsMark, "-_.!~*'()", "aZ09&=+$,;?/%"},
+		{"IsUnreserved", IsUnreserved, "aZ09-_.!~*'()", "&=+$,;?/:@%#\" "},
+		{"IsReserved", IsReserved, ";/?:@&=+$,", "aZ09-_.!~*'()%# "},
+		{"IsUserChar", IsUserChar, "aZ09-_.!~*'()&=+$,;?/", ":@%#\"<> \x80"},
+	}
+
+	for _, test := range tests {
+		for idx := 0; idx < len(test.in); idx++ {
+			if !test.predicate(test.in[idx]) {
+				t.Errorf("expected %s(%q) to be true", test.name, test.in[idx])
+			}
+		}
+		for idx := 0; idx < len(test.out); idx++ {
+			if test.predicate(test.out[idx]) {
+				t.Errorf("expected %s(%q) to be false", test.name, test.out[idx])
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package base
+
+// The option tags and methods supported by the local stack, from which Supported and Allow headers for
+// outgoing messages can be built. The zero value has nothing registered and is ready to use.
+type Capabilities struct {
+	optionTags []string
+	methods    []Method
+}
+
+// Register the given option tags as supported. Tags are kept in the order in which they were first
+// registered; tags which are already registered, compared case-insensitively, are ignored.
+func (capabilities *Capabilities) RegisterOptionTag(tags ...string) {
+	for _, tag := range tags {
+		if !hasOption(capabilities.optionTags, tag) {
+			capabilities.optionTags = append(capabilities.optionTags, tag)
+		}
+	}
+}
+
+// Register the given methods as allowed. Methods are kept in the order in which they were first registered;
+// methods which are already registered are ignored.
+func (capabilities *Capabilities) RegisterMethod(methods ...Method) {
+	for _, method := range methods {
+		if !capabilities.AllowsMethod(method) {
+			capabilities.methods = append(capabilities.methods, method)
+		}
+	}
+}
+
+// Determine whether the given option tag has been registered.
+func (capabilities *Capabilities) SupportsOption(tag string) bool {
+	return hasOption(capabilities.optionTags, tag)
+}
+
+// Determine whether the given method has been registered.
+func (capabilities *Capabilities) AllowsMethod(method Method) bool {
+	for _, existing := range capabilities.methods {
+		if existing == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Build a Supported header listing the registered option tags. The header doesn't share its storage with
+// the registry, so it may be modified freely.
+func (capabilities *Capabilities) SupportedHeader() *SupportedHeader {
+	options := make([]string, len(capabilities.optionTags))
+	copy(options, capabilities.optionTags)
+	return &SupportedHeader{options}
+}
+
+// Build an Allow header listing the registered methods. The header doesn't share its storage with the
+// registry, so it may be modified freely.
+func (capabilities *Capabilities) AllowHeader() *AllowHeader {
+	methods := make([]Method, len(capabilities.methods))
+	copy(methods, capabilities.methods)
+	return &AllowHeader{methods}
+}
@@ -0,0 +1,42 @@
+package base
+
+import (
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	var capabilities Capabilities
+	if result := capabilities.SupportedHeader().String(); result != "Supported: " {
+		t.Errorf("expected an empty Supported header from an empty registry, got '%s'", result)
+	}
+	if result := capabilities.AllowHeader().String(); result != "Allow: " {
+		t.Errorf("expected an empty Allow header from an empty registry, got '%s'", result)
+	}
+
+	capabilities.RegisterOptionTag(OPTION_100REL, OPTION_TIMER, OPTION_PATH)
+	capabilities.RegisterOptionTag(OPTION_OUTBOUND, "Timer")
+	capabilities.RegisterMethod(INVITE, ACK, CANCEL, BYE)
+	capabilities.RegisterMethod(OPTIONS, INVITE)
+
+	if result := capabilities.SupportedHeader().String(); result != "Supported: 100rel, timer, path, outbound" {
+		t.Errorf("unexpected Supported header '%s'", result)
+	}
+	if result := capabilities.AllowHeader().String(); result != "Allow: INVITE, ACK, CANCEL, BYE, OPTIONS" {
+		t.Errorf("unexpected Allow header '%s'", result)
+	}
+
+	if !capabilities.SupportsOption("OUTBOUND") || capabilities.SupportsOption("gruu") {
+		t.Errorf("unexpected option support in %s", capabilities.SupportedHeader().String())
+	}
+	if !capabilities.AllowsMethod(BYE) || capabilities.AllowsMethod(REGISTER) {
+		t.Errorf("unexpected method support in %s", capabilities.AllowHeader().String())
+	}
+
+	supported := capabilities.SupportedHeader()
+	supported.Options[0] = "gruu"
+	allow := capabilities.AllowHeader()
+	allow.Methods[0] = REGISTER
+	if capabilities.SupportsOption("gruu") || capabilities.AllowsMethod(REGISTER) {
+		t.Errorf("modifying a built header changed the registry")
+	}
+}
@@ -0,0 +1,90 @@
+package base
+
+// The state of a dialog which is needed to construct requests within it (RFC 3261 s. 12).
+type Dialog struct {
+	// The Call-ID shared by all messages in the dialog.
+	CallId CallId
+
+	// The local URI and tag, which appear in the From header of requests we send.
+	LocalUri Uri
+	LocalTag string
+
+	// The remote URI and tag, which appear in the To header of requests we send.
+	RemoteUri Uri
+	RemoteTag string
+
+	// The CSeq number of the last request we sent in the dialog.
+	LocalSeq uint32
+
+	// The URI to which requests in the dialog are sent; taken from the remote party's Contact header.
+	RemoteTarget Uri
+
+	// Our own Contact URI, which is placed in a Contact header on requests we send. Optional.
+	LocalTarget ContactUri
+
+	// The ordered list of URIs requests in the dialog must be routed through, taken from the Record-Route
+	// header of the message which established the dialog.
+	RouteSet []Uri
+
+	// A template for the Via hop added to requests in the dialog, specifying the protocol, transport and
+	// sent-by address. A fresh branch parameter is generated for each request.
+	Via *ViaHop
+}
+
+// Build a new request within the given dialog, as described in RFC 3261 s. 12.2.1.1.
+// The Request-URI and Route headers are set from the remote target and route set, handling both
+// loose and strict routers. The local CSeq number of the dialog is incremented, except for ACK and
+// CANCEL requests, which reuse the CSeq number of the request they relate to.
+// The request is given the default Max-Forwards of 70.
+func NewInDialogRequest(dialog *Dialog, method Method) *Request {
+	var recipient Uri = dialog.RemoteTarget
+	var routes []Uri
+	if len(dialog.RouteSet) > 0 {
+		if firstRoute, ok := dialog.RouteSet[0].(*SipUri); ok && !firstRoute.IsLooseRouter() {
+			// The first route is a strict router, so it goes in the Request-URI, and the
+			// remote target goes at the end of the Route header instead.
+			recipient = firstRoute.Copy()
+			routes = append(copyUris(dialog.RouteSet[1:]), dialog.RemoteTarget.Copy())
+		} else {
+			routes = copyUris(dialog.RouteSet)
+		}
+	}
+
+	if method != ACK && method != CANCEL {
+		dialog.LocalSeq++
+	}
+
+	via := dialog.Via.Copy()
+	if via.Params == nil {
+		via.Params = Params{}
+	}
+	branch := GenerateBranch()
+	via.Params["branch"] = &branch
+
+	to := &ToHeader{Address: dialog.RemoteUri.Copy(), Params: Params{}}
+	if len(dialog.RemoteTag) > 0 {
+		remoteTag := dialog.RemoteTag
+		to.Params["tag"] = &remoteTag
+	}
+	localTag := dialog.LocalTag
+	from := &FromHeader{Address: dialog.LocalUri.Copy(), Params: Params{"tag": &localTag}}
+	callId := dialog.CallId
+
+	headers := []SipHeader{
+		&ViaHeader{via},
+		to,
+		from,
+		&callId,
+		&CSeq{dialog.LocalSeq, method},
+	}
+	if len(routes) > 0 {
+		headers = append(headers, &RouteHeader{routes})
+	}
+	if dialog.LocalTarget != nil {
+		headers = append(headers, &ContactHeader{Address: dialog.LocalTarget.Copy().(ContactUri), Params: Params{}})
+	}
+
+	request := NewRequest(method, recipient, "SIP/2.0", headers, "")
+	request.EnsureMaxForwards()
+	return request
+}
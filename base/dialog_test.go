@@ -0,0 +1,95 @@
+package base
+
+import (
+	"strings"
+	"testing"
+)
+
+func testDialog(routeSet []Uri) *Dialog {
+	alice := "alice"
+	port := uint16(5060)
+	return &Dialog{
+		CallId:       CallId("a84b4c76e66710@pc33.atlanta.com"),
+		LocalUri:     &SipUri{User: &alice, Host: "atlanta.com"},
+		LocalTag:     "1928301774",
+		RemoteUri:    &SipUri{User: &bob, Host: "biloxi.com"},
+		RemoteTag:    "a6c85cf",
+		LocalSeq:     314159,
+		RemoteTarget: &SipUri{User: &bob, Host: "192.0.2.4"},
+		RouteSet:     routeSet,
+		Via:          &ViaHop{"SIP", "2.0", "UDP", "pc33.atlanta.com", &port, Params{}},
+	}
+}
+
+func TestInDialogRequest(t *testing.T) {
+	dialog := testDialog(nil)
+	bye := NewInDialogRequest(dialog, BYE)
+
+	if !bye.Recipient.Equals(dialog.RemoteTarget) {
+		t.Errorf("unexpected Request-URI %s", bye.Recipient.String())
+	}
+	if maxForwards := bye.Headers("Max-Forwards"); len(maxForwards) != 1 || *(maxForwards[0].(*MaxForwards)) != 70 {
+		t.Errorf("unexpected Max-Forwards headers %v", maxForwards)
+	}
+	if len(bye.Headers("Route")) != 0 {
+		t.Errorf("unexpected Route header with empty route set: %s", bye.String())
+	}
+	if cseq := bye.Headers("CSeq")[0].(*CSeq); cseq.SeqNo != 314160 || cseq.MethodName != BYE {
+		t.Errorf("unexpected CSeq %s", cseq.String())
+	}
+	if to := bye.Headers("To")[0].(*ToHeader); *to.Params["tag"] != "a6c85cf" || !to.Address.Equals(dialog.RemoteUri) {
+		t.Errorf("unexpected To header %s", to.String())
+	}
+	if from := bye.Headers("From")[0].(*FromHeader); *from.Params["tag"] != "1928301774" || !from.Address.Equals(dialog.LocalUri) {
+		t.Errorf("unexpected From header %s", from.String())
+	}
+	via := *(bye.Headers("Via")[0].(*ViaHeader))
+	if len(via) != 1 || !strings.HasPrefix(*via[0].Params["branch"], RFC3261_BRANCH_MAGIC_COOKIE) {
+		t.Errorf("unexpected Via header %s", via.String())
+	}
+	if _, ok := dialog.Via.Params["branch"]; ok {
+		t.Errorf("building a request modified the dialog's Via template")
+	}
+
+	// ACK reuses the CSeq number of the request it acknowledges.
+	ack := NewInDialogRequest(dialog, ACK)
+	if cseq := ack.Headers("CSeq")[0].(*CSeq); cseq.SeqNo != 314160 {
+		t.Errorf("unexpected CSeq on ACK %s", cseq.String())
+	}
+
+	// Each request gets a fresh branch.
+	ackVia := *(ack.Headers("Via")[0].(*ViaHeader))
+	if *ackVia[0].Params["branch"] == *via[0].Params["branch"] {
+		t.Errorf("branch %s reused between requests", *via[0].Params["branch"])
+	}
+}
+
+func TestInDialogRequestLooseRouting(t *testing.T) {
+	proxy1 := &SipUri{Host: "p1.example.com", UriParams: Params{"lr": nil}}
+	proxy2 := &SipUri{Host: "p2.example.com", UriParams: Params{"lr": nil}}
+	dialog := testDialog([]Uri{proxy1, proxy2})
+	invite := NewInDialogRequest(dialog, INVITE)
+
+	if !invite.Recipient.Equals(dialog.RemoteTarget) {
+		t.Errorf("unexpected Request-URI %s", invite.Recipient.String())
+	}
+	expected := "Route: <sip:p1.example.com;lr>, <sip:p2.example.com;lr>"
+	if route := invite.Headers("Route"); len(route) != 1 || route[0].String() != expected {
+		t.Errorf("unexpected Route headers %v; expected %s", route, expected)
+	}
+}
+
+func TestInDialogRequestStrictRouting(t *testing.T) {
+	proxy1 := &SipUri{Host: "p1.example.com", UriParams: Params{}}
+	proxy2 := &SipUri{Host: "p2.example.com", UriParams: Params{"lr": nil}}
+	dialog := testDialog([]Uri{proxy1, proxy2})
+	invite := NewInDialogRequest(dialog, INVITE)
+
+	if !invite.Recipient.Equals(proxy1) {
+		t.Errorf("unexpected Request-URI %s", invite.Recipient.String())
+	}
+	expected := "Route: <sip:p2.example.com;lr>, <sip:bob@192.0.2.4>"
+	if route := invite.Headers("Route"); len(route) != 1 || route[0].String() != expected {
+		t.Errorf("unexpected Route headers %v; expected %s", route, expected)
+	}
+}
@@ -0,0 +1,150 @@
+package base
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// The Digest authentication scheme (RFC 2617, RFC 7616).
+const DIGEST_SCHEME = "Digest"
+
+// Compute Digest credentials answering the given challenge, for a request with the given method, Request-URI
+// and body (RFC 2617 s. 3.2.2, RFC 7616 s. 3.4.1).
+//
+// The algorithms MD5 (the default, if the challenge names none), MD5-sess, SHA-256 and SHA-256-sess are
+// supported. If the challenge offers quality of protection, 'auth' is chosen if it is offered, and otherwise
+// 'auth-int', which also protects the body; the cnonce and nonce count nc must then be given, as they must
+// for the -sess algorithms. Otherwise they are ignored. The caller is responsible for incrementing nc on
+// each request using the same nonce.
+//
+// Returns an error if the challenge isn't a Digest challenge, lacks a realm or nonce, or names an algorithm
+// or qop options which aren't supported.
+func ComputeDigestResponse(challenge *WWWAuthenticateHeader, username, password string, method Method,
+	uri string, cnonce string, nc uint32, body []byte) (*AuthorizationHeader, error) {
+	if !strings.EqualFold(challenge.Scheme, DIGEST_SCHEME) {
+		return nil, fmt.Errorf("cannot answer a challenge with unsupported scheme '%s'", challenge.Scheme)
+	}
+
+	realm, ok := challenge.Directives["realm"]
+	if !ok || realm == nil {
+		return nil, fmt.Errorf("no realm in challenge '%s'", challenge.String())
+	}
+	nonce, ok := challenge.Directives["nonce"]
+	if !ok || nonce == nil {
+		return nil, fmt.Errorf("no nonce in challenge '%s'", challenge.String())
+	}
+
+	algorithm := "MD5"
+	if param, ok := challenge.Directives["algorithm"]; ok && param != nil {
+		algorithm = *param
+	}
+	var newHash func() hash.Hash
+	baseAlgorithm := strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS")
+	session := len(baseAlgorithm) != len(algorithm)
+	switch baseAlgorithm {
+	case "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported digest algorithm '%s'", algorithm)
+	}
+	digest := func(parts ...string) string {
+		h := newHash()
+		h.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	qop := ""
+	options := challenge.QOPOptions()
+	for _, option := range options {
+		if option == "auth" || (option == "auth-int" && qop == "") {
+			qop = option
+		}
+	}
+	if len(options) > 0 && qop == "" {
+		return nil, fmt.Errorf("unsupported qop options '%s'", strings.Join(options, ","))
+	}
+	if (qop != "" || session) && len(cnonce) == 0 {
+		return nil, fmt.Errorf("a cnonce is required to answer challenge '%s'", challenge.String())
+	}
+
+	ha1 := digest(username, *realm, password)
+	if session {
+		ha1 = digest(ha1, *nonce, cnonce)
+	}
+
+	ha2 := digest(string(method), uri)
+	if qop == "auth-int" {
+		h := newHash()
+		h.Write(body)
+		ha2 = digest(string(method), uri, hex.EncodeToString(h.Sum(nil)))
+	}
+
+	count := fmt.Sprintf("%08x", nc)
+	var response string
+	if qop == "" {
+		response = digest(ha1, *nonce, ha2)
+	} else {
+		response = digest(ha1, *nonce, count, cnonce, qop, ha2)
+	}
+
+	directives := Params{
+		"username": &username,
+		"realm":    realm,
+		"nonce":    nonce,
+		"uri":      &uri,
+		"response": &response,
+	}
+	if _, ok := challenge.Directives["algorithm"]; ok {
+		directives["algorithm"] = &algorithm
+	}
+	if opaque, ok := challenge.Directives["opaque"]; ok && opaque != nil {
+		directives["opaque"] = opaque
+	}
+	if qop != "" {
+		directives["qop"] = &qop
+		directives["cnonce"] = &cnonce
+		directives["nc"] = &count
+	}
+
+	return &AuthorizationHeader{DIGEST_SCHEME, directives.Copy()}, nil
+}
+
+// Choose the strongest of the given challenges which ComputeDigestResponse can answer, as a client should when
+// a response carries several (RFC 7616 s. 3.7): a SHA-256 challenge is preferred to an MD5 one, and of
+// equally strong challenges, the first is chosen. Challenges with other schemes or algorithms are skipped.
+// Returns nil if none of the challenges can be answered.
+func SelectStrongestChallenge(challenges []*WWWAuthenticateHeader) *WWWAuthenticateHeader {
+	var strongest *WWWAuthenticateHeader
+	strongestRank := 0
+	for _, challenge := range challenges {
+		if rank := digestStrength(challenge); rank > strongestRank {
+			strongest, strongestRank = challenge, rank
+		}
+	}
+	return strongest
+}
+
+// Rank the strength of the given challenge's algorithm: higher is stronger, and 0 means that the challenge
+// can't be answered.
+func digestStrength(challenge *WWWAuthenticateHeader) int {
+	if !strings.EqualFold(challenge.Scheme, DIGEST_SCHEME) {
+		return 0
+	}
+	algorithm := "MD5"
+	if param, ok := challenge.Directives["algorithm"]; ok && param != nil {
+		algorithm = *param
+	}
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "SHA-256":
+		return 2
+	case "MD5":
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,155 @@
+package base
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestComputeDigestResponse(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		description string
+		challenge   Params
+		username    string
+		password    string
+		method      Method
+		uri         string
+		cnonce      string
+		nc          uint32
+		body        []byte
+		expected    Params
+	}{
+		{"RFC 2617 s. 3.5",
+			Params{"realm": str("testrealm@host.com"), "qop": str("auth,auth-int"),
+				"nonce": str("dcd98b7102dd2f0e8b11d0f600bfb0c093"), "opaque": str("5ccc069c403ebaf9f0171e9517f40e41")},
+			"Mufasa", "Circle Of Life", Method("GET"), "/dir/index.html", "0a4f113b", 1, nil,
+			Params{"username": str("Mufasa"), "realm": str("testrealm@host.com"),
+				"nonce": str("dcd98b7102dd2f0e8b11d0f600bfb0c093"), "uri": str("/dir/index.html"), "qop": str("auth"),
+				"nc": str("00000001"), "cnonce": str("0a4f113b"), "response": str("6629fae49393a05397450978507c4ef1"),
+				"opaque": str("5ccc069c403ebaf9f0171e9517f40e41")}},
+		{"RFC 7616 s. 3.9.1, MD5",
+			Params{"realm": str("http-auth@example.org"), "qop": str("auth, auth-int"), "algorithm": str("MD5"),
+				"nonce": str("7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v")},
+			"Mufasa", "Circle of Life", Method("GET"), "/dir/index.html", "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", 1, nil,
+			Params{"username": str("Mufasa"), "realm": str("http-auth@example.org"),
+				"nonce": str("7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"), "uri": str("/dir/index.html"),
+				"algorithm": str("MD5"), "qop": str("auth"), "nc": str("00000001"),
+				"cnonce":   str("f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"),
+				"response": str("8ca523f5e9506fed4657c9700eebdbec")}},
+		{"RFC 7616 s. 3.9.1, SHA-256",
+			Params{"realm": str("http-auth@example.org"), "qop": str("auth, auth-int"), "algorithm": str("SHA-256"),
+				"nonce": str("7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v")},
+			"Mufasa", "Circle of Life", Method("GET"), "/dir/index.html", "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ", 1, nil,
+			Params{"username": str("Mufasa"), "realm": str("http-auth@example.org"),
+				"nonce": str("7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"), "uri": str("/dir/index.html"),
+				"algorithm": str("SHA-256"), "qop": str("auth"), "nc": str("00000001"),
+				"cnonce":   str("f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"),
+				"response": str("753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1")}},
+		{"no qop",
+			Params{"realm": str("biloxi.com"), "nonce": str("dcd98b7102dd2f0e8b11d0f600bfb0c093")},
+			"bob", "zanzibar", REGISTER, "sip:bob@biloxi.com", "", 0, nil,
+			Params{"username": str("bob"), "realm": str("biloxi.com"), "nonce": str("dcd98b7102dd2f0e8b11d0f600bfb0c093"),
+				"uri": str("sip:bob@biloxi.com"), "response": str("af85bb4b5adbf02487f62eb11eea57ca")}},
+		{"MD5-sess",
+			Params{"realm": str("biloxi.com"), "nonce": str("dcd98b7102dd2f0e8b11d0f600bfb0c093"), "qop": str("auth"),
+				"algorithm": str("MD5-sess")},
+			"bob", "zanzibar", REGISTER, "sip:bob@biloxi.com", "0a4f113b", 2, nil,
+			Params{"username": str("bob"), "realm": str("biloxi.com"), "nonce": str("dcd98b7102dd2f0e8b11d0f600bfb0c093"),
+				"uri": str("sip:bob@biloxi.com"), "algorithm": str("MD5-sess"), "qop": str("auth"), "nc": str("00000002"),
+				"cnonce": str("0a4f113b"), "response": str("a86eeaf26a2a4229c926eeb845f9e999")}},
+		{"auth-int",
+			Params{"realm": str("biloxi.com"), "nonce": str("dcd98b7102dd2f0e8b11d0f600bfb0c093"), "qop": str("auth-int")},
+			"bob", "zanzibar", INVITE, "sip:bob@biloxi.com", "0a4f113b", 10, []byte("v=0\r\n"),
+			Params{"username": str("bob"), "realm": str("biloxi.com"), "nonce": str("dcd98b7102dd2f0e8b11d0f600bfb0c093"),
+				"uri": str("sip:bob@biloxi.com"), "qop": str("auth-int"), "nc": str("0000000a"),
+				"cnonce": str("0a4f113b"), "response": str("9855c80e3610fac8933f2c676a44cb4b")}},
+	}
+
+	for _, test := range tests {
+		challenge := &WWWAuthenticateHeader{"Digest", test.challenge}
+		authorization, err := ComputeDigestResponse(challenge, test.username, test.password, test.method,
+			test.uri, test.cnonce, test.nc, test.body)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.description, err.Error())
+			continue
+		}
+		if authorization.Scheme != "Digest" || !ParamsEqual(authorization.Directives, test.expected) {
+			t.Errorf("%s: unexpected credentials %s", test.description, authorization.String())
+		}
+	}
+
+	failures := []struct {
+		description string
+		challenge   *WWWAuthenticateHeader
+		cnonce      string
+	}{
+		{"a Basic challenge", &WWWAuthenticateHeader{"Basic", Params{"realm": str("biloxi.com")}}, "0a4f113b"},
+		{"no nonce", &WWWAuthenticateHeader{"Digest", Params{"realm": str("biloxi.com")}}, "0a4f113b"},
+		{"no realm", &WWWAuthenticateHeader{"Digest", Params{"nonce": str("abc")}}, "0a4f113b"},
+		{"an unknown algorithm", &WWWAuthenticateHeader{"Digest",
+			Params{"realm": str("biloxi.com"), "nonce": str("abc"), "algorithm": str("SHA-512-256")}}, "0a4f113b"},
+		{"an unknown qop", &WWWAuthenticateHeader{"Digest",
+			Params{"realm": str("biloxi.com"), "nonce": str("abc"), "qop": str("auth-conf")}}, "0a4f113b"},
+		{"qop without a cnonce", &WWWAuthenticateHeader{"Digest",
+			Params{"realm": str("biloxi.com"), "nonce": str("abc"), "qop": str("auth")}}, ""},
+	}
+	for _, test := range failures {
+		if _, err := ComputeDigestResponse(test.challenge, "bob", "zanzibar", REGISTER, "sip:biloxi.com",
+			test.cnonce, 1, nil); err == nil {
+			t.Errorf("expected an error answering %s", test.description)
+		}
+	}
+}
+
+func TestSelectStrongestChallenge(t *testing.T) {
+	str := func(s string) *string { return &s }
+	md5 := &WWWAuthenticateHeader{"Digest", Params{"realm": str("biloxi.com"), "nonce": str("abc")}}
+	md5Sess := &WWWAuthenticateHeader{"Digest", Params{"realm": str("biloxi.com"), "nonce": str("abc"),
+		"algorithm": str("MD5-sess")}}
+	sha256 := &WWWAuthenticateHeader{"Digest", Params{"realm": str("biloxi.com"), "nonce": str("abc"),
+		"algorithm": str("SHA-256")}}
+	sha512 := &WWWAuthenticateHeader{"Digest", Params{"realm": str("biloxi.com"), "nonce": str("abc"),
+		"algorithm": str("SHA-512-256")}}
+	basic := &WWWAuthenticateHeader{"Basic", Params{"realm": str("biloxi.com")}}
+
+	tests := []struct {
+		challenges []*WWWAuthenticateHeader
+		expected   *WWWAuthenticateHeader
+	}{
+		{[]*WWWAuthenticateHeader{md5, sha256}, sha256},
+		{[]*WWWAuthenticateHeader{sha256, md5}, sha256},
+		{[]*WWWAuthenticateHeader{sha512, md5Sess, md5}, md5Sess},
+		{[]*WWWAuthenticateHeader{basic, sha512}, nil},
+		{nil, nil},
+	}
+	for idx, test := range tests {
+		if result := SelectStrongestChallenge(test.challenges); result != test.expected {
+			t.Errorf("test %d: expected challenge %v, got %v", idx, test.expected, result)
+		}
+	}
+}
+
+func TestQOPOptions(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		qop      *string
+		expected []string
+	}{
+		{str("auth"), []string{"auth"}},
+		{str("auth,auth-int"), []string{"auth", "auth-int"}},
+		{str(" Auth , auth-int ,"), []string{"auth", "auth-int"}},
+		{str(""), []string{}},
+		{nil, []string{}},
+	}
+
+	for _, test := range tests {
+		challenge := &WWWAuthenticateHeader{"Digest", Params{"realm": str("biloxi.com"), "nonce": str("abc")}}
+		if test.qop != nil {
+			challenge.Directives["qop"] = test.qop
+		}
+		options := challenge.QOPOptions()
+		if strings.Join(options, "|") != strings.Join(test.expected, "|") || options == nil {
+			t.Errorf("expected qop options %v from %s, got %v", test.expected, challenge.String(), options)
+		}
+	}
+}
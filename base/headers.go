@@ -5,7 +5,12 @@ import (
 )
 
 import "bytes"
+import "crypto/rand"
+import "encoding/hex"
 import "fmt"
+import "math"
+import "net"
+import "sort"
 import "strconv"
 import "strings"
 
@@ -24,6 +29,23 @@ type SipHeader interface {
 	Copy() SipHeader
 }
 
+// Implemented by headers and URIs which can append their string representation to a byte slice, rather than
+// building a string of their own. This is optional: messages are serialized into a single buffer, into which
+// those headers which implement it are written directly, while the String() of any others is copied.
+// The bytes appended must be exactly those which String() produces.
+type StringAppender interface {
+	AppendString(buf []byte) []byte
+}
+
+// Append the string representation of the given header or URI to the given buffer, using AppendString
+// if it is a StringAppender.
+func appendString(buf []byte, value fmt.Stringer) []byte {
+	if appender, ok := value.(StringAppender); ok {
+		return appender.AppendString(buf)
+	}
+	return append(buf, value.String()...)
+}
+
 // A URI from any schema (e.g. sip:, tel:, callto:)
 type Uri interface {
 	// Determine if the two URIs are equal according to the rules in RFC 3261 s. 19.1.4.
@@ -37,7 +59,7 @@ type Uri interface {
 }
 
 // A URI from a schema suitable for inclusion in a Contact: header.
-// The only such URIs are sip/sips URIs and the special wildcard URI '*'.
+// The only such URIs are sip/sips URIs and the special wildcard URI '*'; but see also AbsoluteUri.
 type ContactUri interface {
 	Uri
 
@@ -46,6 +68,20 @@ type ContactUri interface {
 	IsWildcard() bool
 }
 
+// Get the given URI as a ContactUri, if it is one that is permitted in a Contact header: that is, a SIP or
+// SIPS URI, or the wildcard URI '*'. Other URIs, such as tel URIs, result in an error.
+func AsContactUri(uri Uri) (ContactUri, error) {
+	switch uri := uri.(type) {
+	case *SipUri:
+		return uri, nil
+	case WildcardUri:
+		return uri, nil
+	case *WildcardUri:
+		return uri, nil
+	}
+	return nil, fmt.Errorf("URI '%v' is not permitted in a Contact header", uri)
+}
+
 // A SIP or SIPS URI, including all params and URI header params.
 type SipUri struct {
 	// True if and only if the URI is a SIPS URI.
@@ -125,66 +161,228 @@ func (uri *SipUri) Equals(otherUri Uri) bool {
 		return false
 	}
 
+	// Escaping is purely cosmetic, so the user, password and params are all compared unescaped.
 	other := *otherPtr
 	result := uri.IsEncrypted == other.IsEncrypted &&
-		utils.StrPtrEq(uri.User, other.User) &&
-		utils.StrPtrEq(uri.Password, other.Password) &&
-		uri.Host == other.Host &&
+		utils.StrPtrEq(unescapePtr(uri.User), unescapePtr(other.User)) &&
+		utils.StrPtrEq(unescapePtr(uri.Password), unescapePtr(other.Password)) &&
+		trimHostDot(uri.Host) == trimHostDot(other.Host) &&
 		utils.Uint16PtrEq(uri.Port, other.Port)
 
 	if !result {
 		return false
 	}
 
-	if !ParamsEqual(uri.UriParams, other.UriParams) {
+	// The 'user' parameter is significant whatever its value, but like most parameter values, it is
+	// compared case-insensitively (RFC 3261 s. 19.1.4).
+	uriParams, otherParams := unescapeParams(uri.UriParams), unescapeParams(other.UriParams)
+	user, hasUser := uri.UserParam()
+	otherUser, otherHasUser := other.UserParam()
+	if hasUser && otherHasUser {
+		if !strings.EqualFold(user, otherUser) {
+			return false
+		}
+		delete(uriParams, "user")
+		delete(otherParams, "user")
+	}
+
+	if !ParamsEqual(uriParams, otherParams) {
 		return false
 	}
 
-	if !ParamsEqual(uri.Headers, other.Headers) {
+	// Unlike most params, URI headers are never ignored: any header present in either URI must be present
+	// in both, with the same value (RFC 3261 s. 19.1.4).
+	if !ParamsEqual(unescapeParams(uri.Headers), unescapeParams(other.Headers)) {
 		return false
 	}
 
 	return true
 }
 
+// Strip a single trailing dot from the given host, so that a fully-qualified domain name such as
+// 'example.com.' compares equal to 'example.com'.
+func trimHostDot(host string) string {
+	return strings.TrimSuffix(host, ".")
+}
+
+// Determine if the URI carries the 'user=phone' parameter; that is, if its user part
+// should be interpreted as a telephone-subscriber rather than an ordinary username
+// (RFC 3261 s. 19.1.1).
+func (uri *SipUri) IsPhoneNumber() bool {
+	user, ok := uri.UserParam()
+	return ok && strings.EqualFold(user, "phone")
+}
+
+// Get the value of the 'user' parameter, which says how the user part of the URI should be interpreted:
+// e.g. "phone" for a telephone-subscriber (RFC 3261), "dialstring" for digits to be dialled as-is
+// (RFC 4967) or "ip" for an ordinary username. Any token is allowed, and is returned unescaped.
+// The boolean return is false if the URI has no 'user' parameter with a value.
+func (uri *SipUri) UserParam() (string, bool) {
+	user, ok := uri.UriParams["user"]
+	if !ok || user == nil {
+		return "", false
+	}
+	return unescape(*user), true
+}
+
+// Get the port to use to reach the URI over the given transport: the port in the URI if it has one, and
+// otherwise the default port for the transport, as given by DefaultPort. ResolveTransport gives the
+// transport to use when it isn't known from elsewhere.
+func (uri *SipUri) EffectivePort(transport Transport) uint16 {
+	if uri.Port != nil {
+		return *uri.Port
+	}
+	return DefaultPort(string(transport))
+}
+
+// The components of a SIP URI on which routing decisions are made, with defaults applied; see RoutingKey.
+// A RoutingKey is comparable, so it may be used as a map key.
+type RoutingKey struct {
+	// "sip" or "sips".
+	Scheme string
+
+	// The user part, unescaped; empty if the URI has none.
+	User string
+
+	// The host, in lower case since host names are case-insensitive, and without any trailing dot.
+	Host string
+
+	// The port, or the default port for the transport if the URI has none.
+	Port uint16
+
+	// The transport, as given by ResolveTransport.
+	Transport Transport
+}
+
+// Project the URI onto the components used when matching it against routing rules: scheme, user, host, port
+// and transport. Where the URI leaves the transport or port unspecified, the defaults are filled in, as given
+// by ResolveTransport and EffectivePort. All other params and headers of the URI are ignored.
+func (uri *SipUri) RoutingKey() RoutingKey {
+	key := RoutingKey{Scheme: "sip", Host: strings.ToLower(trimHostDot(uri.Host)), Transport: ResolveTransport(uri)}
+	if uri.IsEncrypted {
+		key.Scheme = "sips"
+	}
+	if uri.User != nil {
+		key.User = unescape(*uri.User)
+	}
+	key.Port = uri.EffectivePort(key.Transport)
+	return key
+}
+
+// Determine if the URI is that of a loose router; that is, if it carries the 'lr' parameter (RFC 3261 s. 19.1.1).
+// The parameter is normally valueless, but some elements send e.g. 'lr=on', so any value is accepted.
+// This decides whether a route set is followed by loose or strict routing (RFC 3261 s. 12.2.1.1).
+func (uri *SipUri) IsLooseRouter() bool {
+	_, ok := uri.UriParams["lr"]
+	return ok
+}
+
+// Determine if the URI carries the 'comp=sigcomp' parameter, which asks for requests sent to it to be
+// compressed with SigComp (RFC 3486). gossip doesn't implement SigComp, but preserves the parameter.
+func (uri *SipUri) IsSigcomp() bool {
+	comp, ok := uri.UriParams["comp"]
+	return ok && comp != nil && strings.EqualFold(*comp, "sigcomp")
+}
+
+// Get the value of the 'ttl' parameter, the time-to-live of multicast requests sent to the URI's maddr
+// (RFC 3261 s. 19.1.1). The parser rejects URIs whose ttl is out of range, so for a parsed URI the second
+// return value is false only if the parameter is absent; for a URI built in code, it is also false if the
+// value is not a number from 0 to 255. Note that ttl is significant when comparing URIs: a URI with a ttl
+// never equals one without.
+func (uri *SipUri) Ttl() (uint8, bool) {
+	ttl, ok := uri.UriParams["ttl"]
+	if !ok || ttl == nil {
+		return 0, false
+	}
+	value, err := ParseTtl(*ttl)
+	if err != nil {
+		return 0, false
+	}
+	return value, true
+}
+
+// Get the value of the 'gr' parameter, which marks the URI as a GRUU identifying a specific UA instance
+// (RFC 5627). The parameter is valueless in a public GRUU, in which case the empty string is returned;
+// in a temporary GRUU it has an opaque value. The boolean return is false if the URI is not a GRUU.
+// Note that Equals() treats 'gr' as significant: a GRUU never equals its AOR, nor a GRUU with a different value.
+func (uri *SipUri) GRUU() (string, bool) {
+	gr, ok := uri.UriParams["gr"]
+	if !ok {
+		return "", false
+	} else if gr == nil {
+		return "", true
+	}
+	return *gr, true
+}
+
+// Convert a 'user=phone' SIP URI into the equivalent tel URI, so that it can be compared
+// according to the rules for telephone numbers in RFC 3966.
+// Any parameters embedded in the user part (e.g. ';phone-context=') become parameters
+// of the tel URI; the host and all other SIP URI parameters are discarded.
+func (uri *SipUri) ToTelUri() (*TelUri, error) {
+	if !uri.IsPhoneNumber() {
+		return nil, fmt.Errorf("cannot convert URI '%s' to a tel URI: no user=phone parameter", uri.String())
+	}
+	if uri.User == nil || len(*uri.User) == 0 {
+		return nil, fmt.Errorf("cannot convert URI '%s' to a tel URI: no user part", uri.String())
+	}
+
+	parts := strings.Split(*uri.User, ";")
+	telUri := &TelUri{Number: parts[0], Params: Params{}}
+	for _, part := range parts[1:] {
+		if len(part) == 0 {
+			continue
+		}
+		if eqIdx := strings.Index(part, "="); eqIdx == -1 {
+			telUri.Params[part] = nil
+		} else {
+			value := part[eqIdx+1:]
+			telUri.Params[part[:eqIdx]] = &value
+		}
+	}
+
+	return telUri, nil
+}
+
 // Generates the string representation of a SipUri struct.
 func (uri *SipUri) String() string {
-	var buffer bytes.Buffer
+	return string(uri.AppendString(nil))
+}
 
+// Append the string representation of the URI to the given buffer; see StringAppender.
+func (uri *SipUri) AppendString(buf []byte) []byte {
 	// Compulsory protocol identifier.
 	if uri.IsEncrypted {
-		buffer.WriteString("sips")
-		buffer.WriteString(":")
+		buf = append(buf, "sips:"...)
 	} else {
-		buffer.WriteString("sip")
-		buffer.WriteString(":")
+		buf = append(buf, "sip:"...)
 	}
 
 	// Optional userinfo part.
 	if uri.User != nil {
-		buffer.WriteString(*uri.User)
+		buf = append(buf, escapeUser(*uri.User)...)
 
 		if uri.Password != nil {
-			buffer.WriteString(":")
-			buffer.WriteString(*uri.Password)
+			buf = append(buf, ':')
+			buf = append(buf, *uri.Password...)
 		}
 
-		buffer.WriteString("@")
+		buf = append(buf, '@')
 	}
 
 	// Compulsory hostname.
-	buffer.WriteString(uri.Host)
+	buf = append(buf, uri.Host...)
 
 	// Optional port number.
 	if uri.Port != nil {
-		buffer.WriteString(":")
-		buffer.WriteString(strconv.Itoa(int(*uri.Port)))
+		buf = append(buf, ':')
+		buf = strconv.AppendUint(buf, uint64(*uri.Port), 10)
 	}
 
-	buffer.WriteString(ParamsToString(uri.UriParams, ';', ';'))
-	buffer.WriteString(ParamsToString(uri.Headers, '?', '&'))
+	buf = appendParams(buf, uri.UriParams, ';', ';', uriParamValueString)
+	buf = appendParams(buf, uri.Headers, '?', '&', uriParamValueString)
 
-	return buffer.String()
+	return buf
 }
 
 // The special wildcard URI used in Contact: headers in REGISTER requests when expiring all registrations.
@@ -214,6 +412,122 @@ func (uri WildcardUri) Equals(other Uri) bool {
 	}
 }
 
+// A URI with a scheme which gossip doesn't understand, such as a vendor extension, kept exactly as it was
+// received so that it can be relayed untouched. The name-addr form of the To, From, Contact, Route and
+// Record-Route headers may hold any absolute URI (RFC 3261 s. 25.1).
+// AbsoluteUri implements ContactUri, so that a Contact with an unknown scheme is still usable, but
+// AsContactUri rejects it, as such a Contact can't be used as a target.
+type AbsoluteUri struct {
+	// The scheme of the URI, without the ':', e.g. "urn".
+	Scheme string
+
+	// The rest of the URI, after the ':'.
+	Opaque string
+}
+
+func (uri *AbsoluteUri) Copy() Uri { return &AbsoluteUri{uri.Scheme, uri.Opaque} }
+
+// Always returns false.
+func (uri *AbsoluteUri) IsWildcard() bool { return false }
+
+func (uri *AbsoluteUri) String() string { return uri.Scheme + ":" + uri.Opaque }
+
+// Determine if the URI is equal to the given one. As the URI isn't understood, this is only the case if the
+// other URI is also an AbsoluteUri with the same scheme, compared case-insensitively, and the same text.
+func (uri *AbsoluteUri) Equals(other Uri) bool {
+	otherUri, ok := other.(*AbsoluteUri)
+	return ok && strings.EqualFold(uri.Scheme, otherUri.Scheme) && uri.Opaque == otherUri.Opaque
+}
+
+// Characters which may appear in a telephone number purely for readability (RFC 3966 s. 3).
+// These are ignored when comparing numbers.
+const c_VISUAL_SEPARATORS = "-.()"
+
+// A tel URI, as defined in RFC 3966, e.g. tel:+1-201-555-0123;ext=1234
+type TelUri struct {
+	// The telephone number, including any leading '+' and any visual separators.
+	Number string
+
+	// Any parameters following the number, such as 'phone-context' or 'ext'.
+	// Valueless parameters are stored with a nil value.
+	Params Params
+}
+
+// Copy the tel URI.
+func (uri *TelUri) Copy() Uri {
+	return &TelUri{uri.Number, uri.Params.Copy()}
+}
+
+// Determine if the tel URI is a global number; that is, if it starts with '+'.
+func (uri *TelUri) IsGlobal() bool {
+	return strings.HasPrefix(uri.Number, "+")
+}
+
+// Get the number in global form, with visual separators removed, e.g. "+12125551234".
+// A local number is globalized by prefixing it with its 'phone-context', if that is itself a global number
+// prefix such as "+1-212" (RFC 3966 s. 5.1.5). The boolean return is false if the number can't be globalized:
+// that is, if it is local and has a domain name as its context, or no context at all, or if it contains
+// characters other than digits, such as '*' or '#'.
+func (uri *TelUri) GlobalNumber() (string, bool) {
+	number := stripVisualSeparators(uri.Number)
+	if !uri.IsGlobal() {
+		context, ok := uri.Params["phone-context"]
+		if !ok || context == nil || !strings.HasPrefix(*context, "+") {
+			return "", false
+		}
+		number = stripVisualSeparators(*context) + number
+	}
+
+	if len(number) < 2 {
+		return "", false
+	}
+	for idx := 1; idx < len(number); idx++ {
+		if number[idx] < '0' || number[idx] > '9' {
+			return "", false
+		}
+	}
+	return number, true
+}
+
+// Determine if the tel URI is equal to the specified URI according to the rules in RFC 3966 s. 4.
+// Visual separators in the number are ignored, and hex digits are compared case-insensitively.
+// Where both numbers can be globalized (see GlobalNumber), their global forms are compared instead, and the
+// 'phone-context' param is disregarded, so that a local number matches its global equivalent.
+func (uri *TelUri) Equals(otherUri Uri) bool {
+	other, ok := otherUri.(*TelUri)
+	if !ok {
+		return false
+	}
+
+	number, ok := uri.GlobalNumber()
+	otherNumber, otherOk := other.GlobalNumber()
+	if ok && otherOk {
+		params, otherParams := uri.Params.Copy(), other.Params.Copy()
+		delete(params, "phone-context")
+		delete(otherParams, "phone-context")
+		return number == otherNumber && ParamsEqual(params, otherParams)
+	}
+
+	return strings.EqualFold(stripVisualSeparators(uri.Number), stripVisualSeparators(other.Number)) &&
+		ParamsEqual(uri.Params, other.Params)
+}
+
+// Generates the string representation of a TelUri struct.
+func (uri *TelUri) String() string {
+	return "tel:" + uri.Number + uriParamsToString(uri.Params, ';', ';')
+}
+
+// Remove any visual separators from the given telephone number.
+func stripVisualSeparators(number string) string {
+	var buffer bytes.Buffer
+	for idx := 0; idx < len(number); idx++ {
+		if strings.IndexByte(c_VISUAL_SEPARATORS, number[idx]) == -1 {
+			buffer.WriteByte(number[idx])
+		}
+	}
+	return buffer.String()
+}
+
 // Generic list of parameters on a header.
 type Params map[string]*string
 
@@ -231,8 +545,36 @@ func (p Params) Copy() Params {
 	return dup
 }
 
+// A single parameter, as produced by OrderedParams. The value is nil for a singleton param.
+type Param struct {
+	Key   string
+	Value *string
+}
+
+// Enumerate the given params in a deterministic order: sorted by key, byte-wise.
+// This works on any of the Params fields, e.g. OrderedParams(uri.UriParams) or OrderedParams(hop.Params),
+// and is suitable for logging or matching where map iteration order would be unstable.
+// The values are shared with the underlying params.
+func OrderedParams(params Params) []Param {
+	ordered := make([]Param, 0, len(params))
+	for key, value := range params {
+		ordered = append(ordered, Param{key, value})
+	}
+	sort.Sort(paramsByKey(ordered))
+	return ordered
+}
+
+type paramsByKey []Param
+
+func (p paramsByKey) Len() int           { return len(p) }
+func (p paramsByKey) Less(i, j int) bool { return p[i].Key < p[j].Key }
+func (p paramsByKey) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
 // Encapsulates a header that gossip does not natively support.
 // This allows header data that is not understood to be parsed by gossip and relayed to the parent application.
+// If the header was folded across several lines, the parser unfolds it onto a single line, replacing each
+// fold with a single space; this is semantically identical per RFC 3261 s. 7.3.1.
+// String() always produces the unfolded form; use Fold() to re-fold the header for output.
 type GenericHeader struct {
 	// The name of the header.
 	HeaderName string
@@ -247,6 +589,71 @@ func (header *GenericHeader) String() string {
 	return header.HeaderName + ": " + header.Contents
 }
 
+// Append the string representation of the header to the given buffer; see StringAppender.
+func (header *GenericHeader) AppendString(buf []byte) []byte {
+	buf = append(buf, header.HeaderName...)
+	buf = append(buf, ": "...)
+	return append(buf, header.Contents...)
+}
+
+// Split the contents of the header into a main value and parameters, for the many headers of the
+// form 'value;param=x;flag'. Semicolons within quoted strings or angle brackets are part of the value.
+// The params are parsed as ParseParams does for headers natively understood by gossip: values may be
+// quoted, and valueless params have a nil value. The contents of the header are not modified.
+func (header *GenericHeader) ParseParams() (value string, params map[string]*string, err error) {
+	paramsIdx := len(header.Contents)
+	inQuotes, inBrackets := false, false
+	for idx := 0; idx < len(header.Contents); idx++ {
+		char := header.Contents[idx]
+		if inQuotes && char == '\\' {
+			idx++
+		} else if char == '"' {
+			inQuotes = !inQuotes
+		} else if !inQuotes && char == '<' {
+			inBrackets = true
+		} else if !inQuotes && char == '>' {
+			inBrackets = false
+		} else if !inQuotes && !inBrackets && char == ';' {
+			paramsIdx = idx
+			break
+		}
+	}
+
+	value = strings.TrimSpace(header.Contents[:paramsIdx])
+	params, _, err = ParseParams(header.Contents[paramsIdx:], ';', ';', 0, true, true)
+	return
+}
+
+// Produce the string representation of the header, folded across several lines so that
+// no line exceeds the given column, where possible.
+// Lines are only broken at spaces, so a word longer than the column will not be split.
+// Continuation lines start with a single space, so unfolding the result yields String() again.
+func (header *GenericHeader) Fold(column int) string {
+	var buffer bytes.Buffer
+	line := header.String()
+	for column > 0 && len(line) > column {
+		// Find the last space before the column, skipping the first character so that we
+		// never break at the leading space of a continuation line.
+		breakIdx := strings.LastIndex(line[1:column+1], " ") + 1
+		if breakIdx == 0 {
+			// No space before the column; break at the next space instead, if any.
+			breakIdx = strings.Index(line[1:], " ") + 1
+			if breakIdx == 0 {
+				break
+			}
+		}
+
+		buffer.WriteString(line[:breakIdx])
+		buffer.WriteString("\r\n")
+
+		// The space we broke at becomes the whitespace at the start of the continuation line.
+		line = line[breakIdx:]
+	}
+	buffer.WriteString(line)
+
+	return buffer.String()
+}
+
 // Pull out the header name.
 func (h *GenericHeader) Name() string {
 	return h.HeaderName
@@ -257,6 +664,44 @@ func (h *GenericHeader) Copy() SipHeader {
 	return &GenericHeader{h.HeaderName, h.Contents}
 }
 
+// How the URI in a To or From header is serialized (RFC 3261 s. 20.10).
+type NameAddrPolicy int
+
+const (
+	// Always enclose the URI in angle brackets (the name-addr form). This is the default.
+	NAME_ADDR_BRACKETED NameAddrPolicy = iota
+
+	// Emit the bare URI (the addr-spec form) when there is no display name and there are no header
+	// params, for interoperability with RFC 2543 peers which reject brackets around a lone URI.
+	// A URI containing a comma, semicolon or question mark is still bracketed, as it would otherwise
+	// be ambiguous.
+	NAME_ADDR_BARE_WHEN_POSSIBLE
+)
+
+// Produce the address part of a To or From header, along with its header params, according to the given policy.
+func nameAddrWithPolicy(displayName *string, address Uri, params Params, policy NameAddrPolicy) string {
+	return string(appendNameAddr(nil, displayName, address, params, policy))
+}
+
+// Append the name-addr produced by nameAddrWithPolicy to the given buffer.
+func appendNameAddr(buf []byte, displayName *string, address Uri, params Params, policy NameAddrPolicy) []byte {
+	if displayName != nil {
+		buf = append(buf, quote(*displayName)...)
+		buf = append(buf, ' ')
+	}
+
+	if policy == NAME_ADDR_BARE_WHEN_POSSIBLE && displayName == nil && len(params) == 0 {
+		if uri := address.String(); !strings.ContainsAny(uri, ",;?") {
+			return append(buf, uri...)
+		}
+	}
+
+	buf = append(buf, '<')
+	buf = appendString(buf, address)
+	buf = append(buf, '>')
+	return appendParams(buf, params, ';', ';', genValueString)
+}
+
 type ToHeader struct {
 	// The display name from the header - this is a pointer type as it is optional.
 	DisplayName *string
@@ -265,20 +710,19 @@ type ToHeader struct {
 
 	// Any parameters present in the header.
 	Params Params
+
+	// Whether the URI may be serialized without angle brackets. The zero value always brackets it.
+	NameAddrPolicy NameAddrPolicy
 }
 
 func (to *ToHeader) String() string {
-	var buffer bytes.Buffer
-	buffer.WriteString("To: ")
-
-	if to.DisplayName != nil {
-		buffer.WriteString(fmt.Sprintf("\"%s\" ", *to.DisplayName))
-	}
-
-	buffer.WriteString(fmt.Sprintf("<%s>", to.Address))
-	buffer.WriteString(ParamsToString(to.Params, ';', ';'))
+	return string(to.AppendString(nil))
+}
 
-	return buffer.String()
+// Append the string representation of the header to the given buffer; see StringAppender.
+func (to *ToHeader) AppendString(buf []byte) []byte {
+	buf = append(buf, "To: "...)
+	return appendNameAddr(buf, to.DisplayName, to.Address, to.Params, to.NameAddrPolicy)
 }
 
 func (h *ToHeader) Name() string { return "To" }
@@ -290,7 +734,33 @@ func (h *ToHeader) Copy() SipHeader {
 		temp := *h.DisplayName
 		name = &temp
 	}
-	return &ToHeader{name, h.Address.Copy(), h.Params.Copy()}
+	return &ToHeader{name, h.Address.Copy(), h.Params.Copy(), h.NameAddrPolicy}
+}
+
+// Determine if the two headers refer to the same address; that is, if their URIs are equal.
+// The display name is cosmetic and is ignored, as are the header params, including the tag.
+// Use SameDialogParty instead when matching a message against a dialog.
+func (to *ToHeader) SameAddress(other *ToHeader) bool {
+	return to.Address.Equals(other.Address)
+}
+
+// Determine if the two headers refer to the same party within a dialog; that is, if their URIs are equal
+// and they carry the same tag (or both lack one). Tags are compared case-sensitively.
+// The display name and any other header params are ignored.
+func (to *ToHeader) SameDialogParty(other *ToHeader) bool {
+	return to.SameAddress(other) && tagsEqual(to.Params, other.Params)
+}
+
+// Determine if the 'tag' params in the two sets of header params are the same.
+func tagsEqual(a Params, b Params) bool {
+	aTag, aOk := a["tag"]
+	bTag, bOk := b["tag"]
+	if aOk != bOk {
+		return false
+	} else if !aOk || aTag == nil || bTag == nil {
+		return aTag == bTag
+	}
+	return *aTag == *bTag
 }
 
 type FromHeader struct {
@@ -301,20 +771,19 @@ type FromHeader struct {
 
 	// Any parameters present in the header.
 	Params Params
+
+	// Whether the URI may be serialized without angle brackets. The zero value always brackets it.
+	NameAddrPolicy NameAddrPolicy
 }
 
 func (from *FromHeader) String() string {
-	var buffer bytes.Buffer
-	buffer.WriteString("From: ")
-
-	if from.DisplayName != nil {
-		buffer.WriteString(fmt.Sprintf("\"%s\" ", *from.DisplayName))
-	}
-
-	buffer.WriteString(fmt.Sprintf("<%s>", from.Address))
-	buffer.WriteString(ParamsToString(from.Params, ';', ';'))
+	return string(from.AppendString(nil))
+}
 
-	return buffer.String()
+// Append the string representation of the header to the given buffer; see StringAppender.
+func (from *FromHeader) AppendString(buf []byte) []byte {
+	buf = append(buf, "From: "...)
+	return appendNameAddr(buf, from.DisplayName, from.Address, from.Params, from.NameAddrPolicy)
 }
 
 func (h *FromHeader) Name() string { return "From" }
@@ -326,7 +795,7 @@ func (h *FromHeader) Copy() SipHeader {
 		temp := *h.DisplayName
 		name = &temp
 	}
-	return &FromHeader{name, h.Address.Copy(), h.Params.Copy()}
+	return &FromHeader{name, h.Address.Copy(), h.Params.Copy(), h.NameAddrPolicy}
 }
 
 type ContactHeader struct {
@@ -340,28 +809,127 @@ type ContactHeader struct {
 }
 
 func (contact *ContactHeader) String() string {
-	var buffer bytes.Buffer
-	buffer.WriteString("Contact: ")
+	return string(contact.AppendString(nil))
+}
+
+// Append the string representation of the header to the given buffer; see StringAppender.
+func (contact *ContactHeader) AppendString(buf []byte) []byte {
+	buf = append(buf, "Contact: "...)
 
 	if contact.DisplayName != nil {
-		buffer.WriteString(fmt.Sprintf("\"%s\" ", *contact.DisplayName))
+		buf = append(buf, quote(*contact.DisplayName)...)
+		buf = append(buf, ' ')
 	}
 
 	switch contact.Address.(type) {
 	case *WildcardUri:
 		// Treat the Wildcard URI separately as it must not be contained in < > angle brackets.
-		buffer.WriteString("*")
+		buf = append(buf, '*')
 	default:
-		buffer.WriteString(fmt.Sprintf("<%s>", contact.Address.String()))
+		buf = append(buf, '<')
+		buf = appendString(buf, contact.Address)
+		buf = append(buf, '>')
 	}
 
-	buffer.WriteString(ParamsToString(contact.Params, ';', ';'))
-
-	return buffer.String()
+	return appendParams(buf, contact.Params, ';', ';', genValueString)
 }
 
 func (h *ContactHeader) Name() string { return "Contact" }
 
+// Create a Contact header for the given local URI, e.g. for a REGISTER request or to put in a dialog-creating
+// request, with an 'expires' param if expires isn't nil. The URI is copied, so any params it carries, such as
+// 'transport', are kept without the header sharing them.
+func NewContactHeader(uri *SipUri, expires *uint32) *ContactHeader {
+	contact := &ContactHeader{Address: uri.Copy().(*SipUri), Params: Params{}}
+	if expires != nil {
+		value := strconv.FormatUint(uint64(*expires), 10)
+		contact.Params["expires"] = &value
+	}
+	return contact
+}
+
+// Create a Contact header for registering a SIP Outbound flow (RFC 5626 s. 4.2): as NewContactHeader, with a
+// '+sip.instance' param holding the given instance ID, e.g. "urn:uuid:f81d4fae-7dec-11d0-a765-00a0c91e6bf6",
+// and a 'reg-id' param holding the given flow number.
+func NewOutboundContactHeader(uri *SipUri, expires *uint32, instanceId string, regId uint32) *ContactHeader {
+	contact := NewContactHeader(uri, expires)
+	instance := "<" + instanceId + ">"
+	flow := strconv.FormatUint(uint64(regId), 10)
+	contact.Params["+sip.instance"] = &instance
+	contact.Params["reg-id"] = &flow
+	return contact
+}
+
+// Get the 'reg-id' param of the Contact, which identifies the registration flow in SIP Outbound (RFC 5626).
+// The second return value is false if the param is absent or is not a valid number.
+func (h *ContactHeader) RegID() (uint32, bool) {
+	regId, ok := h.Params["reg-id"]
+	if !ok || regId == nil {
+		return 0, false
+	}
+	value, err := strconv.ParseUint(*regId, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(value), true
+}
+
+// Determine if the Contact URI carries the valueless 'ob' param, which indicates that the UA supports
+// SIP Outbound and that requests to it should be routed over the flow it registered on (RFC 5626).
+func (h *ContactHeader) IsOutbound() bool {
+	uri, ok := h.Address.(*SipUri)
+	if !ok {
+		return false
+	}
+	_, ok = uri.UriParams["ob"]
+	return ok
+}
+
+// The media feature tags from the base tree (RFC 3840 s. 10), which appear as Contact params without a
+// leading '+'. Tags from other trees are always prefixed with '+', e.g. '+sip.instance'.
+var baseFeatureTags = map[string]bool{
+	"actor": true, "application": true, "audio": true, "automata": true, "class": true, "control": true,
+	"data": true, "description": true, "duplex": true, "events": true, "extensions": true, "isfocus": true,
+	"language": true, "methods": true, "mobility": true, "priority": true, "schemes": true, "text": true,
+	"type": true, "video": true,
+}
+
+// Get the media feature tags advertised by the Contact (RFC 3840), such as 'audio', 'methods' or
+// '+sip.instance', leaving out ordinary params such as 'expires' and 'q'. Feature tag names are matched
+// case-insensitively, and are returned as they appear in the header. Valueless tags, which mean 'true',
+// have a nil value. The returned map is a copy, so changes to it don't affect the header.
+func (h *ContactHeader) FeatureTags() map[string]*string {
+	tags := make(map[string]*string)
+	for name, value := range h.Params {
+		if strings.HasPrefix(name, "+") || baseFeatureTags[strings.ToLower(name)] {
+			tags[name] = copyStrPtr(value)
+		}
+	}
+	return tags
+}
+
+// Rewrite the host and port of the Contact URI, leaving the scheme, user, password, params and headers
+// of the URI as they were. A registrar can use this to bind a NATed client to the address its requests
+// were observed to come from, rather than the private address it advertised. A nil port removes any port.
+// Returns an error if the Contact URI is not a SIP URI, e.g. if it is the wildcard.
+func (h *ContactHeader) SetURIHost(host string, port *uint16) error {
+	uri, ok := h.Address.(*SipUri)
+	if !ok {
+		return fmt.Errorf("cannot set the host of Contact URI '%s', which is not a SIP URI", h.Address.String())
+	}
+	if len(host) == 0 {
+		return fmt.Errorf("cannot set an empty host on Contact URI '%s'", uri.String())
+	}
+
+	uri.Host = host
+	uri.Port = nil
+	if port != nil {
+		temp := *port
+		uri.Port = &temp
+	}
+	return nil
+}
+
 // Copy the header. A little tricky due to string pointers.
 func (h *ContactHeader) Copy() SipHeader {
 	var name *string
@@ -372,12 +940,26 @@ func (h *ContactHeader) Copy() SipHeader {
 	return &ContactHeader{name, h.Address.Copy().(ContactUri), h.Params.Copy()}
 }
 
+// The Call-ID of a message. This is an opaque identifier, and so is case-sensitive: it must never be
+// case-folded (for example, when used as a map key for dialog lookup), or distinct calls may collide.
 type CallId string
 
+// Determine if the Call-ID equals some other Call-ID.
+// Call-IDs are compared byte-for-byte, with no case-insensitivity (RFC 3261 s. 20.8).
+func (callId *CallId) Equals(other CallId) bool {
+	return *callId == other
+}
+
 func (callId CallId) String() string {
 	return "Call-Id: " + (string)(callId)
 }
 
+// Append the string representation of the header to the given buffer; see StringAppender.
+func (callId CallId) AppendString(buf []byte) []byte {
+	buf = append(buf, "Call-Id: "...)
+	return append(buf, callId...)
+}
+
 func (h *CallId) Name() string { return "Call-Id" }
 
 func (h *CallId) Copy() SipHeader {
@@ -391,7 +973,15 @@ type CSeq struct {
 }
 
 func (cseq *CSeq) String() string {
-	return fmt.Sprintf("CSeq: %d %s", cseq.SeqNo, cseq.MethodName)
+	return string(cseq.AppendString(nil))
+}
+
+// Append the string representation of the header to the given buffer; see StringAppender.
+func (cseq *CSeq) AppendString(buf []byte) []byte {
+	buf = append(buf, "CSeq: "...)
+	buf = strconv.AppendUint(buf, uint64(cseq.SeqNo), 10)
+	buf = append(buf, ' ')
+	return append(buf, cseq.MethodName...)
 }
 
 func (h *CSeq) Name() string { return "CSeq" }
@@ -401,193 +991,2055 @@ func (h *CSeq) Copy() SipHeader { return &CSeq{h.SeqNo, h.MethodName} }
 type MaxForwards uint32
 
 func (maxForwards MaxForwards) String() string {
-	return fmt.Sprintf("Max-Forwards: %d", ((int)(maxForwards)))
+	return string(maxForwards.AppendString(nil))
+}
+
+// Append the string representation of the header to the given buffer; see StringAppender.
+func (maxForwards MaxForwards) AppendString(buf []byte) []byte {
+	buf = append(buf, "Max-Forwards: "...)
+	return strconv.AppendUint(buf, uint64(maxForwards), 10)
 }
 
 func (h MaxForwards) Name() string { return "Max-Forwards" }
 
-func (h MaxForwards) Copy() SipHeader { return h }
+func (h MaxForwards) Copy() SipHeader { return &h }
 
-type ContentLength uint32
+// Parse a delta-seconds value: a non-negative count of seconds, written as decimal digits (RFC 3261 s. 25.1).
+// This is the syntax of the Expires and Min-Expires headers, and of params such as the 'expires' param of a
+// Contact or a Subscription-State header. Values above 2^32-1 are rejected with an error rather than
+// wrapping or being truncated, as are signs, whitespace and any other non-digit characters.
+func ParseDeltaSeconds(text string) (uint32, error) {
+	if len(text) == 0 {
+		return 0, fmt.Errorf("empty delta-seconds value")
+	}
+	for idx := 0; idx < len(text); idx++ {
+		if text[idx] < '0' || text[idx] > '9' {
+			return 0, fmt.Errorf("invalid delta-seconds value '%s': not a decimal number", text)
+		}
+	}
 
-func (contentLength ContentLength) String() string {
-	return fmt.Sprintf("Content-Length: %d", ((int)(contentLength)))
+	value, err := strconv.ParseUint(text, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid delta-seconds value '%s': exceeds %d", text, uint32(math.MaxUint32))
+	}
+	return uint32(value), nil
 }
 
-func (h ContentLength) Name() string { return "Content-Length" }
+// Parse a ttl value, the time-to-live of a multicast request: one to three decimal digits, from 0 to 255
+// (RFC 3261 s. 25.1). This is the syntax of the 'ttl' param of both a Via hop and a SIP URI.
+func ParseTtl(text string) (uint8, error) {
+	if len(text) == 0 || len(text) > 3 {
+		return 0, fmt.Errorf("invalid ttl value '%s': must be from 0 to 255", text)
+	}
+	for idx := 0; idx < len(text); idx++ {
+		if text[idx] < '0' || text[idx] > '9' {
+			return 0, fmt.Errorf("invalid ttl value '%s': not a decimal number", text)
+		}
+	}
 
-func (h ContentLength) Copy() SipHeader { return h }
+	value, err := strconv.ParseUint(text, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl value '%s': must be from 0 to 255", text)
+	}
+	return uint8(value), nil
+}
 
-type ViaHeader []*ViaHop
+// 'Expires:' gives the relative time in seconds after which a message or its content expires (RFC 3261 s. 20.19).
+type Expires uint32
 
-// A single component in a Via header.
-// Via headers are composed of several segments of the same structure, added by successive nodes in a routing chain.
-type ViaHop struct {
-	// E.g. 'SIP'.
-	ProtocolName string
+func (expires Expires) String() string {
+	return fmt.Sprintf("Expires: %d", ((int)(expires)))
+}
 
-	// E.g. '2.0'.
-	ProtocolVersion string
-	Transport       string
-	Host            string
+func (h Expires) Name() string { return "Expires" }
 
-	// The port for this via hop. This is stored as a pointer type, since it is an optional field.
-	Port *uint16
+func (h Expires) Copy() SipHeader { return &h }
 
-	Params Params
+// 'Min-Expires:' gives the minimum refresh interval supported by a registrar, in a 423 (Interval Too Brief)
+// response (RFC 3261 s. 20.23).
+type MinExpires uint32
+
+func (minExpires MinExpires) String() string {
+	return fmt.Sprintf("Min-Expires: %d", ((int)(minExpires)))
 }
 
-func (hop *ViaHop) String() string {
-	var buffer bytes.Buffer
-	buffer.WriteString(fmt.Sprintf("%s/%s/%s %s",
-		hop.ProtocolName, hop.ProtocolVersion,
-		hop.Transport,
-		hop.Host))
-	if hop.Port != nil {
-		buffer.WriteString(fmt.Sprintf(":%d", *hop.Port))
-	}
+func (h MinExpires) Name() string { return "Min-Expires" }
 
-	buffer.WriteString(ParamsToString(hop.Params, ';', ';'))
+func (h MinExpires) Copy() SipHeader { return &h }
 
-	return buffer.String()
+// 'RSeq:' numbers a reliable provisional response, so that it can be acknowledged by a PRACK (RFC 3262 s. 7.1).
+type RSeq uint32
+
+func (rseq RSeq) String() string {
+	return fmt.Sprintf("RSeq: %d", ((int)(rseq)))
 }
 
-// Return an exact copy of this ViaHop.
-func (hop *ViaHop) Copy() *ViaHop {
-	var port *uint16 = nil
-	if hop.Port != nil {
-		temp := *hop.Port
-		port = &temp
+func (h RSeq) Name() string { return "RSeq" }
+
+func (h RSeq) Copy() SipHeader { return &h }
+
+// Determine the expiry, in seconds, of the binding represented by the given Contact in a REGISTER request
+// (RFC 3261 s. 10.3): the 'expires' param of the Contact if it has one, otherwise the value of the
+// message's Expires header (which may be nil), otherwise the given default.
+func EffectiveExpiry(contact *ContactHeader, expires *Expires, defaultExpiry uint32) uint32 {
+	if contact != nil {
+		if param, ok := contact.Params["expires"]; ok && param != nil {
+			if value, err := ParseDeltaSeconds(strings.TrimSpace(*param)); err == nil {
+				return value
+			}
+		}
 	}
-	return &ViaHop{
-		hop.ProtocolName,
-		hop.ProtocolVersion,
-		hop.Transport,
-		hop.Host,
-		port,
-		hop.Params.Copy(),
+
+	if expires != nil {
+		return uint32(*expires)
 	}
+
+	return defaultExpiry
 }
 
-func (via ViaHeader) String() string {
-	var buffer bytes.Buffer
-	buffer.WriteString("Via: ")
+type ContentLength uint32
+
+func (contentLength ContentLength) String() string {
+	return string(contentLength.AppendString(nil))
+}
+
+// Append the string representation of the header to the given buffer; see StringAppender.
+func (contentLength ContentLength) AppendString(buf []byte) []byte {
+	buf = append(buf, "Content-Length: "...)
+	return strconv.AppendUint(buf, uint64(contentLength), 10)
+}
+
+func (h ContentLength) Name() string { return "Content-Length" }
+
+func (h ContentLength) Copy() SipHeader { return &h }
+
+// The media type of a message body, e.g. "application/sdp", including any parameters.
+type ContentType string
+
+func (contentType ContentType) String() string {
+	return "Content-Type: " + (string)(contentType)
+}
+
+// Append the string representation of the header to the given buffer; see StringAppender.
+func (contentType ContentType) AppendString(buf []byte) []byte {
+	buf = append(buf, "Content-Type: "...)
+	return append(buf, contentType...)
+}
+
+func (h *ContentType) Name() string { return "Content-Type" }
+
+func (h *ContentType) Copy() SipHeader {
+	temp := *h
+	return &temp
+}
+
+// Get the media type of the Content-Type, e.g. "multipart/mixed", in lower case and without any params.
+func (contentType ContentType) MediaType() string {
+	mediaType := string(contentType)
+	if paramsIdx := strings.Index(mediaType, ";"); paramsIdx != -1 {
+		mediaType = mediaType[:paramsIdx]
+	}
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+// 'Content-ID:' identifies a body, or a part of a multipart body, so that it can be referenced elsewhere
+// with a cid: URI (RFC 2392), e.g. from a Refer-To header or a resource list.
+type ContentIDHeader struct {
+	// The id, without the enclosing angle brackets: e.g. "abc@atlanta.com".
+	Id string
+}
+
+// Create a Content-ID header with the given id, which may be given with or without its angle brackets.
+func NewContentIDHeader(id string) *ContentIDHeader {
+	id = strings.TrimSpace(id)
+	if strings.HasPrefix(id, "<") && strings.HasSuffix(id, ">") {
+		id = id[1 : len(id)-1]
+	}
+	return &ContentIDHeader{id}
+}
+
+func (h *ContentIDHeader) String() string {
+	return "Content-ID: <" + h.Id + ">"
+}
+
+func (h *ContentIDHeader) Name() string { return "Content-ID" }
+
+func (h *ContentIDHeader) Copy() SipHeader {
+	return &ContentIDHeader{h.Id}
+}
+
+// 'Content-Disposition:' says how the body, or a part of a multipart body, is to be interpreted
+// (RFC 3261 s. 20.11); e.g. "session" for a session description, or "render" for content to be displayed.
+type ContentDispositionHeader struct {
+	DispositionType string
+	Params          Params
+}
+
+func (h *ContentDispositionHeader) String() string {
+	return "Content-Disposition: " + h.DispositionType + ParamsToString(h.Params, ';', ';')
+}
+
+func (h *ContentDispositionHeader) Name() string { return "Content-Disposition" }
+
+func (h *ContentDispositionHeader) Copy() SipHeader {
+	return &ContentDispositionHeader{h.DispositionType, h.Params.Copy()}
+}
+
+type ViaHeader []*ViaHop
+
+// A single component in a Via header.
+// Via headers are composed of several segments of the same structure, added by successive nodes in a routing chain.
+type ViaHop struct {
+	// E.g. 'SIP'.
+	ProtocolName string
+
+	// E.g. '2.0'.
+	ProtocolVersion string
+	Transport       string
+	Host            string
+
+	// The port for this via hop. This is stored as a pointer type, since it is an optional field.
+	Port *uint16
+
+	Params Params
+}
+
+// Create a new Via hop with the given transport and sent-by address, using SIP/2.0 as the protocol.
+// The hop has no params; in particular, a branch must be added before use (see GenerateBranch).
+func NewViaHop(transport string, host string, port *uint16) *ViaHop {
+	return &ViaHop{"SIP", "2.0", transport, host, port, Params{}}
+}
+
+// Build the Via hop for an outgoing request, as a client stamps it: SIP/2.0 over the given transport, with the
+// given sent-by address and a newly generated branch (see GenerateBranch). If wantRport is true, a valueless
+// 'rport' param is added, asking the server to respond to the port the request came from (RFC 3581).
+// The port is copied, so the caller may reuse it.
+func BuildVia(transport Transport, host string, port *uint16, wantRport bool) *ViaHop {
+	hop := NewViaHop(string(transport), host, nil)
+	hop.SetSentBy(host, port)
+	branch := GenerateBranch()
+	hop.Params["branch"] = &branch
+	if wantRport {
+		hop.Params["rport"] = nil
+	}
+	return hop
+}
+
+func (hop *ViaHop) String() string {
+	return string(hop.AppendString(nil))
+}
+
+// Append the string representation of the hop to the given buffer; see StringAppender.
+func (hop *ViaHop) AppendString(buf []byte) []byte {
+	buf = append(buf, hop.ProtocolName...)
+	buf = append(buf, '/')
+	buf = append(buf, hop.ProtocolVersion...)
+	buf = append(buf, '/')
+	buf = append(buf, hop.Transport...)
+	buf = append(buf, ' ')
+	buf = append(buf, hop.Host...)
+	if hop.Port != nil {
+		buf = append(buf, ':')
+		buf = strconv.AppendUint(buf, uint64(*hop.Port), 10)
+	}
+
+	return appendParams(buf, hop.Params, ';', ';', viaParamValueString)
+}
+
+// Produce the representation of a Via param value. The 'received' and 'maddr' params may hold an IPv6 address
+// or reference, which isn't a token, but which the grammar takes bare rather than quoted (RFC 3261 s. 25.1,
+// RFC 5118 s. 4.5); other values are represented as they are in other headers.
+func viaParamValueString(value string) string {
+	if strings.Contains(value, ":") && net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")) != nil {
+		return value
+	}
+	return genValueString(value)
+}
+
+// Return an exact copy of this ViaHop.
+func (hop *ViaHop) Copy() *ViaHop {
+	var port *uint16 = nil
+	if hop.Port != nil {
+		temp := *hop.Port
+		port = &temp
+	}
+	return &ViaHop{
+		hop.ProtocolName,
+		hop.ProtocolVersion,
+		hop.Transport,
+		hop.Host,
+		port,
+		hop.Params.Copy(),
+	}
+}
+
+// Replace the sent-by address of the hop, leaving its params intact. This is useful for topology hiding.
+func (hop *ViaHop) SetSentBy(host string, port *uint16) {
+	hop.Host = host
+	if port == nil {
+		hop.Port = nil
+	} else {
+		temp := *port
+		hop.Port = &temp
+	}
+}
+
+// Get the sent-by address of the hop, as 'host' or 'host:port'. IPv6 addresses are enclosed in brackets.
+func (hop *ViaHop) SentBy() string {
+	return hostPortString(hop.Host, hop.Port)
+}
+
+// Get the sent-by address of the hop as 'host:port', filling in the default port for the hop's
+// transport if the hop has no port: 5061 for TLS, and 5060 otherwise (RFC 3261 s. 18.2.2).
+func (hop *ViaHop) SentByWithDefaultPort() string {
+	port := hop.Port
+	if port == nil {
+		defaultPort := DefaultPort(hop.Transport)
+		port = &defaultPort
+	}
+	return hostPortString(hop.Host, port)
+}
+
+// Get the value of the 'branch' param, which identifies the transaction the hop belongs to (RFC 3261 s. 8.1.1.7).
+// The second return value is false if the hop has no branch.
+func (hop *ViaHop) Branch() (string, bool) {
+	return hop.stringParam("branch")
+}
+
+// Get the value of the 'received' param, the source address of the request as seen by the next hop
+// (RFC 3261 s. 18.2.1). The second return value is false if the hop has no received address.
+func (hop *ViaHop) Received() (string, bool) {
+	return hop.stringParam("received")
+}
+
+// Get the value of the 'maddr' param, the multicast address to which responses should be sent
+// (RFC 3261 s. 18.2.2). The second return value is false if the hop has no maddr.
+func (hop *ViaHop) MAddr() (string, bool) {
+	return hop.stringParam("maddr")
+}
+
+// Get the value of the 'comp' param, which names the compression the sender supports, e.g. "sigcomp"
+// (RFC 3486). The second return value is false if the hop has no comp param.
+func (hop *ViaHop) Comp() (string, bool) {
+	return hop.stringParam("comp")
+}
+
+// Determine if the hop carries 'comp=sigcomp', meaning that the sender supports SigComp (RFC 3486).
+// gossip doesn't implement SigComp, but preserves the param when relaying.
+func (hop *ViaHop) IsSigcomp() bool {
+	comp, ok := hop.Comp()
+	return ok && strings.EqualFold(comp, "sigcomp")
+}
+
+// Get the value of the 'ttl' param, the time-to-live of a multicast request (RFC 3261 s. 18.1.1).
+// The second return value is false if the param is absent or is not a number from 0 to 255.
+func (hop *ViaHop) TTL() (uint8, bool) {
+	ttl, ok := hop.Params["ttl"]
+	if !ok || ttl == nil {
+		return 0, false
+	}
+	value, err := ParseTtl(*ttl)
+	if err != nil {
+		return 0, false
+	}
+	return value, true
+}
+
+// Get the 'rport' param, through which a client asks for responses to be sent to the port the request
+// came from (RFC 3581). The client sends the param without a value, in which case the port returned is
+// nil; the server fills in the source port when it receives the request (see FixupTopViaForReceipt).
+// The second return value is false if the param is absent or its value is not a valid port.
+func (hop *ViaHop) RPort() (*uint16, bool) {
+	rport, ok := hop.Params["rport"]
+	if !ok {
+		return nil, false
+	} else if rport == nil || *rport == "" {
+		return nil, true
+	}
+	value, err := strconv.ParseUint(*rport, 10, 16)
+	if err != nil {
+		return nil, false
+	}
+	port := uint16(value)
+	return &port, true
+}
+
+// Get the value of the named param, if the hop has it with a value.
+func (hop *ViaHop) stringParam(name string) (string, bool) {
+	value, ok := hop.Params[name]
+	if !ok || value == nil {
+		return "", false
+	}
+	return *value, true
+}
+
+// Get the default port for the given transport: 5061 for TLS, and 5060 otherwise.
+func DefaultPort(transport string) uint16 {
+	if NormalizeTransport(transport) == "TLS" {
+		return DEFAULT_SIPS_PORT
+	}
+	return DEFAULT_SIP_PORT
+}
+
+// Produce 'host' or 'host:port', enclosing IPv6 addresses in brackets.
+func hostPortString(host string, port *uint16) string {
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		host = "[" + host + "]"
+	}
+	if port == nil {
+		return host
+	}
+	return fmt.Sprintf("%s:%d", host, *port)
+}
+
+func (via ViaHeader) String() string {
+	return string(via.AppendString(nil))
+}
+
+// Append the string representation of the header to the given buffer; see StringAppender.
+func (via ViaHeader) AppendString(buf []byte) []byte {
+	buf = append(buf, "Via: "...)
 	for idx, hop := range via {
-		buffer.WriteString(hop.String())
+		buf = hop.AppendString(buf)
 		if idx != len(via)-1 {
+			buf = append(buf, ", "...)
+		}
+	}
+
+	return buf
+}
+
+func (h ViaHeader) Name() string { return "Via" }
+
+func (h ViaHeader) Copy() SipHeader {
+	dup := make([]*ViaHop, 0, len(h))
+	for _, hop := range h {
+		dup = append(dup, hop.Copy())
+	}
+	via := ViaHeader(dup)
+	return &via
+}
+
+// Get the hops of the header as a single logical Via header. A ViaHeader is already flat within its own
+// line, so this is a copy of the header's list of hops, sharing the hops themselves; see also ViaChain on a
+// message, which flattens all the Via lines in the message.
+func (via ViaHeader) Flatten() ViaHeader {
+	return append(ViaHeader{}, via...)
+}
+
+// Split the header into one single-hop header per hop, in order, as emitted on separate 'Via:' lines.
+// This is the inverse of ViaChain.
+func (via ViaHeader) Split() []ViaHeader {
+	result := make([]ViaHeader, 0, len(via))
+	for _, hop := range via {
+		result = append(result, ViaHeader{hop})
+	}
+	return result
+}
+
+// The transports which may be named in the sent-protocol of a Via header, or in the 'transport' param of
+// a SIP URI. WS and WSS are the WebSocket transports defined by RFC 7118.
+// Other transport tokens are permitted by the grammar, and are accepted by the parser, but are not known to gossip.
+var KnownTransports = []string{"UDP", "TCP", "TLS", "SCTP", "WS", "WSS"}
+
+// Normalize a transport name to the upper-case token used in the Via header, so that e.g. the 'ws' from
+// a URI 'transport=ws' param can be compared against the 'WS' in a Via hop.
+func NormalizeTransport(transport string) string {
+	return strings.ToUpper(strings.TrimSpace(transport))
+}
+
+// A transport protocol, in the upper-case form used in the sent-protocol of a Via header.
+type Transport string
+
+const (
+	UDP  Transport = "UDP"
+	TCP  Transport = "TCP"
+	TLS  Transport = "TLS"
+	SCTP Transport = "SCTP"
+	WS   Transport = "WS"
+	WSS  Transport = "WSS"
+)
+
+// Determine the transport to use to reach the given URI without consulting DNS (RFC 3263 s. 4.1).
+// An explicit 'transport' param takes precedence, except that a SIPS URI always uses a secure transport,
+// so 'transport=tcp' on a SIPS URI means TLS, and 'transport=ws' means WSS. Without the param, a SIPS URI
+// uses TLS and a SIP URI uses UDP; see TransportResolver to use a different default.
+func ResolveTransport(uri *SipUri) Transport {
+	return TransportResolver{UDP}.Resolve(uri)
+}
+
+// Determine if the URI's 'transport' param is consistent with its scheme. It isn't if a SIP URI asks for TLS,
+// which a SIPS URI should be used for instead (RFC 3261 s. 26.2.2), or if a SIPS URI asks for UDP, which
+// can't be secured with TLS. Such URIs are sent by some peers, and are resolved as ResolveTransport
+// describes, but are worth logging as interoperability anomalies.
+// A URI without a 'transport' param is always consistent.
+func (uri *SipUri) TransportSchemeConsistent() bool {
+	param, ok := uri.UriParams["transport"]
+	if !ok || param == nil {
+		return true
+	}
+
+	transport := Transport(NormalizeTransport(*param))
+	if uri.IsEncrypted {
+		return transport != UDP
+	}
+	return transport != TLS
+}
+
+// Resolves the transport to use to reach SIP URIs as ResolveTransport does, but with a configurable
+// transport for SIP URIs which have no 'transport' param.
+type TransportResolver struct {
+	// The transport for a SIP URI with no 'transport' param. If empty, UDP is used.
+	// It doesn't apply to SIPS URIs, which use TLS by default whatever its value.
+	DefaultTransport Transport
+}
+
+// Determine the transport to use to reach the given URI; see TransportResolver and ResolveTransport.
+func (resolver TransportResolver) Resolve(uri *SipUri) Transport {
+	if param, ok := uri.UriParams["transport"]; ok && param != nil && len(*param) > 0 {
+		transport := Transport(NormalizeTransport(*param))
+		if uri.IsEncrypted && transport == TCP {
+			return TLS
+		} else if uri.IsEncrypted && transport == WS {
+			return WSS
+		}
+		return transport
+	}
+
+	if uri.IsEncrypted {
+		return TLS
+	} else if resolver.DefaultTransport != "" {
+		return Transport(NormalizeTransport(string(resolver.DefaultTransport)))
+	}
+	return UDP
+}
+
+// Determine if the transport carries a byte stream rather than discrete messages, so that SIP messages sent
+// over it must be framed by their Content-Length.
+func (transport Transport) IsStream() bool {
+	return transport == TCP || transport == TLS
+}
+
+// Determine if the given transport, compared case-insensitively, is one of the KnownTransports.
+func IsKnownTransport(transport string) bool {
+	transport = NormalizeTransport(transport)
+	for _, known := range KnownTransports {
+		if transport == known {
+			return true
+		}
+	}
+	return false
+}
+
+// The magic cookie which starts the branch parameter of every Via hop generated by an RFC 3261-compliant
+// element (RFC 3261 s. 8.1.1.7).
+const RFC3261_BRANCH_MAGIC_COOKIE = "z9hG4bK"
+
+// Generate a new random tag for a From or To header (RFC 3261 s. 19.3).
+func GenerateTag() string {
+	randBytes := make([]byte, 8)
+	rand.Read(randBytes)
+	return hex.EncodeToString(randBytes)
+}
+
+// Generate a new, globally unique, branch parameter for a Via hop, starting with the RFC 3261 magic cookie.
+func GenerateBranch() string {
+	randBytes := make([]byte, 16)
+	rand.Read(randBytes)
+	return RFC3261_BRANCH_MAGIC_COOKIE + hex.EncodeToString(randBytes)
+}
+
+// A Route header, containing an ordered list of the URIs a request should be routed through.
+type RouteHeader struct {
+	Addresses []Uri
+}
+
+func (header *RouteHeader) String() string {
+	return "Route: " + addressListString(header.Addresses)
+}
+
+func (h *RouteHeader) Name() string { return "Route" }
+
+func (h *RouteHeader) Copy() SipHeader {
+	return &RouteHeader{copyUris(h.Addresses)}
+}
+
+// A Record-Route header, containing an ordered list of the URIs of proxies which wish to remain on the
+// signalling path for subsequent requests in a dialog.
+type RecordRouteHeader struct {
+	Addresses []Uri
+}
+
+func (header *RecordRouteHeader) String() string {
+	return "Record-Route: " + addressListString(header.Addresses)
+}
+
+func (h *RecordRouteHeader) Name() string { return "Record-Route" }
+
+// Replace the host and port of every SIP URI in the header with those given, preserving the user part and
+// any params (such as 'lr'). This is useful for topology hiding, where a proxy's internal addresses are
+// replaced with its own public address. URIs which aren't SIP URIs are left unchanged.
+func (h *RecordRouteHeader) RewriteHosts(host string, port *uint16) {
+	for _, address := range h.Addresses {
+		if uri, ok := address.(*SipUri); ok {
+			uri.Host = host
+			if port == nil {
+				uri.Port = nil
+			} else {
+				temp := *port
+				uri.Port = &temp
+			}
+		}
+	}
+}
+
+func (h *RecordRouteHeader) Copy() SipHeader {
+	return &RecordRouteHeader{copyUris(h.Addresses)}
+}
+
+// A Path header, containing an ordered list of the URIs of proxies on the path between a registering UA and
+// its registrar, which requests to the UA should be routed through (RFC 3327).
+type PathHeader struct {
+	Addresses []Uri
+}
+
+func (header *PathHeader) String() string {
+	return "Path: " + addressListString(header.Addresses)
+}
+
+func (h *PathHeader) Name() string { return "Path" }
+
+func (h *PathHeader) Copy() SipHeader {
+	return &PathHeader{copyUris(h.Addresses)}
+}
+
+// A single identity in a P-Asserted-Identity header.
+type AssertedIdentity struct {
+	// The display name from the identity - this is a pointer type as it is optional.
+	DisplayName *string
+
+	Address Uri
+}
+
+func (identity *AssertedIdentity) String() string {
+	return nameAddrString(identity.DisplayName, identity.Address)
+}
+
+func (identity *AssertedIdentity) Copy() *AssertedIdentity {
+	return &AssertedIdentity{copyStrPtr(identity.DisplayName), identity.Address.Copy()}
+}
+
+// 'P-Asserted-Identity:' carries the identity of the user sending a request, as asserted by a proxy within
+// a network of trusted elements (RFC 3325 s. 9.1). There may be up to two identities: a SIP or SIPS URI,
+// and a tel URI.
+type PAssertedIdentityHeader struct {
+	Identities []*AssertedIdentity
+}
+
+func (h *PAssertedIdentityHeader) String() string {
+	identities := make([]string, 0, len(h.Identities))
+	for _, identity := range h.Identities {
+		identities = append(identities, identity.String())
+	}
+	return "P-Asserted-Identity: " + strings.Join(identities, ", ")
+}
+
+func (h *PAssertedIdentityHeader) Name() string { return "P-Asserted-Identity" }
+
+func (h *PAssertedIdentityHeader) Copy() SipHeader {
+	dup := make([]*AssertedIdentity, 0, len(h.Identities))
+	for _, identity := range h.Identities {
+		dup = append(dup, identity.Copy())
+	}
+	return &PAssertedIdentityHeader{dup}
+}
+
+// The signature algorithm of PASSporTs, and the only one required of implementations (RFC 8225 s. 6).
+const IDENTITY_ALG_ES256 = "ES256"
+
+// The PASSporT extension used by SHAKEN for caller ID attestation (RFC 8588).
+const PPT_SHAKEN = "shaken"
+
+// 'Identity:' carries a signed assertion of the caller's identity, as a PASSporT token (RFC 8224 s. 4).
+type IdentityHeader struct {
+	// The signed-identity-digest: a PASSporT in JWT compact form (RFC 8225), which may run to several hundred
+	// characters.
+	Token string
+
+	// The URI from which the certificate which signed the token can be fetched, from the mandatory 'info'
+	// param; usually an https URI, so an AbsoluteUri.
+	Info Uri
+
+	// The value of the 'alg' param, which names the signature algorithm, e.g. IDENTITY_ALG_ES256; nil if
+	// the header has none.
+	Alg *string
+
+	// The value of the 'ppt' param, which names the PASSporT extension of the token, e.g. PPT_SHAKEN; nil if
+	// the header has none.
+	Ppt *string
+
+	// Any other params of the header.
+	Params Params
+}
+
+func (h *IdentityHeader) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteString("Identity: ")
+	buffer.WriteString(h.Token)
+	buffer.WriteString(";info=<")
+	buffer.WriteString(h.Info.String())
+	buffer.WriteString(">")
+	if h.Alg != nil {
+		buffer.WriteString(";alg=")
+		buffer.WriteString(*h.Alg)
+	}
+	if h.Ppt != nil {
+		buffer.WriteString(";ppt=")
+		buffer.WriteString(*h.Ppt)
+	}
+	buffer.WriteString(ParamsToString(h.Params, ';', ';'))
+	return buffer.String()
+}
+
+func (h *IdentityHeader) Name() string { return "Identity" }
+
+func (h *IdentityHeader) Copy() SipHeader {
+	return &IdentityHeader{h.Token, h.Info.Copy(), copyStrPtr(h.Alg), copyStrPtr(h.Ppt), h.Params.Copy()}
+}
+
+// Determine whether the token is a SHAKEN PASSporT, as given by the 'ppt' param, compared case-insensitively.
+// The attestation level is a claim of the token itself, which this package doesn't decode.
+func (h *IdentityHeader) IsShaken() bool {
+	return h.Ppt != nil && strings.EqualFold(*h.Ppt, PPT_SHAKEN)
+}
+
+// A feature-capability indicator (RFC 6809 s. 4), e.g. '+g.3gpp.srvcc-alerting'.
+type FeatureCap struct {
+	// The name of the indicator, including its leading '+'.
+	Name string
+
+	// The value of the indicator, without its enclosing double quotes; nil if the indicator has none.
+	Value *string
+}
+
+func (fcap *FeatureCap) String() string {
+	if fcap.Value == nil {
+		return fcap.Name
+	}
+	return fcap.Name + "=" + quote(*fcap.Value)
+}
+
+func (fcap *FeatureCap) Copy() *FeatureCap {
+	return &FeatureCap{fcap.Name, copyStrPtr(fcap.Value)}
+}
+
+// 'Feature-Caps:' indicates the features supported by a proxy or B2BUA on the path of a request, as
+// feature-capability indicators attached to a '*' (RFC 6809 s. 4). Each comma-separated value of the header
+// is parsed as a separate FeatureCapsHeader. The indicators are kept in the order they were received.
+type FeatureCapsHeader struct {
+	Caps []*FeatureCap
+}
+
+func (h *FeatureCapsHeader) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteString("Feature-Caps: *")
+	for _, fcap := range h.Caps {
+		buffer.WriteString(";")
+		buffer.WriteString(fcap.String())
+	}
+	return buffer.String()
+}
+
+func (h *FeatureCapsHeader) Name() string { return "Feature-Caps" }
+
+func (h *FeatureCapsHeader) Copy() SipHeader {
+	dup := make([]*FeatureCap, 0, len(h.Caps))
+	for _, fcap := range h.Caps {
+		dup = append(dup, fcap.Copy())
+	}
+	return &FeatureCapsHeader{dup}
+}
+
+// Get the indicator with the given name, including its leading '+' and compared case-insensitively, or nil
+// if there is none.
+func (h *FeatureCapsHeader) Cap(name string) *FeatureCap {
+	for _, fcap := range h.Caps {
+		if strings.EqualFold(fcap.Name, name) {
+			return fcap
+		}
+	}
+	return nil
+}
+
+// Produce a comma-separated list of the given URIs, each enclosed in angle brackets.
+func addressListString(uris []Uri) string {
+	var buffer bytes.Buffer
+	for idx, uri := range uris {
+		if idx > 0 {
 			buffer.WriteString(", ")
 		}
+		buffer.WriteString(fmt.Sprintf("<%s>", uri.String()))
+	}
+	return buffer.String()
+}
+
+// Produce a deep copy of the given list of URIs.
+func copyUris(uris []Uri) []Uri {
+	dup := make([]Uri, 0, len(uris))
+	for _, uri := range uris {
+		dup = append(dup, uri.Copy())
+	}
+	return dup
+}
+
+// 'Allow:' lists the methods supported by a UA (RFC 3261 s. 20.5).
+type AllowHeader struct {
+	Methods []Method
+}
+
+func (header *AllowHeader) String() string {
+	methods := make([]string, 0, len(header.Methods))
+	for _, method := range header.Methods {
+		methods = append(methods, string(method))
+	}
+	return fmt.Sprintf("Allow: %s",
+		strings.Join(methods, ", "))
+}
+
+func (h *AllowHeader) Name() string { return "Allow" }
+
+func (h *AllowHeader) Copy() SipHeader {
+	dup := make([]Method, len(h.Methods))
+	copy(dup, h.Methods)
+	return &AllowHeader{dup}
+}
+
+type RequireHeader struct {
+	Options []string
+}
+
+func (header *RequireHeader) String() string {
+	return fmt.Sprintf("Require: %s",
+		strings.Join(header.Options, ", "))
+}
+
+func (h *RequireHeader) Name() string { return "Require" }
+
+func (h *RequireHeader) Copy() SipHeader {
+	dup := make([]string, len(h.Options))
+	copy(dup, h.Options)
+	return &RequireHeader{dup}
+}
+
+// The option tag for reliable provisional responses (RFC 3262).
+const OPTION_100REL = "100rel"
+
+// The option tag for session timers (RFC 4028).
+const OPTION_TIMER = "timer"
+
+// The option tag for the Path header (RFC 3327).
+const OPTION_PATH = "path"
+
+// The option tag for SIP Outbound (RFC 5626).
+const OPTION_OUTBOUND = "outbound"
+
+// Determine if the given Supported header, which may be nil, advertises support for reliable
+// provisional responses.
+func Supports100rel(supported *SupportedHeader) bool {
+	return supported != nil && hasOption(supported.Options, OPTION_100REL)
+}
+
+// Determine if the given Require header, which may be nil, demands reliable provisional responses.
+func Requires100rel(require *RequireHeader) bool {
+	return require != nil && hasOption(require.Options, OPTION_100REL)
+}
+
+// Determine if the given option tag is among the given options. Option tags are compared case-insensitively.
+func hasOption(options []string, option string) bool {
+	for _, existing := range options {
+		if strings.EqualFold(existing, option) {
+			return true
+		}
+	}
+	return false
+}
+
+type SupportedHeader struct {
+	Options []string
+}
+
+func (header *SupportedHeader) String() string {
+	return fmt.Sprintf("Supported: %s",
+		strings.Join(header.Options, ", "))
+}
+
+func (h *SupportedHeader) Name() string { return "Supported" }
+
+func (h *SupportedHeader) Copy() SipHeader {
+	dup := make([]string, len(h.Options))
+	copy(dup, h.Options)
+	return &SupportedHeader{dup}
+}
+
+type ProxyRequireHeader struct {
+	Options []string
+}
+
+func (header *ProxyRequireHeader) String() string {
+	return fmt.Sprintf("Proxy-Require: %s",
+		strings.Join(header.Options, ", "))
+}
+
+func (h *ProxyRequireHeader) Name() string { return "Proxy-Require" }
+
+func (h *ProxyRequireHeader) Copy() SipHeader {
+	dup := make([]string, len(h.Options))
+	copy(dup, h.Options)
+	return &ProxyRequireHeader{dup}
+}
+
+// 'Unsupported:' is a SIP header type - this doesn't indicate that the
+// header itself is not supported by gossip!
+type UnsupportedHeader struct {
+	Options []string
+}
+
+func (header *UnsupportedHeader) String() string {
+	return fmt.Sprintf("Unsupported: %s",
+		strings.Join(header.Options, ", "))
+}
+
+func (h *UnsupportedHeader) Name() string { return "Unsupported" }
+
+func (h *UnsupportedHeader) Copy() SipHeader {
+	dup := make([]string, len(h.Options))
+	copy(dup, h.Options)
+	return &UnsupportedHeader{dup}
+}
+
+// A reference to an existing dialog by its Call-ID and tags, as carried in the Join header (RFC 3911) and the
+// Replaces header (RFC 3891).
+type DialogReference struct {
+	CallId  CallId
+	ToTag   string
+	FromTag string
+
+	// Any other parameters present in the header.
+	Params Params
+}
+
+func (ref *DialogReference) String() string {
+	return fmt.Sprintf("%s;to-tag=%s;from-tag=%s%s",
+		string(ref.CallId), ref.ToTag, ref.FromTag, ParamsToString(ref.Params, ';', ';'))
+}
+
+func (ref *DialogReference) copy() DialogReference {
+	return DialogReference{ref.CallId, ref.ToTag, ref.FromTag, ref.Params.Copy()}
+}
+
+// 'Join:' requests that the recipient add the new dialog to the referenced one, e.g. for a barge-in
+// or to join a conference (RFC 3911).
+type JoinHeader struct {
+	DialogReference
+}
+
+func (header *JoinHeader) String() string {
+	return "Join: " + header.DialogReference.String()
+}
+
+func (h *JoinHeader) Name() string { return "Join" }
+
+func (h *JoinHeader) Copy() SipHeader { return &JoinHeader{h.DialogReference.copy()} }
+
+// 'Replaces:' requests that the recipient replace the referenced dialog with the new one, e.g. for call
+// pickup or attended transfer (RFC 3891).
+type ReplacesHeader struct {
+	DialogReference
+}
+
+func (header *ReplacesHeader) String() string {
+	return "Replaces: " + header.DialogReference.String()
+}
+
+func (h *ReplacesHeader) Name() string { return "Replaces" }
+
+func (h *ReplacesHeader) Copy() SipHeader { return &ReplacesHeader{h.DialogReference.copy()} }
+
+// Determine if the header carries the valueless 'early-only' flag, which means that the referenced dialog
+// may only be replaced while it is early; if it has already been confirmed, the request must be rejected with
+// a 486 (Busy Here) response (RFC 3891 s. 3).
+func (h *ReplacesHeader) EarlyOnly() bool {
+	_, ok := h.Params["early-only"]
+	return ok
+}
+
+// 'Target-Dialog:' references an existing dialog by its Call-ID and tags, in a request sent outside of it, such
+// as a REFER; the recipient may authorize the request if the sender is a participant in that dialog (RFC 4538).
+// Its tags are named local-tag and remote-tag, rather than the to-tag and from-tag of Join and Replaces.
+type TargetDialogHeader struct {
+	CallId    CallId
+	LocalTag  string
+	RemoteTag string
+
+	// Any other parameters present in the header.
+	Params Params
+}
+
+func (header *TargetDialogHeader) String() string {
+	return fmt.Sprintf("Target-Dialog: %s;local-tag=%s;remote-tag=%s%s",
+		string(header.CallId), header.LocalTag, header.RemoteTag, ParamsToString(header.Params, ';', ';'))
+}
+
+func (h *TargetDialogHeader) Name() string { return "Target-Dialog" }
+
+func (h *TargetDialogHeader) Copy() SipHeader {
+	return &TargetDialogHeader{h.CallId, h.LocalTag, h.RemoteTag, h.Params.Copy()}
+}
+
+// A single entry in a History-Info header, recording one target of the request (RFC 4244).
+type HistoryInfoEntry struct {
+	// The display name from the entry - this is a pointer type as it is optional.
+	DisplayName *string
+
+	Address Uri
+
+	// The position of the entry in the history tree, as a dot-separated string (e.g. "1.1").
+	Index string
+
+	// Any other parameters present on the entry.
+	Params Params
+}
+
+func (entry *HistoryInfoEntry) String() string {
+	var buffer bytes.Buffer
+	buffer.WriteString(nameAddrString(entry.DisplayName, entry.Address))
+	buffer.WriteString(";index=" + entry.Index)
+	buffer.WriteString(ParamsToString(entry.Params, ';', ';'))
+
+	return buffer.String()
+}
+
+// Copy the entry. A little tricky due to string pointers.
+func (entry *HistoryInfoEntry) Copy() *HistoryInfoEntry {
+	var name *string
+	if entry.DisplayName != nil {
+		temp := *entry.DisplayName
+		name = &temp
+	}
+	return &HistoryInfoEntry{name, entry.Address.Copy(), entry.Index, entry.Params.Copy()}
+}
+
+// 'History-Info:' records the targets a request has been retargeted to, in order (RFC 4244).
+type HistoryInfoHeader struct {
+	Entries []*HistoryInfoEntry
+}
+
+func (header *HistoryInfoHeader) String() string {
+	entries := make([]string, 0, len(header.Entries))
+	for _, entry := range header.Entries {
+		entries = append(entries, entry.String())
+	}
+	return "History-Info: " + strings.Join(entries, ", ")
+}
+
+func (h *HistoryInfoHeader) Name() string { return "History-Info" }
+
+func (h *HistoryInfoHeader) Copy() SipHeader {
+	dup := make([]*HistoryInfoEntry, 0, len(h.Entries))
+	for _, entry := range h.Entries {
+		dup = append(dup, entry.Copy())
+	}
+	return &HistoryInfoHeader{dup}
+}
+
+// A single entry in a Diversion header, recording one diversion of the call (RFC 5806).
+type DiversionEntry struct {
+	// The display name from the entry - this is a pointer type as it is optional.
+	DisplayName *string
+
+	Address Uri
+
+	// The parameters of the entry, e.g. 'reason', 'counter', 'limit', 'privacy' and 'screen'.
+	Params Params
+}
+
+func (entry *DiversionEntry) String() string {
+	return nameAddrString(entry.DisplayName, entry.Address) + ParamsToString(entry.Params, ';', ';')
+}
+
+func (entry *DiversionEntry) Copy() *DiversionEntry {
+	return &DiversionEntry{copyStrPtr(entry.DisplayName), entry.Address.Copy(), entry.Params.Copy()}
+}
+
+// Get the reason for the diversion (e.g. "unconditional", "user-busy"), if the entry has one.
+func (entry *DiversionEntry) Reason() (string, bool) {
+	reason, ok := entry.Params["reason"]
+	if !ok || reason == nil {
+		return "", false
+	}
+	return *reason, true
+}
+
+// Get the number of times the call has been diverted, if the entry says.
+// The second return value is false if the counter is absent or malformed.
+func (entry *DiversionEntry) Counter() (uint32, bool) {
+	counter, ok := entry.Params["counter"]
+	if !ok || counter == nil {
+		return 0, false
+	}
+	value, err := strconv.ParseUint(*counter, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(value), true
+}
+
+// 'Diversion:' is the legacy means of recording call forwarding, superseded by History-Info (RFC 5806).
+type DiversionHeader struct {
+	Entries []*DiversionEntry
+}
+
+func (header *DiversionHeader) String() string {
+	entries := make([]string, 0, len(header.Entries))
+	for _, entry := range header.Entries {
+		entries = append(entries, entry.String())
+	}
+	return "Diversion: " + strings.Join(entries, ", ")
+}
+
+func (h *DiversionHeader) Name() string { return "Diversion" }
+
+func (h *DiversionHeader) Copy() SipHeader {
+	dup := make([]*DiversionEntry, 0, len(h.Entries))
+	for _, entry := range h.Entries {
+		dup = append(dup, entry.Copy())
+	}
+	return &DiversionHeader{dup}
+}
+
+// Values of the 'purpose' param of a Call-Info entry (RFC 3261 s. 20.9).
+const (
+	// An image representing the caller or callee, such as a photo or icon.
+	CALL_INFO_ICON = "icon"
+
+	// A web page describing the caller or callee.
+	CALL_INFO_INFO = "info"
+
+	// A business card for the caller or callee, e.g. in vCard format.
+	CALL_INFO_CARD = "card"
+)
+
+// A single entry in a Call-Info header: a URI giving more information about the caller or callee.
+type CallInfoEntry struct {
+	// The absolute URI of the information, e.g. "http://www.example.com/alice/photo.jpg".
+	// This is usually not a SIP URI, so it is kept as a string.
+	Address string
+
+	// The parameters of the entry, chiefly 'purpose'.
+	Params Params
+}
+
+func (entry *CallInfoEntry) String() string {
+	return "<" + entry.Address + ">" + ParamsToString(entry.Params, ';', ';')
+}
+
+func (entry *CallInfoEntry) Copy() *CallInfoEntry {
+	return &CallInfoEntry{entry.Address, entry.Params.Copy()}
+}
+
+// Get the purpose of the entry, e.g. CALL_INFO_ICON, if it has one. Purposes are tokens, and other values
+// than the three defined by RFC 3261 are allowed. The value is returned in lower case, since it is compared
+// case-insensitively.
+func (entry *CallInfoEntry) Purpose() (string, bool) {
+	purpose, ok := entry.Params["purpose"]
+	if !ok || purpose == nil {
+		return "", false
+	}
+	return strings.ToLower(*purpose), true
+}
+
+// 'Call-Info:' gives additional information about the caller or callee, such as an icon to display
+// (RFC 3261 s. 20.9).
+type CallInfoHeader struct {
+	Entries []*CallInfoEntry
+}
+
+func (header *CallInfoHeader) String() string {
+	entries := make([]string, 0, len(header.Entries))
+	for _, entry := range header.Entries {
+		entries = append(entries, entry.String())
+	}
+	return "Call-Info: " + strings.Join(entries, ", ")
+}
+
+func (h *CallInfoHeader) Name() string { return "Call-Info" }
+
+func (h *CallInfoHeader) Copy() SipHeader {
+	dup := make([]*CallInfoEntry, 0, len(h.Entries))
+	for _, entry := range h.Entries {
+		dup = append(dup, entry.Copy())
+	}
+	return &CallInfoHeader{dup}
+}
+
+// Get the first entry with the given purpose, compared case-insensitively, or nil if there is none.
+func (h *CallInfoHeader) EntryWithPurpose(purpose string) *CallInfoEntry {
+	for _, entry := range h.Entries {
+		if entryPurpose, ok := entry.Purpose(); ok && strings.EqualFold(entryPurpose, purpose) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Produce the string representation of a name-addr: an optional quoted display name, and a URI in angle brackets.
+func nameAddrString(displayName *string, address Uri) string {
+	if displayName != nil {
+		return fmt.Sprintf("%s <%s>", quote(*displayName), address)
+	}
+	return fmt.Sprintf("<%s>", address)
+}
+
+// Copy a string pointer, so that the copy doesn't share its target.
+func copyStrPtr(str *string) *string {
+	if str == nil {
+		return nil
+	}
+	temp := *str
+	return &temp
+}
+
+// 'Recv-Info:' lists the INFO packages a UA is willing to receive (RFC 6086).
+// An empty list is meaningful: it indicates that the UA will not accept any INFO packages.
+type RecvInfoHeader struct {
+	Packages []string
+}
+
+func (header *RecvInfoHeader) String() string {
+	return fmt.Sprintf("Recv-Info: %s",
+		strings.Join(header.Packages, ", "))
+}
+
+func (h *RecvInfoHeader) Name() string { return "Recv-Info" }
+
+func (h *RecvInfoHeader) Copy() SipHeader {
+	dup := make([]string, len(h.Packages))
+	copy(dup, h.Packages)
+	return &RecvInfoHeader{dup}
+}
+
+// 'Info-Package:' names the INFO package an INFO request is associated with (RFC 6086).
+type InfoPackageHeader struct {
+	Package string
+
+	// Any parameters present in the header.
+	Params Params
+}
+
+func (header *InfoPackageHeader) String() string {
+	return fmt.Sprintf("Info-Package: %s%s",
+		header.Package, ParamsToString(header.Params, ';', ';'))
+}
+
+func (h *InfoPackageHeader) Name() string { return "Info-Package" }
+
+func (h *InfoPackageHeader) Copy() SipHeader { return &InfoPackageHeader{h.Package, h.Params.Copy()} }
+
+// 'Allow-Events:' lists the event packages a UA supports for subscriptions (RFC 6665 s. 8.2.2).
+type AllowEventsHeader struct {
+	EventTypes []string
+}
+
+func (header *AllowEventsHeader) String() string {
+	return fmt.Sprintf("Allow-Events: %s",
+		strings.Join(header.EventTypes, ", "))
+}
+
+func (h *AllowEventsHeader) Name() string { return "Allow-Events" }
+
+func (h *AllowEventsHeader) Copy() SipHeader {
+	dup := make([]string, len(h.EventTypes))
+	copy(dup, h.EventTypes)
+	return &AllowEventsHeader{dup}
+}
+
+// Determine if the given event package, e.g. "presence", is listed in the header.
+// Event types are compared exactly, as RFC 6665 requires.
+func (h *AllowEventsHeader) Contains(eventType string) bool {
+	for _, existing := range h.EventTypes {
+		if existing == eventType {
+			return true
+		}
 	}
+	return false
+}
 
-	return buffer.String()
+// 'Subscription-State:' gives the state of the subscription a NOTIFY request relates to (RFC 6665 s. 8.2.3):
+// e.g. "active", "pending" or "terminated", followed by any params.
+type SubscriptionStateHeader struct {
+	State string
+
+	// Any parameters present in the header, including 'expires', 'retry-after' and 'reason'.
+	Params Params
 }
 
-func (h ViaHeader) Name() string { return "Via" }
+func (header *SubscriptionStateHeader) String() string {
+	return fmt.Sprintf("Subscription-State: %s%s",
+		header.State, ParamsToString(header.Params, ';', ';'))
+}
 
-func (h ViaHeader) Copy() SipHeader {
-	dup := make([]*ViaHop, 0, len(h))
-	for _, hop := range h {
-		dup = append(dup, hop.Copy())
+func (h *SubscriptionStateHeader) Name() string { return "Subscription-State" }
+
+func (h *SubscriptionStateHeader) Copy() SipHeader {
+	return &SubscriptionStateHeader{h.State, h.Params.Copy()}
+}
+
+// Get the number of seconds for which the subscription remains active, from the 'expires' param.
+// Returns false if the param is absent or is not a valid delta-seconds value.
+func (h *SubscriptionStateHeader) Expires() (uint32, bool) {
+	return deltaSecondsParam(h.Params, "expires")
+}
+
+// Get the number of seconds the subscriber should wait before trying to subscribe again, from the
+// 'retry-after' param. Returns false if the param is absent or is not a valid delta-seconds value.
+func (h *SubscriptionStateHeader) RetryAfter() (uint32, bool) {
+	return deltaSecondsParam(h.Params, "retry-after")
+}
+
+// Get the reason the subscription was terminated, e.g. "probation" or "timeout", from the 'reason'
+// param. Returns false if there is no reason.
+func (h *SubscriptionStateHeader) Reason() (string, bool) {
+	reason, ok := h.Params["reason"]
+	if !ok || reason == nil {
+		return "", false
 	}
-	return ViaHeader(dup)
+	return *reason, true
 }
 
-type RequireHeader struct {
-	Options []string
+// Parse the value of the named param as delta-seconds, a count of seconds (RFC 3261 s. 25.1).
+func deltaSecondsParam(params Params, name string) (uint32, bool) {
+	value, ok := params[name]
+	if !ok || value == nil {
+		return 0, false
+	}
+	seconds, err := ParseDeltaSeconds(*value)
+	if err != nil {
+		return 0, false
+	}
+	return seconds, true
 }
 
-func (header *RequireHeader) String() string {
-	return fmt.Sprintf("Require: %s",
-		strings.Join(header.Options, ", "))
+// 'Accept:' lists the media types acceptable in the body of a response (RFC 3261 s. 20.1).
+// Each media range is stored as it appears in the header, including any params, e.g. "text/*;q=0.5".
+//
+// A missing Accept header and an empty one mean different things: if there is no Accept header, the
+// body may be application/sdp; but an empty Accept header means that no body is acceptable at all.
+// Accordingly, a nil *AcceptHeader represents a missing header, while an AcceptHeader with no media
+// ranges represents an empty one.
+type AcceptHeader struct {
+	MediaRanges []string
 }
 
-func (h *RequireHeader) Name() string { return "Require" }
+func (header *AcceptHeader) String() string {
+	return fmt.Sprintf("Accept: %s",
+		strings.Join(header.MediaRanges, ", "))
+}
 
-func (h *RequireHeader) Copy() SipHeader {
-	dup := make([]string, len(h.Options))
-	copy(h.Options, dup)
-	return &RequireHeader{dup}
+func (h *AcceptHeader) Name() string { return "Accept" }
+
+func (h *AcceptHeader) Copy() SipHeader {
+	dup := make([]string, len(h.MediaRanges))
+	copy(dup, h.MediaRanges)
+	return &AcceptHeader{dup}
 }
 
-type SupportedHeader struct {
-	Options []string
+// Determine if a body of the given media type (e.g. "application/sdp") is acceptable.
+// This may be called on a nil header, which represents an absent Accept header, in which case only
+// application/sdp is acceptable. An empty Accept header accepts nothing.
+// Wildcard media ranges (e.g. "*/*", "text/*") are honoured, and ranges with q=0 are ignored.
+func (header *AcceptHeader) Accepts(mediaType string) bool {
+	if header == nil {
+		return strings.EqualFold(mediaType, SDP_CONTENT_TYPE)
+	}
+
+	typeParts := strings.SplitN(strings.ToLower(strings.TrimSpace(mediaType)), "/", 2)
+	if len(typeParts) != 2 {
+		return false
+	}
+
+	for _, mediaRange := range header.MediaRanges {
+		params := strings.Split(strings.ToLower(mediaRange), ";")
+		rejected := false
+		for _, param := range params[1:] {
+			if name, value := splitParam(param); name == "q" && strings.Trim(value, "0.") == "" {
+				rejected = true
+			}
+		}
+		if rejected {
+			continue
+		}
+
+		rangeParts := strings.SplitN(strings.TrimSpace(params[0]), "/", 2)
+		if len(rangeParts) != 2 {
+			continue
+		}
+		if (rangeParts[0] == "*" || rangeParts[0] == typeParts[0]) &&
+			(rangeParts[1] == "*" || rangeParts[1] == typeParts[1]) {
+			return true
+		}
+	}
+
+	return false
 }
 
-func (header *SupportedHeader) String() string {
-	return fmt.Sprintf("Supported: %s",
-		strings.Join(header.Options, ", "))
+// Split a 'name=value' param into its trimmed name and value.
+func splitParam(param string) (name string, value string) {
+	parts := strings.SplitN(param, "=", 2)
+	name = strings.TrimSpace(parts[0])
+	if len(parts) == 2 {
+		value = strings.TrimSpace(parts[1])
+	}
+	return
 }
 
-func (h *SupportedHeader) Name() string { return "Supported" }
+// 'P-Charging-Vector:' carries the IMS charging correlation information for a session (RFC 7315 s. 4.6).
+type PChargingVectorHeader struct {
+	// The globally unique IMS Charging Identifier; the mandatory 'icid-value' param.
+	IcidValue string
 
-func (h *SupportedHeader) Copy() SipHeader {
-	dup := make([]string, len(h.Options))
-	copy(h.Options, dup)
-	return &SupportedHeader{dup}
+	// Any other parameters present in the header, e.g. 'icid-generated-at', 'orig-ioi' and 'term-ioi'.
+	Params Params
 }
 
-type ProxyRequireHeader struct {
-	Options []string
+func (header *PChargingVectorHeader) String() string {
+	return fmt.Sprintf("P-Charging-Vector: icid-value=%s%s",
+		genValueString(header.IcidValue), ParamsToString(header.Params, ';', ';'))
 }
 
-func (header *ProxyRequireHeader) String() string {
-	return fmt.Sprintf("Proxy-Require: %s",
-		strings.Join(header.Options, ", "))
+func (h *PChargingVectorHeader) Name() string { return "P-Charging-Vector" }
+
+func (h *PChargingVectorHeader) Copy() SipHeader {
+	return &PChargingVectorHeader{h.IcidValue, h.Params.Copy()}
 }
 
-func (h *ProxyRequireHeader) Name() string { return "Proxy-Require" }
+// Get the host which generated the ICID, from the 'icid-generated-at' param.
+func (h *PChargingVectorHeader) IcidGeneratedAt() (string, bool) {
+	return paramValue(h.Params, "icid-generated-at")
+}
 
-func (h *ProxyRequireHeader) Copy() SipHeader {
-	dup := make([]string, len(h.Options))
-	copy(h.Options, dup)
-	return &ProxyRequireHeader{dup}
+// Get the Inter Operator Identifier of the originating network, from the 'orig-ioi' param.
+func (h *PChargingVectorHeader) OrigIoi() (string, bool) {
+	return paramValue(h.Params, "orig-ioi")
 }
 
-// 'Unsupported:' is a SIP header type - this doesn't indicate that the
-// header itself is not supported by gossip!
-type UnsupportedHeader struct {
-	Options []string
+// Get the Inter Operator Identifier of the terminating network, from the 'term-ioi' param.
+func (h *PChargingVectorHeader) TermIoi() (string, bool) {
+	return paramValue(h.Params, "term-ioi")
 }
 
-func (header *UnsupportedHeader) String() string {
-	return fmt.Sprintf("Unsupported: %s",
-		strings.Join(header.Options, ", "))
+// 'P-Charging-Function-Addresses:' gives the addresses of the IMS charging functions for a session
+// (RFC 7315 s. 4.5). The 'ccf' and 'ecf' params may each appear more than once, so are held as slices
+// in the order they appear.
+type PChargingFunctionAddressesHeader struct {
+	// The Charging Collection Function addresses.
+	Ccf []string
+
+	// The Event Charging Function addresses.
+	Ecf []string
+
+	// Any other parameters present in the header.
+	Params Params
 }
 
-func (h *UnsupportedHeader) Name() string { return "Unsupported" }
+func (header *PChargingFunctionAddressesHeader) String() string {
+	var params []string
+	for _, ccf := range header.Ccf {
+		params = append(params, "ccf="+genValueString(ccf))
+	}
+	for _, ecf := range header.Ecf {
+		params = append(params, "ecf="+genValueString(ecf))
+	}
 
-func (h *UnsupportedHeader) Copy() SipHeader {
-	dup := make([]string, len(h.Options))
-	copy(h.Options, dup)
-	return &UnsupportedHeader{dup}
+	return fmt.Sprintf("P-Charging-Function-Addresses: %s%s",
+		strings.Join(params, ";"), ParamsToString(header.Params, ';', ';'))
+}
+
+func (h *PChargingFunctionAddressesHeader) Name() string { return "P-Charging-Function-Addresses" }
+
+func (h *PChargingFunctionAddressesHeader) Copy() SipHeader {
+	ccf := make([]string, len(h.Ccf))
+	copy(ccf, h.Ccf)
+	ecf := make([]string, len(h.Ecf))
+	copy(ecf, h.Ecf)
+	return &PChargingFunctionAddressesHeader{ccf, ecf, h.Params.Copy()}
+}
+
+// Get the value of the given param, if it is present and has a value.
+func paramValue(params Params, name string) (string, bool) {
+	value, ok := params[name]
+	if !ok || value == nil {
+		return "", false
+	}
+	return *value, true
+}
+
+// Determine which of the option tags in a Require or Proxy-Require header are not in the given
+// set of supported extensions. The result is the Unsupported header to be sent in a 420 (Bad Extension)
+// response (RFC 3261 s. 8.2.2.3), or nil if every required extension is supported.
+// Option tags are compared case-insensitively, as tokens always are (RFC 3261 s. 7.3.1).
+func UnsupportedExtensions(require *RequireHeader, supported map[string]bool) *UnsupportedHeader {
+	if require == nil {
+		return nil
+	}
+
+	supportedFolded := make(map[string]bool, len(supported))
+	for option, isSupported := range supported {
+		if isSupported {
+			supportedFolded[strings.ToLower(option)] = true
+		}
+	}
+
+	var unsupported []string
+	seen := make(map[string]bool)
+	for _, option := range require.Options {
+		folded := strings.ToLower(option)
+		if !supportedFolded[folded] && !seen[folded] {
+			unsupported = append(unsupported, option)
+			seen[folded] = true
+		}
+	}
+
+	if len(unsupported) == 0 {
+		return nil
+	}
+	return &UnsupportedHeader{unsupported}
+}
+
+// The default warn-text for each of the standard warning codes
+// (RFC 3261 s. 20.43, and RFC 5630 for 380 and 381).
+var WarningTexts = map[uint16]string{
+	300: "Incompatible network protocol",
+	301: "Incompatible network address formats",
+	302: "Incompatible transport protocol",
+	303: "Incompatible bandwidth units",
+	304: "Media type not available",
+	305: "Incompatible media format",
+	306: "Attribute not understood",
+	307: "Session description parameter not understood",
+	330: "Multicast not available",
+	331: "Unicast not available",
+	370: "Insufficient bandwidth",
+	380: "SIPS Not Allowed",
+	381: "SIPS Required",
+	399: "Miscellaneous warning",
+}
+
+// A single warning value from a Warning header, e.g.
+//
+//	Warning: 307 isi.edu "Session parameter 'foo' not understood"
+type WarningHeader struct {
+	// The three-digit warning code, in the range 300-399.
+	Code uint16
+
+	// The host (and optional port), or pseudonym, of the entity adding the warning.
+	Agent string
+
+	// Human-readable text describing the warning.
+	Text string
+}
+
+// Create a new Warning header, validating that the code is a three-digit warning code in the
+// range 300-399. If no text is given, the default text for the code is used, if one is known.
+func NewWarning(code int, agent string, text string) (*WarningHeader, error) {
+	if code < 300 || code > 399 {
+		return nil, fmt.Errorf("invalid warning code %d: must be in the range 300-399", code)
+	}
+	if len(agent) == 0 {
+		return nil, fmt.Errorf("empty warn-agent for warning code %d", code)
+	}
+	if len(text) == 0 {
+		text = WarningTexts[uint16(code)]
+	}
+
+	return &WarningHeader{uint16(code), agent, text}, nil
+}
+
+func (header *WarningHeader) String() string {
+	return fmt.Sprintf("Warning: %d %s %s", header.Code, header.Agent, quote(header.Text))
+}
+
+func (h *WarningHeader) Name() string { return "Warning" }
+
+func (h *WarningHeader) Copy() SipHeader { return &WarningHeader{h.Code, h.Agent, h.Text} }
+
+// 'WWW-Authenticate:' carries a challenge from a UAS or registrar which the client must answer with credentials
+// in an Authorization header (RFC 3261 s. 22.2, RFC 2617 s. 3.2.1), e.g.
+//
+//	WWW-Authenticate: Digest realm="atlanta.com",nonce="84a4cc6f3082121f32b42a2187831a9e",algorithm=MD5,qop="auth"
+type WWWAuthenticateHeader struct {
+	// The authentication scheme, e.g. "Digest".
+	Scheme string
+
+	// The directives of the challenge, keyed by their lower-case names, with any quotes removed from the values.
+	Directives Params
+}
+
+// The order in which the directives of a Digest challenge are written, and which of them are quoted.
+var challengeDirectives = []string{"realm", "domain", "nonce", "opaque", "stale", "algorithm", "qop"}
+var challengeQuoted = map[string]bool{"realm": true, "domain": true, "nonce": true, "opaque": true, "qop": true}
+
+func (header *WWWAuthenticateHeader) String() string {
+	return fmt.Sprintf("WWW-Authenticate: %s %s", header.Scheme,
+		directivesString(header.Directives, challengeDirectives, challengeQuoted))
+}
+
+func (h *WWWAuthenticateHeader) Name() string { return "WWW-Authenticate" }
+
+func (h *WWWAuthenticateHeader) Copy() SipHeader {
+	return &WWWAuthenticateHeader{h.Scheme, h.Directives.Copy()}
+}
+
+// Get the quality of protection options offered by the challenge, e.g. ["auth", "auth-int"], from its 'qop'
+// directive, which is a quoted comma-separated list. The options are lower-cased, and empty options are skipped.
+// Returns an empty list if the challenge has no 'qop' directive.
+func (h *WWWAuthenticateHeader) QOPOptions() []string {
+	options := []string{}
+	qop, ok := h.Directives["qop"]
+	if !ok || qop == nil {
+		return options
+	}
+	for _, option := range strings.Split(*qop, ",") {
+		if option = strings.ToLower(strings.TrimSpace(option)); len(option) > 0 {
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
+// 'Authorization:' carries a client's credentials, in answer to a challenge (RFC 3261 s. 22.2,
+// RFC 2617 s. 3.2.2). See ComputeDigestResponse.
+type AuthorizationHeader struct {
+	// The authentication scheme, e.g. "Digest".
+	Scheme string
+
+	// The directives of the credentials, keyed by their lower-case names, with any quotes removed from the values.
+	Directives Params
+}
+
+// The order in which the directives of Digest credentials are written, and which of them are quoted.
+var credentialsDirectives = []string{"username", "realm", "nonce", "uri", "response", "algorithm", "cnonce",
+	"opaque", "qop", "nc"}
+var credentialsQuoted = map[string]bool{"username": true, "realm": true, "nonce": true, "uri": true,
+	"response": true, "cnonce": true, "opaque": true}
+
+func (header *AuthorizationHeader) String() string {
+	return fmt.Sprintf("Authorization: %s %s", header.Scheme,
+		directivesString(header.Directives, credentialsDirectives, credentialsQuoted))
+}
+
+func (h *AuthorizationHeader) Name() string { return "Authorization" }
+
+func (h *AuthorizationHeader) Copy() SipHeader {
+	return &AuthorizationHeader{h.Scheme, h.Directives.Copy()}
+}
+
+// 'Proxy-Authenticate:' is a challenge from a proxy rather than from the user agent server, in a 407 (Proxy
+// Authentication Required) response (RFC 3261 s. 20.27). It has the same form as WWW-Authenticate, so a
+// *ProxyAuthenticateHeader converts to a *WWWAuthenticateHeader for use with SelectStrongestChallenge and
+// ComputeDigestResponse.
+type ProxyAuthenticateHeader struct {
+	// The authentication scheme, e.g. "Digest".
+	Scheme string
+
+	// The directives of the challenge, keyed by their lower-case names, with any quotes removed from the values.
+	Directives Params
+}
+
+func (header *ProxyAuthenticateHeader) String() string {
+	return fmt.Sprintf("Proxy-Authenticate: %s %s", header.Scheme,
+		directivesString(header.Directives, challengeDirectives, challengeQuoted))
+}
+
+func (h *ProxyAuthenticateHeader) Name() string { return "Proxy-Authenticate" }
+
+func (h *ProxyAuthenticateHeader) Copy() SipHeader {
+	return &ProxyAuthenticateHeader{h.Scheme, h.Directives.Copy()}
+}
+
+// 'Proxy-Authorization:' carries a client's credentials for a proxy, in answer to a Proxy-Authenticate
+// challenge (RFC 3261 s. 20.28). It has the same form as Authorization, so the credentials produced by
+// ComputeDigestResponse convert to a ProxyAuthorizationHeader.
+type ProxyAuthorizationHeader struct {
+	// The authentication scheme, e.g. "Digest".
+	Scheme string
+
+	// The directives of the credentials, keyed by their lower-case names, with any quotes removed from the values.
+	Directives Params
+}
+
+func (header *ProxyAuthorizationHeader) String() string {
+	return fmt.Sprintf("Proxy-Authorization: %s %s", header.Scheme,
+		directivesString(header.Directives, credentialsDirectives, credentialsQuoted))
+}
+
+func (h *ProxyAuthorizationHeader) Name() string { return "Proxy-Authorization" }
+
+func (h *ProxyAuthorizationHeader) Copy() SipHeader {
+	return &ProxyAuthorizationHeader{h.Scheme, h.Directives.Copy()}
+}
+
+// 'Authentication-Info:' is sent by a server after successful Digest authentication (RFC 3261 s. 20.6,
+// RFC 2617 s. 3.2.3), e.g.
+//
+//	Authentication-Info: nextnonce="47364c23432d2e131a5fb210812c",qop=auth,rspauth="6629fae4",cnonce="0a4f113b",nc=00000001
+//
+// Its 'rspauth' directive lets the client authenticate the server in turn.
+type AuthenticationInfoHeader struct {
+	// The directives of the header, keyed by their lower-case names, with any quotes removed from the values.
+	Directives Params
+}
+
+// The order in which the Authentication-Info directives are written, and which of them are quoted.
+// Other directives follow, in order of name, and are quoted only if they need to be.
+var authenticationInfoDirectives = []string{"nextnonce", "qop", "rspauth", "cnonce", "nc"}
+var authenticationInfoQuoted = map[string]bool{"nextnonce": true, "rspauth": true, "cnonce": true}
+
+func (header *AuthenticationInfoHeader) String() string {
+	return "Authentication-Info: " +
+		directivesString(header.Directives, authenticationInfoDirectives, authenticationInfoQuoted)
+}
+
+func (h *AuthenticationInfoHeader) Name() string { return "Authentication-Info" }
+
+func (h *AuthenticationInfoHeader) Copy() SipHeader {
+	return &AuthenticationInfoHeader{h.Directives.Copy()}
+}
+
+// Write out the comma-separated directives of an authentication header: those named in order first, then
+// the rest by name. Directives in the quoted set are always written as quoted strings; the others only
+// when their values aren't tokens.
+func directivesString(directives Params, order []string, quoted map[string]bool) string {
+	var buffer bytes.Buffer
+	write := func(key string, value *string) {
+		if buffer.Len() > 0 {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString(key)
+		if value == nil {
+			return
+		}
+		buffer.WriteString("=")
+		if quoted[key] {
+			buffer.WriteString(quote(*value))
+		} else {
+			buffer.WriteString(genValueString(*value))
+		}
+	}
+
+	known := make(map[string]bool, len(order))
+	for _, key := range order {
+		known[key] = true
+		if value, ok := directives[key]; ok {
+			write(key, value)
+		}
+	}
+	for _, param := range OrderedParams(directives) {
+		if !known[param.Key] {
+			write(param.Key, param.Value)
+		}
+	}
+	return buffer.String()
 }
 
-// Utility method for converting a map of parameters to a flat string representation.
-// Takes the map of parameters, and start and end characters (e.g. '?' and '&').
+// Utility method for converting a map of header parameters to a flat string representation.
+// Takes the map of parameters, and start and end characters (e.g. ';' and ';').
 // It is assumed that key/value pairs are always represented as "key=value".
-// Note that this method does not escape special characters - that should be done before calling this method.
+// Values which are not pure tokens (RFC 3261 s. 25.1), such as IPv6 addresses or URIs, are written as
+// quoted strings, with any '"' or '\' characters escaped.
+// This is not suitable for URI params, which cannot be quoted; see uriParamsToString.
 func ParamsToString(params Params, start uint8, sep uint8) string {
-	var buffer bytes.Buffer
+	return paramsToString(params, start, sep, genValueString)
+}
+
+// Convert a map of URI parameters or URI headers to a flat string representation.
+// Unlike ParamsToString, values are not quoted unless they contain whitespace, as URIs have no quoted
+// strings; special characters should be escaped before calling this method.
+func uriParamsToString(params Params, start uint8, sep uint8) string {
+	return paramsToString(params, start, sep, uriParamValueString)
+}
+
+// Produce the representation of a URI param value: the value itself, unless it contains whitespace.
+func uriParamValueString(value string) string {
+	if strings.ContainsAny(value, c_ABNF_WS) {
+		return quote(value)
+	}
+	return value
+}
+
+func paramsToString(params Params, start uint8, sep uint8, format func(string) string) string {
+	return string(appendParams(nil, params, start, sep, format))
+}
+
+// Append the representation of the given params produced by paramsToString to the given buffer.
+func appendParams(buf []byte, params Params, start uint8, sep uint8, format func(string) string) []byte {
 	first := true
 	for key, value := range params {
 		if first {
-			buffer.WriteString(fmt.Sprintf("%c", start))
+			buf = append(buf, start)
 			first = false
 		} else {
-			buffer.WriteString(fmt.Sprintf("%c", sep))
+			buf = append(buf, sep)
 		}
-		if value == nil {
-			buffer.WriteString(fmt.Sprintf("%s", key))
-		} else if strings.ContainsAny(*value, c_ABNF_WS) {
-			buffer.WriteString(fmt.Sprintf("%s=\"%s\"", key, *value))
+		buf = append(buf, key...)
+		if value != nil {
+			buf = append(buf, '=')
+			buf = append(buf, format(*value)...)
+		}
+	}
+
+	return buf
+}
+
+// Produce the representation of a header param value: the value itself if it is a token, and otherwise a
+// quoted string.
+func genValueString(value string) string {
+	if isToken(value) {
+		return value
+	}
+	return quote(value)
+}
+
+// Produce a quoted-string (RFC 3261 s. 25.1) containing the given text, escaping any '"' or '\' characters.
+// Neither character can occur within a multibyte UTF-8 sequence, so UTF-8 text passes through intact.
+func quote(text string) string {
+	var buffer bytes.Buffer
+	buffer.WriteByte('"')
+	for idx := 0; idx < len(text); idx++ {
+		if text[idx] == '"' || text[idx] == '\\' {
+			buffer.WriteByte('\\')
+		}
+		buffer.WriteByte(text[idx])
+	}
+	buffer.WriteByte('"')
+
+	return buffer.String()
+}
+
+// Convert a telephone number, as it appears in a tel URI, into the user part of an equivalent SIP URI
+// (e.g. "sip:+15551234@gw;user=phone"), as described in RFC 3261 s. 19.1.6.
+// Characters permitted in the user part (such as '+') are preserved, and any others are escaped.
+func TelToSipUser(number string) string {
+	return escapeUser(number)
+}
+
+// Escape any characters in the given text which may not appear in the user part of a SIP URI.
+// Existing escape sequences are left alone, so escaping an already-escaped user part is harmless.
+func escapeUser(text string) string {
+	var buffer bytes.Buffer
+	for idx := 0; idx < len(text); idx++ {
+		char := text[idx]
+		if IsUserChar(char) ||
+			(char == '%' && idx+2 < len(text) && IsHexDigit(text[idx+1]) && IsHexDigit(text[idx+2])) {
+			buffer.WriteByte(char)
 		} else {
-			buffer.WriteString(fmt.Sprintf("%s=%s", key, *value))
+			buffer.WriteString(fmt.Sprintf("%%%02X", char))
 		}
 	}
 
 	return buffer.String()
 }
 
+// Decode any %-escaped octets in the given string (RFC 3261 s. 19.1.2).
+// Malformed escapes, such as a '%' not followed by two hex digits, are left as literals.
+func unescape(text string) string {
+	if strings.IndexByte(text, '%') == -1 {
+		return text
+	}
+
+	var buffer bytes.Buffer
+	for idx := 0; idx < len(text); idx++ {
+		if text[idx] == '%' && idx+2 < len(text) && IsHexDigit(text[idx+1]) && IsHexDigit(text[idx+2]) {
+			value, _ := strconv.ParseUint(text[idx+1:idx+3], 16, 8)
+			buffer.WriteByte(byte(value))
+			idx += 2
+		} else {
+			buffer.WriteByte(text[idx])
+		}
+	}
+
+	return buffer.String()
+}
+
+// Unescape the string pointed to by the given pointer, preserving nil.
+func unescapePtr(text *string) *string {
+	if text == nil {
+		return nil
+	}
+	result := unescape(*text)
+	return &result
+}
+
+// Produce a copy of the given params with all keys and values unescaped.
+func unescapeParams(params Params) Params {
+	result := make(Params, len(params))
+	for key, value := range params {
+		result[unescape(key)] = unescapePtr(value)
+	}
+	return result
+}
+
+// General utility method for parsing 'key=value' parameters, as used by the parser for URIs and headers.
+// Takes a string (source), ensures that it begins with the 'start' character provided,
+// and then parses successive key/value pairs separated with 'sep',
+// until either 'end' is reached or there are no characters remaining.
+// A map of keys to values will be returned, along with the number of characters consumed.
+// Provide 0 for start or end to indicate that there is no starting/ending delimiter.
+// If quoteValues is true, values can be enclosed in double-quotes which will be validated by the
+// parser and omitted from the returned map. Within the quotes, a backslash escapes the character after it
+// (a quoted-pair, RFC 3261 s. 25.1), which is taken literally, and the backslash is dropped.
+// If permitSingletons is true, keys with no values are permitted.
+// These will result in a nil value in the returned map.
+func ParseParams(source string,
+	start uint8, sep uint8, end uint8,
+	quoteValues bool, permitSingletons bool) (
+	params Params, consumed int, err error) {
+
+	params = make(Params)
+
+	if len(source) == 0 {
+		// Key-value section is completely empty; return defaults.
+		return
+	}
+
+	// Ensure the starting character is correct.
+	if start != 0 {
+		if source[0] != start {
+			err = fmt.Errorf("expected %c at start of key-value section; got %c. section was %s",
+				start, source[0], source)
+			return
+		}
+		consumed++
+	}
+
+	// Statefully parse the given string one character at a time.
+	var buffer bytes.Buffer
+	var key string
+	parsingKey := true // false implies we are parsing a value
+	inQuotes := false
+parseLoop:
+	for ; consumed < len(source); consumed++ {
+		if inQuotes && source[consumed] == '\\' && consumed+1 < len(source) {
+			consumed++
+			buffer.WriteByte(source[consumed])
+			continue
+		}
+
+		switch source[consumed] {
+		case end:
+			if inQuotes {
+				// We read an end character, but since we're inside quotations we should
+				// treat it as a literal part of the value.
+				buffer.WriteByte(end)
+				continue
+			}
+
+			break parseLoop
+
+		case sep:
+			if inQuotes {
+				// We read a separator character, but since we're inside quotations
+				// we should treat it as a literal part of the value.
+				buffer.WriteByte(sep)
+				continue
+			}
+			if parsingKey && permitSingletons {
+				params[buffer.String()] = nil
+			} else if parsingKey {
+				err = fmt.Errorf("Singleton param '%s' when parsing params which disallow singletons: \"%s\"",
+					buffer.String(), source)
+				return
+			} else {
+				value := buffer.String()
+				params[key] = &value
+			}
+			buffer.Reset()
+			parsingKey = true
+
+		case '"':
+			if !quoteValues {
+				// We hit a quote character, but since quoting is turned off we treat it as a literal.
+				buffer.WriteString("\"")
+				continue
+			}
+
+			if parsingKey {
+				// Quotes are never allowed in keys.
+				err = fmt.Errorf("Unexpected '\"' in parameter key in params \"%s\"", source)
+				return
+			}
+
+			if !inQuotes && buffer.Len() != 0 {
+				// We hit an initial quote midway through a value; that's not allowed.
+				err = fmt.Errorf("unexpected '\"' in params \"%s\"", source)
+				return
+			}
+
+			if inQuotes &&
+				consumed != len(source)-1 &&
+				source[consumed+1] != sep {
+				// We hit an end-quote midway through a value; that's not allowed.
+				err = fmt.Errorf("unexpected character %c after quoted param in \"%s\"",
+					source[consumed+1], source)
+
+				return
+			}
+
+			inQuotes = !inQuotes
+
+		case '=':
+			if inQuotes {
+				// An '=' within a quoted value is just part of the value.
+				buffer.WriteByte('=')
+				continue
+			}
+			if buffer.Len() == 0 {
+				err = fmt.Errorf("Key of length 0 in params \"%s\"", source)
+				return
+			}
+			if !parsingKey {
+				err = fmt.Errorf("Unexpected '=' char in value token: \"%s\"", source)
+				return
+			}
+			key = buffer.String()
+			buffer.Reset()
+			parsingKey = false
+
+		default:
+			if !inQuotes && IsWhitespace(source[consumed]) {
+				// Skip unquoted whitespace.
+				continue
+			}
+
+			buffer.WriteByte(source[consumed])
+		}
+	}
+
+	// The param string has ended. Check that it ended in a valid place, and then store off the
+	// contents of the buffer.
+	if inQuotes {
+		err = fmt.Errorf("Unclosed quotes in parameter string: %s", source)
+	} else if parsingKey && permitSingletons {
+		params[buffer.String()] = nil
+	} else if parsingKey {
+		err = fmt.Errorf("Singleton param '%s' when parsing params which disallow singletons: \"%s\"",
+			buffer.String(), source)
+	} else {
+		value := buffer.String()
+		params[key] = &value
+	}
+	return
+}
+
 // Check if two maps of parameters are equal in the sense of having the same keys with the same values.
 // This does not rely on any ordering of the keys of the map in memory.
 func ParamsEqual(a Params, b Params) bool {
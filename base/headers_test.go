@@ -0,0 +1,1035 @@
+package base
+
+import (
+	"strings"
+	"testing"
+)
+
+// Need to define immutable variables in order to pointer to them.
+var bob = "bob"
+var phone = "phone"
+var telNumber = "+1-555-123-4567"
+
+func TestIsPhoneNumber(t *testing.T) {
+	uri := &SipUri{User: &telNumber, Host: "gw.example.com", UriParams: Params{"user": &phone}}
+	if !uri.IsPhoneNumber() {
+		t.Errorf("expected %s to be a phone number", uri.String())
+	}
+
+	uri = &SipUri{User: &telNumber, Host: "gw.example.com", UriParams: Params{}}
+	if uri.IsPhoneNumber() {
+		t.Errorf("expected %s not to be a phone number", uri.String())
+	}
+}
+
+func TestToTelUri(t *testing.T) {
+	user := "+1-555-123-4567;phone-context=example.com"
+	uri := &SipUri{User: &user, Host: "gw.example.com", UriParams: Params{"user": &phone}}
+	telUri, err := uri.ToTelUri()
+	if err != nil {
+		t.Fatalf("unexpected error converting %s: %s", uri.String(), err.Error())
+	}
+
+	context := "example.com"
+	expected := &TelUri{Number: "+15551234567", Params: Params{"phone-context": &context}}
+	if !telUri.Equals(expected) {
+		t.Errorf("unexpected tel URI: expected %s, got %s", expected.String(), telUri.String())
+	}
+
+	uri = &SipUri{User: &telNumber, Host: "gw.example.com", UriParams: Params{}}
+	if _, err := uri.ToTelUri(); err == nil {
+		t.Errorf("unexpected success converting %s without user=phone", uri.String())
+	}
+}
+
+func TestNewWarning(t *testing.T) {
+	warning, err := NewWarning(305, "media.example.com", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	expected := "Warning: 305 media.example.com \"Incompatible media format\""
+	if warning.String() != expected {
+		t.Errorf("unexpected warning: expected '%s', got '%s'", expected, warning.String())
+	}
+
+	warning, err = NewWarning(399, "media.example.com", "Codec negotiation failed")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if warning.Text != "Codec negotiation failed" {
+		t.Errorf("unexpected warning text '%s'", warning.Text)
+	}
+
+	// The text is a quoted-string, so any quotes or backslashes in it are escaped.
+	warning, err = NewWarning(399, "media.example.com", `No "PCMU\PCMA" codec`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	expected = `Warning: 399 media.example.com "No \"PCMU\\PCMA\" codec"`
+	if warning.String() != expected {
+		t.Errorf("unexpected warning: expected '%s', got '%s'", expected, warning.String())
+	}
+
+	for _, code := range []int{0, 299, 400, 1000} {
+		if _, err := NewWarning(code, "media.example.com", "Oops"); err == nil {
+			t.Errorf("unexpected success creating warning with code %d", code)
+		}
+	}
+}
+
+func TestGenericHeaderFold(t *testing.T) {
+	header := &GenericHeader{"Subject", "I know you're there, pick up the phone and talk to me!"}
+
+	folded := header.Fold(20)
+	expected := "Subject: I know\r\n you're there, pick\r\n up the phone and\r\n talk to me!"
+	if folded != expected {
+		t.Errorf("unexpected folded header: expected %q, got %q", expected, folded)
+	}
+
+	// Unfolding the header must give back the original contents.
+	unfolded := strings.Replace(folded, "\r\n", "", -1)
+	if unfolded != header.String() {
+		t.Errorf("unfolded header differs from the original: expected %q, got %q", header.String(), unfolded)
+	}
+
+	if header.Fold(1000) != header.String() {
+		t.Errorf("header folded despite fitting within the column: %q", header.Fold(1000))
+	}
+}
+
+func TestGenericHeaderParseParams(t *testing.T) {
+	header := &GenericHeader{"Reason", "SIP ;cause=480; text=\"Temporarily; Unavailable\";retry"}
+	value, params, err := header.ParseParams()
+	cause, text := "480", "Temporarily; Unavailable"
+	if err != nil || value != "SIP" || !ParamsEqual(params, Params{"cause": &cause, "text": &text, "retry": nil}) {
+		t.Errorf("unexpected result parsing %s: %q, %v, %v", header.String(), value, params, err)
+	}
+
+	header = &GenericHeader{"Refer-To", "\"Bob; Jr.\" <sip:bob@biloxi.com;transport=tcp>;method=INVITE"}
+	value, params, err = header.ParseParams()
+	method := "INVITE"
+	if err != nil || value != "\"Bob; Jr.\" <sip:bob@biloxi.com;transport=tcp>" ||
+		!ParamsEqual(params, Params{"method": &method}) {
+		t.Errorf("unexpected result parsing %s: %q, %v, %v", header.String(), value, params, err)
+	}
+
+	header = &GenericHeader{"X-Opaque", "no params here"}
+	if value, params, err = header.ParseParams(); err != nil || value != "no params here" || len(params) != 0 {
+		t.Errorf("unexpected result parsing %s: %q, %v, %v", header.String(), value, params, err)
+	}
+
+	header = &GenericHeader{"X-Broken", "value;text=\"unclosed"}
+	if _, _, err = header.ParseParams(); err == nil {
+		t.Errorf("unexpected success parsing %s", header.String())
+	}
+}
+
+func TestCallIdEquals(t *testing.T) {
+	callId := CallId("a84b4c76e66710@pc33.atlanta.com")
+	if !callId.Equals(CallId("a84b4c76e66710@pc33.atlanta.com")) {
+		t.Errorf("expected Call-ID %s to equal itself", callId)
+	}
+	if callId.Equals(CallId("A84B4C76E66710@pc33.atlanta.com")) {
+		t.Errorf("expected Call-ID comparison to be case-sensitive")
+	}
+}
+
+func TestGRUU(t *testing.T) {
+	instance := "urn:uuid:f81d4fae-7dec-11d0-a765-00a0c91e6bf6"
+	aor := &SipUri{User: &bob, Host: "example.com", UriParams: Params{}}
+	pubGruu := &SipUri{User: &bob, Host: "example.com", UriParams: Params{"gr": nil}}
+	tempGruu := &SipUri{User: &bob, Host: "example.com", UriParams: Params{"gr": &instance}}
+
+	if _, ok := aor.GRUU(); ok {
+		t.Errorf("unexpected GRUU on %s", aor.String())
+	}
+	if gr, ok := pubGruu.GRUU(); !ok || gr != "" {
+		t.Errorf("unexpected GRUU on %s: %q, %v", pubGruu.String(), gr, ok)
+	}
+	if gr, ok := tempGruu.GRUU(); !ok || gr != instance {
+		t.Errorf("unexpected GRUU on %s: %q, %v", tempGruu.String(), gr, ok)
+	}
+
+	if aor.Equals(pubGruu) || pubGruu.Equals(tempGruu) || tempGruu.Equals(aor) {
+		t.Errorf("expected GRUUs to be distinct from each other and from the AOR")
+	}
+	if !tempGruu.Equals(tempGruu.Copy()) {
+		t.Errorf("expected %s to equal its copy", tempGruu.String())
+	}
+}
+
+func TestEqualsIgnoresEscaping(t *testing.T) {
+	escapedUser := "b%6Fb"
+	escapedValue := "a%20b"
+	unescapedValue := "a b"
+	badEscape := "100%"
+	escaped := &SipUri{User: &escapedUser, Host: "example.com",
+		UriParams: Params{"foo": &escapedValue}, Headers: Params{"subject": &escapedValue}}
+	unescaped := &SipUri{User: &bob, Host: "example.com",
+		UriParams: Params{"foo": &unescapedValue}, Headers: Params{"subject": &unescapedValue}}
+	if !escaped.Equals(unescaped) || !unescaped.Equals(escaped) {
+		t.Errorf("expected %s to equal %s", escaped.String(), unescaped.String())
+	}
+
+	different := &SipUri{User: &bob, Host: "example.com",
+		UriParams: Params{"foo": &badEscape}, Headers: Params{"subject": &unescapedValue}}
+	if different.Equals(unescaped) {
+		t.Errorf("expected %s not to equal %s", different.String(), unescaped.String())
+	}
+	if !different.Equals(different.Copy()) {
+		t.Errorf("expected %s with a malformed escape to equal its copy", different.String())
+	}
+}
+
+func TestUnsupportedExtensions(t *testing.T) {
+	supported := map[string]bool{"100rel": true, "timer": true}
+
+	unsupported := UnsupportedExtensions(&RequireHeader{[]string{"100rel", "foo", "timer", "bar"}}, supported)
+	if unsupported == nil || unsupported.String() != "Unsupported: foo, bar" {
+		t.Errorf("unexpected result %v for partially supported Require", unsupported)
+	}
+
+	if unsupported := UnsupportedExtensions(&RequireHeader{[]string{"timer", "100rel"}}, supported); unsupported != nil {
+		t.Errorf("expected nil for fully supported Require, got %v", unsupported)
+	}
+
+	if unsupported := UnsupportedExtensions(&RequireHeader{[]string{"foo", "foo"}}, nil); unsupported == nil || len(unsupported.Options) != 1 {
+		t.Errorf("expected a single unsupported option, got %v", unsupported)
+	}
+
+	// Option tags are case-insensitive.
+	if unsupported := UnsupportedExtensions(&RequireHeader{[]string{"100REL", "Timer"}}, supported); unsupported != nil {
+		t.Errorf("expected nil for a Require supported but for case, got %v", unsupported)
+	}
+	unsupported = UnsupportedExtensions(&RequireHeader{[]string{"Foo", "foo", "100Rel"}},
+		map[string]bool{"100REL": true})
+	if unsupported == nil || unsupported.String() != "Unsupported: Foo" {
+		t.Errorf("unexpected result %v for a mixed-case Require", unsupported)
+	}
+}
+
+func TestIsKnownTransport(t *testing.T) {
+	for _, transport := range []string{"UDP", "tcp", "TLS", "ws", "WSS"} {
+		if !IsKnownTransport(transport) {
+			t.Errorf("expected %s to be a known transport", transport)
+		}
+	}
+	if IsKnownTransport("foo") {
+		t.Errorf("expected foo not to be a known transport")
+	}
+	if NormalizeTransport("ws") != "WS" {
+		t.Errorf("expected ws to normalize to WS, got %s", NormalizeTransport("ws"))
+	}
+}
+
+func TestToHeaderComparison(t *testing.T) {
+	alice := "Alice"
+	tag1 := "1928301774"
+	tag2 := "a6c85cf"
+	to := &ToHeader{DisplayName: &alice, Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{"tag": &tag1}}
+	renamed := &ToHeader{DisplayName: nil, Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{"tag": &tag1}}
+	retagged := &ToHeader{DisplayName: &alice, Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{"tag": &tag2}}
+	untagged := &ToHeader{DisplayName: &alice, Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{}}
+	elsewhere := &ToHeader{DisplayName: &alice, Address: &SipUri{User: &bob, Host: "atlanta.com"}, Params: Params{"tag": &tag1}}
+
+	if !to.SameAddress(renamed) || !to.SameDialogParty(renamed) {
+		t.Errorf("expected the display name to be ignored")
+	}
+	if !to.SameAddress(retagged) || to.SameDialogParty(retagged) {
+		t.Errorf("expected the tag to matter only to SameDialogParty")
+	}
+	if !to.SameAddress(untagged) || to.SameDialogParty(untagged) || !untagged.SameDialogParty(untagged.Copy().(*ToHeader)) {
+		t.Errorf("unexpected comparison with an untagged header")
+	}
+	if to.SameAddress(elsewhere) || to.SameDialogParty(elsewhere) {
+		t.Errorf("expected headers with different URIs not to match")
+	}
+}
+
+func TestDiversionAccessors(t *testing.T) {
+	reason := "user-busy"
+	counter := "3"
+	badCounter := "three"
+	entry := &DiversionEntry{nil, &SipUri{User: &bob, Host: "biloxi.com"}, Params{"reason": &reason, "counter": &counter}}
+	if value, ok := entry.Reason(); !ok || value != "user-busy" {
+		t.Errorf("unexpected reason %s", value)
+	}
+	if value, ok := entry.Counter(); !ok || value != 3 {
+		t.Errorf("unexpected counter %d", value)
+	}
+
+	entry = &DiversionEntry{nil, &SipUri{User: &bob, Host: "biloxi.com"}, Params{"counter": &badCounter}}
+	if _, ok := entry.Reason(); ok {
+		t.Errorf("unexpected reason on entry without one")
+	}
+	if _, ok := entry.Counter(); ok {
+		t.Errorf("unexpected counter on entry with malformed counter")
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	var absent *AcceptHeader
+	if !absent.Accepts("application/sdp") || absent.Accepts("text/plain") {
+		t.Errorf("expected an absent Accept header to accept only application/sdp")
+	}
+
+	empty := &AcceptHeader{[]string{}}
+	if empty.Accepts("application/sdp") {
+		t.Errorf("expected an empty Accept header to accept nothing")
+	}
+
+	accept := &AcceptHeader{[]string{"application/sdp;level=1", "text/*", "image/png;q=0"}}
+	if !accept.Accepts("application/SDP") || !accept.Accepts("text/plain") {
+		t.Errorf("expected application/sdp and text/plain to be accepted")
+	}
+	if accept.Accepts("image/png") || accept.Accepts("application/pidf+xml") {
+		t.Errorf("expected image/png and application/pidf+xml not to be accepted")
+	}
+	if !(&AcceptHeader{[]string{"*/*"}}).Accepts("message/sipfrag") {
+		t.Errorf("expected */* to accept message/sipfrag")
+	}
+}
+
+func TestTelToSipUser(t *testing.T) {
+	tests := map[string]string{
+		"+15551234":          "+15551234",
+		"+1(555)123-4567":    "+1(555)123-4567",
+		"+1 (555) 123-4567":  "+1%20(555)%20123-4567",
+		"*67#1234":           "*67%231234",
+		"1234;phone-context": "1234;phone-context",
+	}
+	for number, expected := range tests {
+		if user := TelToSipUser(number); user != expected {
+			t.Errorf("expected %s to convert to %s, got %s", number, expected, user)
+		}
+	}
+
+	user := TelToSipUser("+1 (555) 123#4567")
+	uri := &SipUri{User: &user, Host: "gw", UriParams: Params{"user": &phone}}
+	if uri.String() != "sip:+1%20(555)%20123%234567@gw;user=phone" {
+		t.Errorf("unexpected URI %s", uri.String())
+	}
+
+	raw := "+1 555#1234"
+	uri = &SipUri{User: &raw, Host: "gw"}
+	if uri.String() != "sip:+1%20555%231234@gw" {
+		t.Errorf("expected the user part to be escaped, got %s", uri.String())
+	}
+}
+
+func TestViaSentBy(t *testing.T) {
+	port := uint16(5070)
+	tests := []struct {
+		hop            *ViaHop
+		sentBy         string
+		sentByWithPort string
+	}{
+		{&ViaHop{"SIP", "2.0", "UDP", "pc33.atlanta.com", nil, Params{}}, "pc33.atlanta.com", "pc33.atlanta.com:5060"},
+		{&ViaHop{"SIP", "2.0", "TLS", "pc33.atlanta.com", nil, Params{}}, "pc33.atlanta.com", "pc33.atlanta.com:5061"},
+		{&ViaHop{"SIP", "2.0", "tls", "pc33.atlanta.com", &port, Params{}}, "pc33.atlanta.com:5070", "pc33.atlanta.com:5070"},
+		{&ViaHop{"SIP", "2.0", "TCP", "2001:db8::9:1", &port, Params{}}, "[2001:db8::9:1]:5070", "[2001:db8::9:1]:5070"},
+		{&ViaHop{"SIP", "2.0", "TLS", "[2001:db8::9:1]", nil, Params{}}, "[2001:db8::9:1]", "[2001:db8::9:1]:5061"},
+	}
+	for _, test := range tests {
+		if sentBy := test.hop.SentBy(); sentBy != test.sentBy {
+			t.Errorf("expected sent-by %s for %s, got %s", test.sentBy, test.hop, sentBy)
+		}
+		if sentBy := test.hop.SentByWithDefaultPort(); sentBy != test.sentByWithPort {
+			t.Errorf("expected sent-by %s for %s, got %s", test.sentByWithPort, test.hop, sentBy)
+		}
+	}
+}
+
+func TestEffectiveExpiry(t *testing.T) {
+	contactExpiry := "60"
+	badExpiry := "soon"
+	expires := Expires(1800)
+	withParam := &ContactHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{"expires": &contactExpiry}}
+	withBadParam := &ContactHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{"expires": &badExpiry}}
+	withoutParam := &ContactHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{}}
+
+	if expiry := EffectiveExpiry(withParam, &expires, 3600); expiry != 60 {
+		t.Errorf("expected the Contact expires param to take precedence, got %d", expiry)
+	}
+	if expiry := EffectiveExpiry(withoutParam, &expires, 3600); expiry != 1800 {
+		t.Errorf("expected the Expires header to be used, got %d", expiry)
+	}
+	if expiry := EffectiveExpiry(withBadParam, &expires, 3600); expiry != 1800 {
+		t.Errorf("expected a malformed expires param to be ignored, got %d", expiry)
+	}
+	if expiry := EffectiveExpiry(withoutParam, nil, 3600); expiry != 3600 {
+		t.Errorf("expected the default expiry to be used, got %d", expiry)
+	}
+}
+
+func TestPChargingVectorAccessors(t *testing.T) {
+	generatedAt := "192.0.6.8"
+	origIoi := "home1.net"
+	vector := &PChargingVectorHeader{"1234bc9876e", Params{"icid-generated-at": &generatedAt, "orig-ioi": &origIoi}}
+	if value, ok := vector.IcidGeneratedAt(); !ok || value != generatedAt {
+		t.Errorf("unexpected icid-generated-at %s", value)
+	}
+	if value, ok := vector.OrigIoi(); !ok || value != origIoi {
+		t.Errorf("unexpected orig-ioi %s", value)
+	}
+	if _, ok := vector.TermIoi(); ok {
+		t.Errorf("unexpected term-ioi on P-Charging-Vector without one")
+	}
+}
+
+func TestAsContactUri(t *testing.T) {
+	valid := []Uri{
+		&SipUri{User: &bob, Host: "biloxi.com"},
+		&SipUri{IsEncrypted: true, User: &bob, Host: "biloxi.com"},
+		WildcardUri{},
+		&WildcardUri{},
+	}
+	for _, uri := range valid {
+		if contactUri, err := AsContactUri(uri); err != nil || contactUri.String() != uri.String() {
+			t.Errorf("expected %s to be a valid Contact URI; got %v, %v", uri, contactUri, err)
+		}
+	}
+
+	if contactUri, err := AsContactUri(&TelUri{Number: telNumber, Params: Params{}}); err == nil {
+		t.Errorf("expected a tel URI not to be a valid Contact URI; got %v", contactUri)
+	}
+	if contactUri, err := AsContactUri(nil); err == nil {
+		t.Errorf("expected a nil URI not to be a valid Contact URI; got %v", contactUri)
+	}
+}
+
+func TestParamsToStringQuoting(t *testing.T) {
+	tests := map[string]string{
+		"z9hG4bK776asdhds":        ";branch=z9hG4bK776asdhds",
+		"0.7":                     ";branch=0.7",
+		"2001:db8::9:1":           ";branch=\"2001:db8::9:1\"",
+		"<sip:alice@atlanta.com>": ";branch=\"<sip:alice@atlanta.com>\"",
+		"text/plain":              ";branch=\"text/plain\"",
+		"say \"hi\"":              ";branch=\"say \\\"hi\\\"\"",
+		"":                        ";branch=\"\"",
+	}
+	for value, expected := range tests {
+		value := value
+		if result := ParamsToString(Params{"branch": &value}, ';', ';'); result != expected {
+			t.Errorf("expected %s to be written as %s, got %s", value, expected, result)
+		}
+	}
+
+	// Values written with quoted-pairs parse back to the same value.
+	for _, value := range []string{"say \"hi\"", "a\"b\\c", "\\", "x;y=\"z\""} {
+		value := value
+		written := ParamsToString(Params{"x": &value}, ';', ';')
+		params, _, err := ParseParams(written, ';', ';', 0, true, true)
+		if err != nil {
+			t.Errorf("unexpected error parsing %s: %s", written, err.Error())
+		} else if parsed, ok := params["x"]; !ok || parsed == nil || *parsed != value {
+			t.Errorf("expected %s to parse back to %q, got %v", written, value, params)
+		}
+	}
+
+	received := "2001:db8::9:1"
+	hop := &ViaHop{"SIP", "2.0", "UDP", "pc33.atlanta.com", nil, Params{"received": &received}}
+	if hop.String() != "SIP/2.0/UDP pc33.atlanta.com;received=2001:db8::9:1" {
+		t.Errorf("unexpected Via hop %s", hop.String())
+	}
+	maddr := "[2001:db8::9:2]"
+	hop.Params = Params{"maddr": &maddr}
+	if hop.String() != "SIP/2.0/UDP pc33.atlanta.com;maddr=[2001:db8::9:2]" {
+		t.Errorf("unexpected Via hop %s", hop.String())
+	}
+
+	// URI params can't be quoted.
+	instance := "urn:uuid:f81d4fae-7dec-11d0-a765-00a0c91e6bf6"
+	uri := &SipUri{User: &bob, Host: "example.com", UriParams: Params{"gr": &instance}}
+	if uri.String() != "sip:bob@example.com;gr="+instance {
+		t.Errorf("unexpected URI %s", uri.String())
+	}
+}
+
+func TestNewViaHop(t *testing.T) {
+	port := uint16(5061)
+	hop := NewViaHop("TLS", "pc33.atlanta.com", &port)
+	if hop.String() != "SIP/2.0/TLS pc33.atlanta.com:5061" {
+		t.Errorf("unexpected Via hop %s", hop.String())
+	}
+
+	branch := GenerateBranch()
+	hop.Params["branch"] = &branch
+	if hop.String() != "SIP/2.0/TLS pc33.atlanta.com:5061;branch="+branch {
+		t.Errorf("unexpected Via hop %s", hop.String())
+	}
+}
+
+func TestBuildVia(t *testing.T) {
+	port := uint16(5060)
+	hop := BuildVia(UDP, "pc33.atlanta.com", &port, true)
+	port = 5070
+	if hop.ProtocolName != "SIP" || hop.ProtocolVersion != "2.0" || hop.Transport != "UDP" ||
+		hop.SentBy() != "pc33.atlanta.com:5060" {
+		t.Errorf("unexpected Via hop %s", hop.String())
+	}
+	branch, ok := hop.Branch()
+	if !ok || !strings.HasPrefix(branch, RFC3261_BRANCH_MAGIC_COOKIE) || len(branch) <= len(RFC3261_BRANCH_MAGIC_COOKIE) {
+		t.Errorf("expected a generated branch on %s", hop.String())
+	}
+	if rport, present := hop.Params["rport"]; !present || rport != nil {
+		t.Errorf("expected a valueless rport on %s", hop.String())
+	}
+	if len(hop.Params) != 2 {
+		t.Errorf("unexpected params on %s", hop.String())
+	}
+
+	other := BuildVia(TCP, "pc33.atlanta.com", nil, false)
+	otherBranch, _ := other.Branch()
+	if other.String() != "SIP/2.0/TCP pc33.atlanta.com;branch="+otherBranch {
+		t.Errorf("unexpected Via hop %s", other.String())
+	}
+	if otherBranch == branch {
+		t.Errorf("expected each Via hop to get a fresh branch")
+	}
+}
+
+func TestOptionHeaderCopy(t *testing.T) {
+	require := &RequireHeader{[]string{"100rel", "timer"}}
+	dup := require.Copy().(*RequireHeader)
+	if require.String() != "Require: 100rel, timer" || dup.String() != "Require: 100rel, timer" {
+		t.Errorf("unexpected result of copying %s: %s", require, dup)
+	}
+}
+
+func TestTopologyHiding(t *testing.T) {
+	branch := "z9hG4bK776asdhds"
+	internalPort := uint16(5070)
+	publicPort := uint16(5080)
+	hop := &ViaHop{"SIP", "2.0", "UDP", "10.0.0.1", &internalPort, Params{"branch": &branch}}
+	hop.SetSentBy("sbc.example.com", &publicPort)
+	if hop.String() != "SIP/2.0/UDP sbc.example.com:5080;branch=z9hG4bK776asdhds" {
+		t.Errorf("unexpected Via hop after SetSentBy: %s", hop.String())
+	}
+	hop.SetSentBy("sbc.example.com", nil)
+	if hop.String() != "SIP/2.0/UDP sbc.example.com;branch=z9hG4bK776asdhds" {
+		t.Errorf("unexpected Via hop after SetSentBy: %s", hop.String())
+	}
+
+	recordRoute := &RecordRouteHeader{[]Uri{
+		&SipUri{User: &bob, Host: "10.0.0.1", Port: &internalPort, UriParams: Params{"lr": nil}},
+		&SipUri{Host: "10.0.0.2", UriParams: Params{"lr": nil}},
+	}}
+	recordRoute.RewriteHosts("sbc.example.com", &publicPort)
+	if recordRoute.String() != "Record-Route: <sip:bob@sbc.example.com:5080;lr>, <sip:sbc.example.com:5080;lr>" {
+		t.Errorf("unexpected Record-Route after RewriteHosts: %s", recordRoute.String())
+	}
+}
+
+func TestUserParam(t *testing.T) {
+	for _, value := range []string{"phone", "dialstring", "ip", "x-custom"} {
+		user := value
+		uri := &SipUri{User: &telNumber, Host: "gw.example.com", UriParams: Params{"user": &user}}
+		if result, ok := uri.UserParam(); !ok || result != value {
+			t.Errorf("unexpected user param for %s: %q, %v", uri.String(), result, ok)
+		}
+		if uri.String() != "sip:"+telNumber+"@gw.example.com;user="+value {
+			t.Errorf("unexpected serialization %s", uri.String())
+		}
+		if uri.IsPhoneNumber() != (value == "phone") {
+			t.Errorf("unexpected IsPhoneNumber() for %s", uri.String())
+		}
+	}
+
+	uri := &SipUri{User: &telNumber, Host: "gw.example.com", UriParams: Params{}}
+	if _, ok := uri.UserParam(); ok {
+		t.Errorf("unexpected user param for %s", uri.String())
+	}
+
+	dialstring, upperDialstring := "dialstring", "DialString"
+	a := &SipUri{User: &telNumber, Host: "gw.example.com", UriParams: Params{"user": &dialstring}}
+	b := &SipUri{User: &telNumber, Host: "gw.example.com", UriParams: Params{"user": &upperDialstring}}
+	c := &SipUri{User: &telNumber, Host: "gw.example.com", UriParams: Params{"user": &phone}}
+	d := &SipUri{User: &telNumber, Host: "gw.example.com", UriParams: Params{"user": nil}}
+	if !a.Equals(b) {
+		t.Errorf("expected %s to equal %s", a.String(), b.String())
+	}
+	if a.Equals(c) || c.Equals(a) {
+		t.Errorf("expected %s not to equal %s", a.String(), c.String())
+	}
+	if a.Equals(uri) || uri.Equals(a) {
+		t.Errorf("expected %s not to equal %s", a.String(), uri.String())
+	}
+	if d.Equals(uri) || d.Equals(a) {
+		t.Errorf("expected %s not to equal %s or %s", d.String(), uri.String(), a.String())
+	}
+}
+
+func TestNameAddrPolicy(t *testing.T) {
+	alice := "Alice"
+	tag := "1928301774"
+	maddr := "239.255.255.1"
+	tests := []struct {
+		header   SipHeader
+		expected string
+	}{
+		{&ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}}, "To: <sip:bob@biloxi.com>"},
+		{&ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, NameAddrPolicy: NAME_ADDR_BARE_WHEN_POSSIBLE},
+			"To: sip:bob@biloxi.com"},
+		{&FromHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, NameAddrPolicy: NAME_ADDR_BARE_WHEN_POSSIBLE},
+			"From: sip:bob@biloxi.com"},
+		{&ToHeader{DisplayName: &alice, Address: &SipUri{User: &bob, Host: "biloxi.com"}, NameAddrPolicy: NAME_ADDR_BARE_WHEN_POSSIBLE},
+			"To: \"Alice\" <sip:bob@biloxi.com>"},
+		{&FromHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{"tag": &tag},
+			NameAddrPolicy: NAME_ADDR_BARE_WHEN_POSSIBLE}, "From: <sip:bob@biloxi.com>;tag=1928301774"},
+		{&ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com", UriParams: Params{"maddr": &maddr}},
+			NameAddrPolicy: NAME_ADDR_BARE_WHEN_POSSIBLE}, "To: <sip:bob@biloxi.com;maddr=239.255.255.1>"},
+	}
+
+	for _, test := range tests {
+		if test.header.String() != test.expected {
+			t.Errorf("unexpected serialization: expected %q, got %q", test.expected, test.header.String())
+		}
+		if test.header.Copy().String() != test.expected {
+			t.Errorf("policy not preserved on copy of %q", test.expected)
+		}
+	}
+}
+
+func TestTelGlobalNumber(t *testing.T) {
+	numericContext := "+1-212"
+	domainContext := "example.com"
+	ext := "22"
+	tests := []struct {
+		uri      *TelUri
+		expected string
+		ok       bool
+	}{
+		{&TelUri{Number: "+1-212-555-1234", Params: Params{}}, "+12125551234", true},
+		{&TelUri{Number: "555-1234", Params: Params{"phone-context": &numericContext}}, "+12125551234", true},
+		{&TelUri{Number: "555-1234", Params: Params{"phone-context": &domainContext}}, "", false},
+		{&TelUri{Number: "555-1234", Params: Params{}}, "", false},
+		{&TelUri{Number: "*69", Params: Params{"phone-context": &numericContext}}, "", false},
+	}
+
+	for _, test := range tests {
+		if result, ok := test.uri.GlobalNumber(); result != test.expected || ok != test.ok {
+			t.Errorf("unexpected global number for %s: %q, %v", test.uri.String(), result, ok)
+		}
+	}
+
+	global := tests[0].uri
+	local := tests[1].uri
+	if !global.Equals(local) || !local.Equals(global) {
+		t.Errorf("expected %s to equal %s", global.String(), local.String())
+	}
+	if global.Equals(tests[2].uri) || tests[2].uri.Equals(global) {
+		t.Errorf("expected %s not to equal %s", global.String(), tests[2].uri.String())
+	}
+	if !tests[2].uri.Equals(tests[2].uri.Copy()) {
+		t.Errorf("expected %s to equal itself", tests[2].uri.String())
+	}
+
+	withExt := &TelUri{Number: "555-1234", Params: Params{"phone-context": &numericContext, "ext": &ext}}
+	if global.Equals(withExt) {
+		t.Errorf("expected %s not to equal %s", global.String(), withExt.String())
+	}
+	if !withExt.Equals(&TelUri{Number: "+12125551234", Params: Params{"ext": &ext}}) {
+		t.Errorf("expected %s to equal its global form", withExt.String())
+	}
+}
+
+func TestResolveTransport(t *testing.T) {
+	tcp, upperTcp, ws, sctp := "tcp", "TCP", "ws", "sctp"
+	tests := []struct {
+		uri      *SipUri
+		expected Transport
+	}{
+		{&SipUri{Host: "biloxi.com"}, UDP},
+		{&SipUri{IsEncrypted: true, Host: "biloxi.com"}, TLS},
+		{&SipUri{Host: "biloxi.com", UriParams: Params{"transport": &tcp}}, TCP},
+		{&SipUri{Host: "biloxi.com", UriParams: Params{"transport": &upperTcp}}, TCP},
+		{&SipUri{Host: "biloxi.com", UriParams: Params{"transport": &sctp}}, SCTP},
+		{&SipUri{Host: "biloxi.com", UriParams: Params{"transport": &ws}}, WS},
+		{&SipUri{Host: "biloxi.com", UriParams: Params{"transport": nil}}, UDP},
+		{&SipUri{IsEncrypted: true, Host: "biloxi.com", UriParams: Params{"transport": &tcp}}, TLS},
+		{&SipUri{IsEncrypted: true, Host: "biloxi.com", UriParams: Params{"transport": &ws}}, WSS},
+	}
+
+	for _, test := range tests {
+		if result := ResolveTransport(test.uri); result != test.expected {
+			t.Errorf("unexpected transport for %s: expected %s, got %s", test.uri.String(), test.expected, result)
+		}
+	}
+}
+
+func TestRoutingKey(t *testing.T) {
+	tcp, tls, escaped, port := "tcp", "TLS", "b%6Fb", uint16(5080)
+	tests := []struct {
+		uri      *SipUri
+		expected RoutingKey
+	}{
+		{&SipUri{User: &bob, Host: "Biloxi.COM"}, RoutingKey{"sip", "bob", "biloxi.com", 5060, UDP}},
+		{&SipUri{IsEncrypted: true, User: &bob, Host: "biloxi.com"}, RoutingKey{"sips", "bob", "biloxi.com", 5061, TLS}},
+		{&SipUri{Host: "10.0.0.5", Port: &port, UriParams: Params{"transport": &tcp}},
+			RoutingKey{"sip", "", "10.0.0.5", 5080, TCP}},
+		{&SipUri{Host: "biloxi.com", UriParams: Params{"transport": &tls}}, RoutingKey{"sip", "", "biloxi.com", 5061, TLS}},
+		{&SipUri{IsEncrypted: true, User: &escaped, Host: "biloxi.com", UriParams: Params{"transport": &tcp, "lr": nil}},
+			RoutingKey{"sips", "bob", "biloxi.com", 5061, TLS}},
+	}
+
+	for _, test := range tests {
+		if result := test.uri.RoutingKey(); result != test.expected {
+			t.Errorf("unexpected routing key for %s: expected %+v, got %+v", test.uri.String(), test.expected, result)
+		}
+	}
+}
+
+func TestTransportSchemeConsistent(t *testing.T) {
+	udp, tcp, tls, upperTls, ws := "udp", "tcp", "tls", "TLS", "ws"
+	tests := []struct {
+		uri      *SipUri
+		expected bool
+	}{
+		{&SipUri{Host: "biloxi.com"}, true},
+		{&SipUri{IsEncrypted: true, Host: "biloxi.com"}, true},
+		{&SipUri{Host: "biloxi.com", UriParams: Params{"transport": &udp}}, true},
+		{&SipUri{Host: "biloxi.com", UriParams: Params{"transport": &tcp}}, true},
+		{&SipUri{Host: "biloxi.com", UriParams: Params{"transport": &tls}}, false},
+		{&SipUri{Host: "biloxi.com", UriParams: Params{"transport": &upperTls}}, false},
+		{&SipUri{IsEncrypted: true, Host: "biloxi.com", UriParams: Params{"transport": &tcp}}, true},
+		{&SipUri{IsEncrypted: true, Host: "biloxi.com", UriParams: Params{"transport": &tls}}, true},
+		{&SipUri{IsEncrypted: true, Host: "biloxi.com", UriParams: Params{"transport": &ws}}, true},
+		{&SipUri{IsEncrypted: true, Host: "biloxi.com", UriParams: Params{"transport": &udp}}, false},
+	}
+
+	for _, test := range tests {
+		if result := test.uri.TransportSchemeConsistent(); result != test.expected {
+			t.Errorf("expected TransportSchemeConsistent to be %v for %s", test.expected, test.uri.String())
+		}
+	}
+}
+
+func TestTransportResolver(t *testing.T) {
+	udp, ws := "udp", "ws"
+	bare := &SipUri{Host: "biloxi.com"}
+	sips := &SipUri{IsEncrypted: true, Host: "biloxi.com"}
+	explicitUdp := &SipUri{Host: "biloxi.com", UriParams: Params{"transport": &udp}}
+	sipsWs := &SipUri{IsEncrypted: true, Host: "biloxi.com", UriParams: Params{"transport": &ws}}
+
+	tests := []struct {
+		resolver TransportResolver
+		uri      *SipUri
+		expected Transport
+	}{
+		{TransportResolver{}, bare, UDP},
+		{TransportResolver{UDP}, bare, UDP},
+		{TransportResolver{TCP}, bare, TCP},
+		{TransportResolver{Transport("tcp")}, bare, TCP},
+		{TransportResolver{UDP}, sips, TLS},
+		{TransportResolver{TCP}, sips, TLS},
+		{TransportResolver{TCP}, explicitUdp, UDP},
+		{TransportResolver{TCP}, sipsWs, WSS},
+	}
+
+	for _, test := range tests {
+		if result := test.resolver.Resolve(test.uri); result != test.expected {
+			t.Errorf("unexpected transport for %s with default %q: expected %s, got %s", test.uri.String(),
+				test.resolver.DefaultTransport, test.expected, result)
+		}
+	}
+}
+
+func TestEqualsComparesUriHeaders(t *testing.T) {
+	subject, otherSubject := "project%20x", "project%20y"
+	plain := &SipUri{User: &bob, Host: "biloxi.com", UriParams: Params{}, Headers: Params{}}
+	withSubject := &SipUri{User: &bob, Host: "biloxi.com", UriParams: Params{}, Headers: Params{"subject": &subject}}
+	withOtherSubject := &SipUri{User: &bob, Host: "biloxi.com", UriParams: Params{}, Headers: Params{"subject": &otherSubject}}
+
+	// Per RFC 3261 s. 19.1.4, "URI header components are never ignored".
+	if plain.Equals(withSubject) || withSubject.Equals(plain) {
+		t.Errorf("expected %s not to equal %s", plain.String(), withSubject.String())
+	}
+	if withSubject.Equals(withOtherSubject) {
+		t.Errorf("expected %s not to equal %s", withSubject.String(), withOtherSubject.String())
+	}
+	if !withSubject.Equals(withSubject.Copy()) {
+		t.Errorf("expected %s to equal its copy", withSubject.String())
+	}
+}
+
+func TestEqualsIgnoresTrailingDot(t *testing.T) {
+	port := uint16(5060)
+	tests := []struct {
+		host      string
+		otherHost string
+		expected  bool
+	}{
+		{"example.com.", "example.com", true},
+		{"example.com", "example.com.", true},
+		{"example.com.", "example.com.", true},
+		{"example.com..", "example.com", false},
+		{"example.com.", "example.org", false},
+	}
+
+	for _, test := range tests {
+		uri := &SipUri{User: &bob, Host: test.host, Port: &port, UriParams: Params{}, Headers: Params{}}
+		other := &SipUri{User: &bob, Host: test.otherHost, Port: &port, UriParams: Params{}, Headers: Params{}}
+		if uri.Equals(other) != test.expected || other.Equals(uri) != test.expected {
+			t.Errorf("expected equality of %s and %s to be %v", uri.String(), other.String(), test.expected)
+		}
+		if (uri.RoutingKey() == other.RoutingKey()) != test.expected {
+			t.Errorf("expected routing key equality of %s and %s to be %v", uri.String(), other.String(), test.expected)
+		}
+	}
+}
+
+func TestIsLooseRouter(t *testing.T) {
+	on := "on"
+	tests := []struct {
+		uri      *SipUri
+		expected bool
+	}{
+		{&SipUri{Host: "p1.example.com", UriParams: Params{"lr": nil}}, true},
+		{&SipUri{Host: "p1.example.com", UriParams: Params{"lr": &on}}, true},
+		{&SipUri{Host: "p1.example.com", UriParams: Params{}}, false},
+		{&SipUri{Host: "p1.example.com"}, false},
+	}
+	for _, test := range tests {
+		if test.uri.IsLooseRouter() != test.expected {
+			t.Errorf("unexpected IsLooseRouter() for %s", test.uri.String())
+		}
+	}
+
+	if uri := tests[0].uri.String(); uri != "sip:p1.example.com;lr" {
+		t.Errorf("expected 'lr' to be emitted bare, got %s", uri)
+	}
+}
+
+func TestFeatureTags(t *testing.T) {
+	expires, q, methods, instance, extensions := "3600", "0.7", "\"INVITE,BYE\"", "\"<urn:uuid:1234>\"", "\"100rel\""
+	contact := &ContactHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{
+		"expires":         &expires,
+		"q":               &q,
+		"reg-id":          &q,
+		"audio":           nil,
+		"Video":           nil,
+		"methods":         &methods,
+		"+sip.instance":   &instance,
+		"+sip.extensions": &extensions,
+	}}
+
+	expected := Params{"audio": nil, "Video": nil, "methods": &methods, "+sip.instance": &instance,
+		"+sip.extensions": &extensions}
+	tags := contact.FeatureTags()
+	if !ParamsEqual(tags, expected) {
+		t.Errorf("unexpected feature tags %v", tags)
+	}
+
+	*tags["methods"] = "\"ACK\""
+	if *contact.Params["methods"] != methods {
+		t.Errorf("expected the feature tags to be a copy of the header's params")
+	}
+
+	plain := &ContactHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{"expires": &expires}}
+	if tags := plain.FeatureTags(); len(tags) != 0 {
+		t.Errorf("unexpected feature tags %v on %s", tags, plain.String())
+	}
+}
+
+func TestEffectivePort(t *testing.T) {
+	port := uint16(5080)
+	bare := &SipUri{Host: "10.0.0.5"}
+	explicit := &SipUri{Host: "10.0.0.5", Port: &port}
+
+	for transport, expected := range map[Transport]uint16{UDP: 5060, TCP: 5060, TLS: 5061, Transport("tls"): 5061} {
+		if result := bare.EffectivePort(transport); result != expected {
+			t.Errorf("unexpected port for %s over %s: expected %d, got %d", bare.String(), transport, expected, result)
+		}
+		if result := explicit.EffectivePort(transport); result != port {
+			t.Errorf("unexpected port for %s over %s: expected %d, got %d", explicit.String(), transport, port, result)
+		}
+	}
+
+	sips := &SipUri{IsEncrypted: true, Host: "10.0.0.5"}
+	if result := sips.EffectivePort(ResolveTransport(sips)); result != 5061 {
+		t.Errorf("unexpected port for %s: %d", sips.String(), result)
+	}
+}
+
+func TestOrderedParams(t *testing.T) {
+	tcp, branch, tag := "tcp", "z9hG4bK776asdhds", "1928301774"
+	tests := []struct {
+		params   Params
+		expected string
+	}{
+		{(&SipUri{Host: "example.com", UriParams: Params{"transport": &tcp, "lr": nil, "maddr": &bob}}).UriParams,
+			"lr maddr=bob transport=tcp"},
+		{(&ViaHop{Params: Params{"rport": nil, "branch": &branch, "received": &bob}}).Params,
+			"branch=z9hG4bK776asdhds received=bob rport"},
+		{(&ToHeader{Params: Params{"tag": &tag}}).Params, "tag=1928301774"},
+		{Params{}, ""},
+		{nil, ""},
+	}
+
+	for _, test := range tests {
+		// Map iteration order varies between runs, so repeat to catch any dependence on it.
+		for attempt := 0; attempt < 10; attempt++ {
+			parts := []string{}
+			for _, param := range OrderedParams(test.params) {
+				if param.Value == nil {
+					parts = append(parts, param.Key)
+				} else {
+					parts = append(parts, param.Key+"="+*param.Value)
+				}
+			}
+			if result := strings.Join(parts, " "); result != test.expected {
+				t.Errorf("expected ordered params %q, got %q", test.expected, result)
+				break
+			}
+		}
+	}
+}
+
+func TestContactSetURIHost(t *testing.T) {
+	tcp, expires, password := "tcp", "3600", "Hunter2"
+	port := uint16(5060)
+	contact := &ContactHeader{
+		Address: &SipUri{IsEncrypted: true, User: &bob, Password: &password, Host: "192.168.1.10", Port: &port,
+			UriParams: Params{"transport": &tcp}, Headers: Params{}},
+		Params: Params{"expires": &expires},
+	}
+
+	publicPort := uint16(31522)
+	if err := contact.SetURIHost("203.0.113.7", &publicPort); err != nil {
+		t.Fatalf("unexpected error rewriting %s: %s", contact.String(), err.Error())
+	}
+	publicPort = 1
+	if contact.String() != "Contact: <sips:bob:Hunter2@203.0.113.7:31522;transport=tcp>;expires=3600" {
+		t.Errorf("unexpected rewritten contact %s", contact.String())
+	}
+
+	if err := contact.SetURIHost("proxy.example.com", nil); err != nil || contact.String() !=
+		"Contact: <sips:bob:Hunter2@proxy.example.com;transport=tcp>;expires=3600" {
+		t.Errorf("unexpected rewritten contact %s (error %v)", contact.String(), err)
+	}
+
+	if err := contact.SetURIHost("", nil); err == nil {
+		t.Errorf("expected an error setting an empty host on %s", contact.String())
+	}
+
+	wildcard := &ContactHeader{Address: &WildcardUri{}, Params: Params{}}
+	if err := wildcard.SetURIHost("203.0.113.7", &publicPort); err == nil {
+		t.Errorf("expected an error rewriting the wildcard contact")
+	}
+}
+
+func TestParseTtl(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected uint8
+		valid    bool
+	}{
+		{"0", 0, true},
+		{"1", 1, true},
+		{"016", 16, true},
+		{"255", 255, true},
+		{"256", 0, false},
+		{"0255", 0, false},
+		{"", 0, false},
+		{"+1", 0, false},
+		{"1a", 0, false},
+	}
+
+	for _, test := range tests {
+		value, err := ParseTtl(test.text)
+		if test.valid && (err != nil || value != test.expected) {
+			t.Errorf("expected ParseTtl(%q) to be %d, got %d (error %v)", test.text, test.expected, value, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("expected an error from ParseTtl(%q), got %d", test.text, value)
+		}
+	}
+
+	// A URI built in code may carry an out-of-range ttl, which isn't reported as valid.
+	outOfRange := "256"
+	uri := &SipUri{Host: "224.2.0.1", UriParams: Params{"ttl": &outOfRange}}
+	if _, ok := uri.Ttl(); ok {
+		t.Errorf("expected the ttl of %s to be invalid", uri.String())
+	}
+}
+
+func TestParseDeltaSeconds(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected uint32
+		valid    bool
+	}{
+		{"0", 0, true},
+		{"3600", 3600, true},
+		{"0003600", 3600, true},
+		{"4294967295", 4294967295, true},
+		{"4294967296", 0, false},
+		{"18446744073709551616", 0, false},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"+1", 0, false},
+		{" 60", 0, false},
+		{"60s", 0, false},
+		{"0x10", 0, false},
+	}
+
+	for _, test := range tests {
+		value, err := ParseDeltaSeconds(test.text)
+		if test.valid && (err != nil || value != test.expected) {
+			t.Errorf("expected ParseDeltaSeconds(%q) to be %d, got %d (error %v)", test.text, test.expected, value, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("expected an error from ParseDeltaSeconds(%q), got %d", test.text, value)
+		}
+	}
+
+	// Overflowing params are treated as invalid rather than wrapping.
+	overflow := "4294967296"
+	contact := &ContactHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{"expires": &overflow}}
+	if expiry := EffectiveExpiry(contact, nil, 3600); expiry != 3600 {
+		t.Errorf("expected an overflowing expires param to be ignored, got %d", expiry)
+	}
+}
+
+func TestNewContentIDHeader(t *testing.T) {
+	for _, id := range []string{"abc@atlanta.com", "<abc@atlanta.com>", " <abc@atlanta.com> "} {
+		header := NewContentIDHeader(id)
+		if header.Id != "abc@atlanta.com" || header.String() != "Content-ID: <abc@atlanta.com>" {
+			t.Errorf("unexpected Content-ID from %q: %q", id, header.String())
+		}
+	}
+}
+
+func TestNewContactHeader(t *testing.T) {
+	tcp := "tcp"
+	uri := &SipUri{User: &bob, Host: "192.0.2.4", UriParams: Params{"transport": &tcp}, Headers: Params{}}
+	expires := uint32(3600)
+
+	contact := NewContactHeader(uri, &expires)
+	if contact.String() != "Contact: <sip:bob@192.0.2.4;transport=tcp>;expires=3600" {
+		t.Errorf("unexpected contact %s", contact.String())
+	}
+	if EffectiveExpiry(contact, nil, 0) != 3600 {
+		t.Errorf("expected an expiry of 3600 on %s", contact.String())
+	}
+	contact.Address.(*SipUri).UriParams["transport"] = nil
+	if *uri.UriParams["transport"] != "tcp" {
+		t.Errorf("expected the contact not to share the given URI's params")
+	}
+
+	if contact := NewContactHeader(uri, nil); contact.String() != "Contact: <sip:bob@192.0.2.4;transport=tcp>" {
+		t.Errorf("unexpected contact without expiry %s", contact.String())
+	}
+
+	outbound := NewOutboundContactHeader(uri, &expires, "urn:uuid:f81d4fae-7dec-11d0-a765-00a0c91e6bf6", 1)
+	if regId, ok := outbound.RegID(); !ok || regId != 1 {
+		t.Errorf("expected reg-id 1 on %s", outbound.String())
+	}
+	if instance := outbound.FeatureTags()["+sip.instance"]; instance == nil ||
+		*instance != "<urn:uuid:f81d4fae-7dec-11d0-a765-00a0c91e6bf6>" {
+		t.Errorf("unexpected instance ID on %s", outbound.String())
+	}
+	if !strings.Contains(outbound.String(), `+sip.instance="<urn:uuid:f81d4fae-7dec-11d0-a765-00a0c91e6bf6>"`) ||
+		!strings.Contains(outbound.String(), "expires=3600") {
+		t.Errorf("unexpected outbound contact %s", outbound.String())
+	}
+}
@@ -3,7 +3,11 @@ package base
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
+
+	"github.com/stefankopieczek/gossip/utils"
 )
 
 // A representation of a SIP method.
@@ -22,6 +26,38 @@ func (method *Method) Equals(other *Method) bool {
 	}
 }
 
+// Produce the name of the method, e.g. "INVITE".
+func (method Method) String() string {
+	return string(method)
+}
+
+// Determine if a request with this method can create a dialog (RFC 3261 s. 12, RFC 6665, RFC 3515):
+// that is, if it is an INVITE, SUBSCRIBE or REFER.
+func (method Method) IsDialogCreating() bool {
+	switch Method(strings.ToUpper(string(method))) {
+	case INVITE, SUBSCRIBE, REFER:
+		return true
+	}
+	return false
+}
+
+// Determine if a request with this method is a target refresh request, which updates the remote target of
+// the dialog from its Contact header (RFC 3261 s. 12.2): that is, if it is an INVITE, UPDATE, SUBSCRIBE
+// or NOTIFY.
+func (method Method) IsTargetRefresh() bool {
+	switch Method(strings.ToUpper(string(method))) {
+	case INVITE, UPDATE, SUBSCRIBE, NOTIFY:
+		return true
+	}
+	return false
+}
+
+// Determine if a request with this method may carry a message body. This is true of every method except
+// CANCEL, for which Content-Type is not applicable (RFC 3261 s. 20, table 2), including unknown methods.
+func (method Method) CanHaveBody() bool {
+	return !strings.EqualFold(string(method), string(CANCEL))
+}
+
 // It's nicer to avoid using raw strings to represent methods, so the following standard
 // method names are defined here as constants for convenience.
 const (
@@ -34,8 +70,56 @@ const (
 	SUBSCRIBE Method = "SUBSCRIBE"
 	NOTIFY    Method = "NOTIFY"
 	REFER     Method = "REFER"
+	INFO      Method = "INFO"
+	MESSAGE   Method = "MESSAGE"
+	PRACK     Method = "PRACK"
+	PUBLISH   Method = "PUBLISH"
+	UPDATE    Method = "UPDATE"
 )
 
+// The port used for SIP when none is specified (RFC 3261 s. 19.1.2).
+const DEFAULT_SIP_PORT uint16 = 5060
+
+// The port used for SIP over TLS when none is specified (RFC 3261 s. 19.1.2).
+const DEFAULT_SIPS_PORT uint16 = 5061
+
+// Return the given port, or the default SIP port if it is nil.
+func portOrDefault(port *uint16) uint16 {
+	if port == nil {
+		return DEFAULT_SIP_PORT
+	}
+	return *port
+}
+
+// The initial value of the Max-Forwards header on new requests (RFC 3261 s. 8.1.1.6).
+const DEFAULT_MAX_FORWARDS = 70
+
+// The initial capacity of the buffer into which a message is serialized, in addition to the size of its body.
+// This is enough for the headers of most messages, so that the buffer rarely needs to grow.
+const c_SERIALIZE_BUFFER_SIZE = 1024
+
+// The media type of a Session Description Protocol body (RFC 4566).
+const SDP_CONTENT_TYPE = "application/sdp"
+
+// A part of a multipart body (RFC 2046 s. 5.1), as produced by parser.ParseMultipart.
+type BodyPart struct {
+	// The headers of the part, in order.
+	Headers []SipHeader
+
+	// The part's Content-Type, which is also in Headers; nil if it has none, in which case it is text/plain.
+	ContentType *ContentType
+
+	// The part's Content-Disposition, which is also in Headers; nil if it has none.
+	ContentDisposition *ContentDispositionHeader
+
+	// The part's Content-ID, which is also in Headers, and allows it to be referenced from elsewhere with a
+	// cid: URI (RFC 2392); nil if it has none.
+	ContentId *ContentIDHeader
+
+	// The content of the part, excluding its headers.
+	Content []byte
+}
+
 // Internal representation of a SIP message - either a Request or a Response.
 type SipMessage interface {
 	// Yields a flat, string representation of the SIP message suitable for sending out over the wire.
@@ -69,31 +153,201 @@ type headers struct {
 	// The logical SIP headers attached to this message.
 	headers map[string][]SipHeader
 
-	// The order the headers should be displayed in.
+	// The order the headers should be displayed in: the order in which each header name first appeared.
+	// Headers with the same name are kept together, in the order they were added, which is equivalent
+	// per RFC 3261 s. 7.3.1 as the relative order of headers with different names is not significant.
 	headerOrder []string
+
+	// How Via hops are laid out when the message is serialized; see SetViaPolicy.
+	viaPolicy ViaPolicy
+
+	// Whether a Content-Length header is added when the message is serialized without one; see
+	// SetContentLengthPolicy.
+	contentLengthPolicy ContentLengthPolicy
+
+	// The text from which each header was parsed, by header name and in the same order as headers, for a
+	// message built by NewParsedRequest or NewParsedResponse. Headers added since have none, so a slice may be
+	// shorter than the headers it goes with. Nil unless the message was built with raw values.
+	rawValues map[string][]string
 }
 
+// A header, together with the text from which it was parsed: its whole field as received, including the name
+// and any folded continuation lines, which are joined by CRLF without a trailing one. Where a field holds
+// several headers, such as a comma-separated list of Contacts, each of them has the whole field. Raw is empty
+// if the text wasn't kept.
+type ParsedHeader struct {
+	Header SipHeader
+	Raw    string
+}
+
+// How the Via hops of a message are laid out when it is serialized. Either way, the hops keep their order.
+type ViaPolicy int
+
+const (
+	// Emit each hop on its own 'Via:' line. This is the default, and is the most interoperable.
+	VIA_ONE_HOP_PER_LINE ViaPolicy = iota
+
+	// Emit all hops on a single 'Via:' line, separated by commas (RFC 3261 s. 7.3.1).
+	VIA_COALESCED
+)
+
+// Whether a message serialized without a Content-Length header gets one.
+type ContentLengthPolicy int
+
+const (
+	// Emit a Content-Length header giving the length of the body if the message has none, so that even an
+	// empty body is framed with 'Content-Length: 0'. This is the default; RFC 3261 s. 18.3 makes the header
+	// mandatory over stream transports, and recommends it everywhere.
+	CONTENT_LENGTH_ALWAYS ContentLengthPolicy = iota
+
+	// Emit only the headers the message has, for the rare UDP peer which mishandles Content-Length.
+	// Messages with this policy should be checked with CheckContentLength before being sent.
+	CONTENT_LENGTH_AS_GIVEN
+)
+
 func newHeaders() (result headers) {
 	result.headers = make(map[string][]SipHeader)
 	return result
 }
 
 func (h headers) String() string {
-	buffer := bytes.Buffer{}
+	return string(h.appendString(nil))
+}
+
+// Append the headers, each followed by a CRLF, to the given buffer.
+func (h headers) appendString(buf []byte) []byte {
 	// Construct each header in turn and add it to the message.
-	for typeIdx, name := range h.headerOrder {
+	for _, name := range h.headerOrder {
 		headers := h.headers[name]
-		for idx, header := range headers {
-			buffer.WriteString(header.String())
-			if typeIdx < len(h.headerOrder) || idx < len(headers) {
-				buffer.WriteString("\r\n")
-			}
+		if name == "Via" {
+			headers = layOutVias(headers, h.viaPolicy)
+		}
+		for _, header := range headers {
+			buf = appendString(buf, header)
+			buf = append(buf, "\r\n"...)
 		}
 	}
-	return buffer.String()
+	return buf
+}
+
+// Compute the length of the string produced by String(), without building it. Each header is serialized
+// in turn into the given scratch buffer, which is reused for each rather than grown to hold them all.
+func (h headers) size(scratch []byte) int {
+	size := 0
+	for _, name := range h.headerOrder {
+		headers := h.headers[name]
+		if name == "Via" {
+			headers = layOutVias(headers, h.viaPolicy)
+		}
+		for _, header := range headers {
+			scratch = appendString(scratch[:0], header)
+			size += len(scratch) + len("\r\n")
+		}
+	}
+	return size
+}
+
+// Get the policy deciding how the Via hops of the message are laid out when it is serialized.
+func (hs *headers) ViaPolicy() ViaPolicy {
+	return hs.viaPolicy
+}
+
+// Set the policy deciding how the Via hops of the message are laid out when it is serialized.
+func (hs *headers) SetViaPolicy(policy ViaPolicy) {
+	hs.viaPolicy = policy
+}
+
+// Get the policy deciding whether a Content-Length header is added when the message is serialized without one.
+func (hs *headers) ContentLengthPolicy() ContentLengthPolicy {
+	return hs.contentLengthPolicy
+}
+
+// Set the policy deciding whether a Content-Length header is added when the message is serialized without one.
+func (hs *headers) SetContentLengthPolicy(policy ContentLengthPolicy) {
+	hs.contentLengthPolicy = policy
+}
+
+// Produce the Content-Length header to serialize after the headers of a message with the given body, if any:
+// one is only needed if the policy is CONTENT_LENGTH_ALWAYS and the message has none.
+func (h headers) implicitContentLength(body string) string {
+	if h.contentLengthPolicy != CONTENT_LENGTH_ALWAYS || len(h.Headers("Content-Length")) > 0 {
+		return ""
+	}
+	contentLength := ContentLength(len(body))
+	return contentLength.String() + "\r\n"
+}
+
+// Check that the message can be framed when sent over the given transport. Over a stream transport such
+// as TCP, the Content-Length header is the only way to find the end of a message, so it is mandatory
+// (RFC 3261 s. 18.3); an error is returned if the message doesn't have one and won't be given one when it
+// is serialized, because its ContentLengthPolicy() is CONTENT_LENGTH_AS_GIVEN.
+func (hs *headers) CheckContentLength(transport Transport) error {
+	if transport.IsStream() && hs.contentLengthPolicy == CONTENT_LENGTH_AS_GIVEN &&
+		len(hs.Headers("Content-Length")) == 0 {
+		return fmt.Errorf("message to be sent over stream transport %s has no Content-Length header", transport)
+	}
+	return nil
 }
 
-// Add the given header.
+// Regroup the hops of the given Via headers into headers laid out according to the given policy.
+// If any of the headers isn't a ViaHeader, they are returned as they are.
+func layOutVias(vias []SipHeader, policy ViaPolicy) []SipHeader {
+	hops, ok := flattenVias(vias)
+	if !ok {
+		return vias
+	}
+
+	if policy == VIA_COALESCED {
+		return []SipHeader{hops}
+	}
+
+	result := make([]SipHeader, 0, len(hops))
+	for _, line := range hops.Split() {
+		result = append(result, line)
+	}
+	return result
+}
+
+// Concatenate the hops of the given Via headers, in order. The boolean return is false if any of the
+// headers isn't a ViaHeader.
+func flattenVias(vias []SipHeader) (ViaHeader, bool) {
+	hops := make(ViaHeader, 0, len(vias))
+	for _, header := range vias {
+		switch header := header.(type) {
+		case ViaHeader:
+			hops = append(hops, header...)
+		case *ViaHeader:
+			hops = append(hops, (*header)...)
+		default:
+			return nil, false
+		}
+	}
+	return hops, true
+}
+
+// Get the whole Via chain of the message as a single logical header, with the topmost hop first.
+// A message's Via hops may be split across any number of 'Via:' lines without changing its meaning
+// (RFC 3261 s. 7.3.1), so this is the form to use when comparing or inspecting them.
+// The hops are shared with the message, not copied.
+func (hs *headers) ViaChain() ViaHeader {
+	hops, _ := flattenVias(hs.Headers("Via"))
+	return hops
+}
+
+// Replace all Via headers on the message with the given chain, which goes in the place of the first of
+// the existing ones. However the chain is split, the message's ViaPolicy decides how its hops are laid
+// out when it is serialized. An empty chain removes all Via headers.
+func (hs *headers) SetViaChain(chain ViaHeader) {
+	if len(chain) == 0 {
+		hs.RemoveHeaders("Via")
+		return
+	}
+	hs.SetHeader("Via", &chain)
+}
+
+// Add the given header after any others with the same name, or at the end of the message if there are none.
+// Headers with the same name are always kept together, so a message whose headers of one name are interleaved
+// with others is serialized with them grouped at the position of the first; see headers.headerOrder.
 func (hs *headers) AddHeader(h SipHeader) {
 	if hs.headers == nil {
 		hs.headers = map[string][]SipHeader{}
@@ -108,6 +362,48 @@ func (hs *headers) AddHeader(h SipHeader) {
 	}
 }
 
+// Add the given header, as AddHeader does, along with the text from which it was parsed.
+func (hs *headers) addParsedHeader(parsed ParsedHeader) {
+	hs.AddHeader(parsed.Header)
+	if parsed.Raw == "" {
+		return
+	}
+	if hs.rawValues == nil {
+		hs.rawValues = map[string][]string{}
+	}
+	name := parsed.Header.Name()
+	raws := hs.rawValues[name]
+	for len(raws) < len(hs.headers[name])-1 {
+		raws = append(raws, "")
+	}
+	hs.rawValues[name] = append(raws, parsed.Raw)
+}
+
+// Remove the raw value, if any, of the header with the given name at the given position among those with it.
+func (hs *headers) removeRawValue(name string, idx int) {
+	raws := hs.rawValues[name]
+	if idx >= len(raws) {
+		return
+	}
+	raws = append(raws[:idx], raws[idx+1:]...)
+	if len(raws) == 0 {
+		delete(hs.rawValues, name)
+	} else {
+		hs.rawValues[name] = raws
+	}
+}
+
+// Get the text from which each of the headers with the given name was parsed, in the same order as Headers
+// returns them; see ParsedHeader. A header has "" if the message wasn't built with its raw value, as when it
+// was added since. Unlike the header's String(), this is exactly the bytes received, so it can be logged
+// losslessly or used to verify a signature computed over the received message (e.g. RFC 8224). The raw
+// value isn't updated if the header is modified, and copies of the message have none.
+func (hs *headers) RawValues(name string) []string {
+	raws := make([]string, len(hs.headers[name]))
+	copy(raws, hs.rawValues[name])
+	return raws
+}
+
 // Gets some headers.
 func (hs *headers) Headers(name string) []SipHeader {
 	if hs.headers == nil {
@@ -121,6 +417,148 @@ func (hs *headers) Headers(name string) []SipHeader {
 	}
 }
 
+// Replace all headers with the given name, compared case-insensitively, with the given header alone.
+// The new header takes the place of the ones it replaces; if there were none, it is added to the end of the message.
+func (hs *headers) SetHeader(name string, h SipHeader) {
+	idx := hs.removeHeaders(name)
+	if _, ok := hs.headers[h.Name()]; ok || idx == -1 {
+		hs.AddHeader(h)
+		return
+	}
+
+	hs.headers[h.Name()] = []SipHeader{h}
+	hs.insertHeaderName(idx, h.Name())
+}
+
+// Add the given header ahead of any others with the same name, as a proxy does with its Via and any Route
+// headers it pushes (RFC 3261 s. 16.6). If there are no others, a Via header is placed at the top of the
+// message, a Route header just after any Via headers, and any other header at the end of the message.
+// The order of all existing headers is preserved, except that, as with AddHeader, headers with the same name
+// are kept together.
+func (hs *headers) PrependHeader(h SipHeader) {
+	name := h.Name()
+	if existing, ok := hs.headers[name]; ok {
+		hs.headers[name] = append([]SipHeader{h}, existing...)
+		if raws, ok := hs.rawValues[name]; ok {
+			hs.rawValues[name] = append([]string{""}, raws...)
+		}
+		return
+	}
+
+	idx := len(hs.headerOrder)
+	switch name {
+	case "Via":
+		idx = 0
+	case "Route":
+		idx = 0
+		for pos, existing := range hs.headerOrder {
+			if existing == "Via" {
+				idx = pos + 1
+			}
+		}
+	}
+
+	if hs.headers == nil {
+		hs.headers = map[string][]SipHeader{}
+	}
+	hs.headers[name] = []SipHeader{h}
+	hs.insertHeaderName(idx, name)
+}
+
+// Insert the given header name into the header order at the given position.
+func (hs *headers) insertHeaderName(idx int, name string) {
+	hs.headerOrder = append(hs.headerOrder, "")
+	copy(hs.headerOrder[idx+1:], hs.headerOrder[idx:])
+	hs.headerOrder[idx] = name
+}
+
+// Remove all headers with the given name, compared case-insensitively.
+func (hs *headers) RemoveHeaders(name string) {
+	hs.removeHeaders(name)
+}
+
+// Remove all headers with the given name, compared case-insensitively, and return the position
+// the first of them held in the header order, or -1 if there were none.
+func (hs *headers) removeHeaders(name string) int {
+	firstIdx := -1
+	for idx := 0; idx < len(hs.headerOrder); idx++ {
+		if strings.EqualFold(hs.headerOrder[idx], name) {
+			delete(hs.headers, hs.headerOrder[idx])
+			delete(hs.rawValues, hs.headerOrder[idx])
+			hs.headerOrder = append(hs.headerOrder[:idx], hs.headerOrder[idx+1:]...)
+			if firstIdx == -1 {
+				firstIdx = idx
+			}
+			idx--
+		}
+	}
+	return firstIdx
+}
+
+// Replace all headers with the same name as the given header with that header alone.
+// If there were no such headers, the header is added to the end of the message.
+func (hs *headers) replaceHeader(h SipHeader) {
+	name := h.Name()
+	if _, ok := hs.headers[name]; ok {
+		hs.headers[name] = []SipHeader{h}
+		delete(hs.rawValues, name)
+	} else {
+		hs.AddHeader(h)
+	}
+}
+
+// Get the Content-Type header, if there is one; otherwise return nil.
+func (hs *headers) GetContentType() *ContentType {
+	contentTypes := hs.Headers("Content-Type")
+	if len(contentTypes) == 0 {
+		return nil
+	}
+	return contentTypes[0].(*ContentType)
+}
+
+// Headers which every request and response must carry exactly once (RFC 3261 s. 8.1.1).
+var singleInstanceHeaders = []string{"Call-Id", "CSeq", "From", "To"}
+
+// Headers which may appear at most once in any message.
+var atMostOnceHeaders = []string{"Content-Length", "Content-Type", "Expires", "Max-Forwards", "Min-Expires"}
+
+// Count the headers with the given name, compared case-insensitively.
+func (hs *headers) countHeaders(name string) int {
+	count := 0
+	for key, headers := range hs.headers {
+		if strings.EqualFold(key, name) {
+			count += len(headers)
+		}
+	}
+	return count
+}
+
+// Check that each of the given mandatory headers is present exactly once, that there is at least one Via
+// header, and that no header which may only appear once has been duplicated.
+// The returned error names the first offending header found.
+func (hs *headers) checkCardinality(mandatory []string) error {
+	for _, name := range mandatory {
+		switch count := hs.countHeaders(name); {
+		case count == 0:
+			return fmt.Errorf("missing mandatory %s header", name)
+		case count > 1:
+			return fmt.Errorf("%d %s headers found; expected exactly one", count, name)
+		}
+	}
+
+	for _, name := range atMostOnceHeaders {
+		if count := hs.countHeaders(name); count > 1 {
+			return fmt.Errorf("%d %s headers found; expected at most one", count, name)
+		}
+	}
+
+	if hs.countHeaders("Via") == 0 {
+		return fmt.Errorf("missing mandatory Via header")
+	}
+
+	return nil
+}
+
 // Copy all headers of one type from one message to another.
 // Appending to any headers that were already there.
 func CopyHeaders(name string, from, to SipMessage) {
@@ -136,6 +574,8 @@ type Request struct {
 	Method Method
 
 	// The Request URI. This indicates the user to whom this request is being addressed.
+	// It is taken from the request line, and is distinct from the URI in the To header: the two differ
+	// once a request has been retargeted, and the Request-URI may carry params which the To URI does not.
 	Recipient Uri
 
 	// The version of SIP used in this message, e.g. "SIP/2.0".
@@ -144,11 +584,11 @@ type Request struct {
 	// A Request has headers.
 	headers
 
-	// The order the headers should be displayed in.
-	headerOrder []string
-
 	// The application data of the message.
 	Body string
+
+	// The cached wire representation of the request; see CachedBytes().
+	cachedBytes []byte
 }
 
 func NewRequest(method Method, recipient Uri, sipVersion string, headers []SipHeader, body string) (request *Request) {
@@ -166,21 +606,449 @@ func NewRequest(method Method, recipient Uri, sipVersion string, headers []SipHe
 	return
 }
 
+// Build a request as NewRequest does, from headers which carry the text they were parsed from, so that it can
+// be retrieved with RawValues. This is how the parser builds the requests it produces.
+func NewParsedRequest(method Method, recipient Uri, sipVersion string, headers []ParsedHeader, body string) (request *Request) {
+	request = NewRequest(method, recipient, sipVersion, []SipHeader{}, body)
+	for _, header := range headers {
+		request.addParsedHeader(header)
+	}
+
+	return
+}
+
 func (request *Request) String() string {
-	var buffer bytes.Buffer
+	return string(request.appendBytes(make([]byte, 0, c_SERIALIZE_BUFFER_SIZE+len(request.Body))))
+}
 
+// Write the wire representation of the request to the given writer, without building an intermediate
+// string; this implements io.WriterTo. The request is always serialized afresh, so fields changed directly
+// since the bytes were cached are reflected; use CachedBytes to retransmit the same bytes.
+// The number of bytes written is returned, along with any error from the writer.
+func (request *Request) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(request.appendBytes(make([]byte, 0, c_SERIALIZE_BUFFER_SIZE+len(request.Body))))
+	return int64(n), err
+}
+
+// Append the wire representation of the request to the given buffer. The whole request is serialized
+// into the one buffer.
+func (request *Request) appendBytes(buf []byte) []byte {
 	// Every SIP request starts with a Request Line - RFC 2361 7.1.
-	buffer.WriteString(fmt.Sprintf("%s %s %s\r\n",
-		(string)(request.Method),
-		request.Recipient.String(),
-		request.SipVersion))
+	buf = append(buf, request.Method...)
+	buf = append(buf, ' ')
+	buf = appendString(buf, request.Recipient)
+	buf = append(buf, ' ')
+	buf = append(buf, request.SipVersion...)
+	buf = append(buf, "\r\n"...)
 
-	buffer.WriteString(request.headers.String())
+	buf = request.headers.appendString(buf)
+	buf = append(buf, request.headers.implicitContentLength(request.Body)...)
 
 	// If the request has a message body, add it.
-	buffer.WriteString("\r\n" + request.Body)
+	buf = append(buf, "\r\n"...)
+	buf = append(buf, request.Body...)
 
-	return buffer.String()
+	return buf
+}
+
+// Make a deep copy of the request, which shares no headers, URIs or params with the original.
+// The copy keeps the original's Via and Content-Length policies.
+func (request *Request) Copy() *Request {
+	headers := request.AllHeaders()
+	for idx, header := range headers {
+		headers[idx] = header.Copy()
+	}
+
+	dup := NewRequest(request.Method, request.Recipient.Copy(), request.SipVersion, headers, request.Body)
+	dup.viaPolicy = request.viaPolicy
+	dup.contentLengthPolicy = request.contentLengthPolicy
+	return dup
+}
+
+// Fork the request to the given targets, as a proxy does when it forwards a request to several
+// destinations in parallel (RFC 3261 s. 16.6). One copy of the request is made per target, in order,
+// with the target as its Request-URI; and a copy of the given Via hop, which should be the proxy's own,
+// is pushed on top of its Via headers with a newly generated branch, so that each fork is a separate
+// client transaction. The forks share no mutable state with the original request or with each other.
+// The caller remains responsible for the rest of the proxy's processing, such as Max-Forwards and Route.
+func (request *Request) Fork(targets []Uri, via *ViaHop) []*Request {
+	forks := make([]*Request, 0, len(targets))
+	for _, target := range targets {
+		fork := request.Copy()
+		fork.SetRequestURI(target.Copy())
+
+		hop := via.Copy()
+		if hop.Params == nil {
+			hop.Params = Params{}
+		}
+		branch := GenerateBranch()
+		hop.Params["branch"] = &branch
+		fork.PrependHeader(&ViaHeader{hop})
+
+		forks = append(forks, fork)
+	}
+	return forks
+}
+
+// Add a Max-Forwards header with the default value of 70 if the request has none (RFC 3261 s. 8.1.1.6).
+// This should be called before proxying a request, to guard against routing loops.
+func (request *Request) EnsureMaxForwards() {
+	if len(request.Headers("Max-Forwards")) == 0 {
+		maxForwards := MaxForwards(DEFAULT_MAX_FORWARDS)
+		request.AddHeader(&maxForwards)
+	}
+}
+
+// Determine if the request is sent within an existing dialog, which is the case exactly when its
+// To header carries a tag (RFC 3261 s. 12.2). Returns false if there is no To header.
+func (request *Request) IsInDialog() bool {
+	for _, header := range request.Headers("To") {
+		to, ok := header.(*ToHeader)
+		if !ok {
+			continue
+		}
+		tag, ok := to.Params["tag"]
+		return ok && tag != nil && *tag != ""
+	}
+	return false
+}
+
+// Determine if the request is a re-INVITE, modifying an existing session, rather than an initial
+// INVITE creating a new one; that is, if it is an INVITE sent within a dialog.
+func (request *Request) IsReInvite() bool {
+	return request.Method == INVITE && request.IsInDialog()
+}
+
+// Raise the expiry of a REGISTER request to at least the given Min-Expires, after it has been
+// rejected with a 423 (Interval Too Brief) response (RFC 3261 s. 10.2.8).
+// Any Contact 'expires' params below the minimum are raised to it, and so is the Expires header,
+// which is added if the request has none. The caller remains responsible for updating the CSeq and
+// Via branch before resending.
+func AdjustRegisterForMinExpires(register *Request, minExpires MinExpires) {
+	register.cachedBytes = nil
+	minimum := strconv.FormatUint(uint64(minExpires), 10)
+
+	for _, header := range register.Headers("Contact") {
+		contact, ok := header.(*ContactHeader)
+		if !ok {
+			continue
+		}
+		if param, ok := contact.Params["expires"]; ok && param != nil {
+			if value, err := ParseDeltaSeconds(*param); err != nil || value < uint32(minExpires) {
+				contact.Params["expires"] = &minimum
+			}
+		}
+	}
+
+	expires := Expires(minExpires)
+	for _, header := range register.Headers("Expires") {
+		if existing, ok := header.(*Expires); ok && uint32(*existing) > uint32(minExpires) {
+			expires = *existing
+		}
+	}
+	register.SetHeader("Expires", &expires)
+}
+
+// Determine if any Via hop on the request has the given sent-by address, across all Via headers.
+// The host is compared case-insensitively, and an absent port on either side is taken to be the default
+// SIP port, 5060. A proxy can use this, together with the branch parameter, to detect loops
+// (RFC 3261 s. 16.3).
+func (request *Request) HasViaMatching(host string, port *uint16) bool {
+	for _, header := range request.Headers("Via") {
+		var via ViaHeader
+		switch header := header.(type) {
+		case ViaHeader:
+			via = header
+		case *ViaHeader:
+			via = *header
+		default:
+			continue
+		}
+
+		for _, hop := range via {
+			if strings.EqualFold(hop.Host, host) && portOrDefault(hop.Port) == portOrDefault(port) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Identifies a request for the purpose of detecting merged requests (RFC 3261 s. 8.2.2.2): requests which
+// arrive at a UAS more than once, over different paths, after being forked by a proxy upstream.
+// MergeKey is comparable, so it can be used as a map key.
+type MergeKey struct {
+	FromTag string
+	CallId  CallId
+	CSeq    CSeq
+}
+
+// Get the merge detection key of the request, made up of its From tag, Call-ID and CSeq.
+// Returns an error if the request has no From tag, Call-ID or CSeq.
+func (request *Request) MergeKey() (key MergeKey, err error) {
+	for _, header := range request.Headers("From") {
+		if from, ok := header.(*FromHeader); ok {
+			if tag, ok := from.Params["tag"]; ok && tag != nil {
+				key.FromTag = *tag
+			}
+		}
+	}
+	if key.FromTag == "" {
+		err = fmt.Errorf("request '%s' has no From tag", request.Short())
+		return
+	}
+
+	callIds := request.Headers("Call-Id")
+	if len(callIds) == 0 {
+		err = fmt.Errorf("request '%s' has no Call-Id header", request.Short())
+		return
+	}
+	if callId, ok := callIds[0].(*CallId); ok {
+		key.CallId = *callId
+	}
+
+	cseqs := request.Headers("CSeq")
+	if len(cseqs) == 0 {
+		err = fmt.Errorf("request '%s' has no CSeq header", request.Short())
+		return
+	}
+	if cseq, ok := cseqs[0].(*CSeq); ok {
+		key.CSeq = *cseq
+	}
+	return
+}
+
+// Determine if the request is a merged copy of an earlier one received by a UAS: that is, if it has the same
+// From tag, Call-ID and CSeq, but belongs to a different transaction, as identified by the branch and sent-by
+// of its top Via hop. A retransmission of the earlier request is not a merged request. A UAS should reject
+// a merged request with a 482 (Loop Detected) response (RFC 3261 s. 8.2.2.2).
+// Only a request outside a dialog, with no To tag, can be a merged request.
+// Returns false if either request lacks any of the headers needed to tell.
+func IsMergedRequest(request *Request, earlier *Request) bool {
+	if request.IsInDialog() {
+		return false
+	}
+	key, err := request.MergeKey()
+	if err != nil {
+		return false
+	}
+	earlierKey, err := earlier.MergeKey()
+	if err != nil || key != earlierKey {
+		return false
+	}
+
+	hops, earlierHops := request.ViaChain(), earlier.ViaChain()
+	if len(hops) == 0 || len(earlierHops) == 0 {
+		return false
+	}
+	hop, earlierHop := hops[0], earlierHops[0]
+	branch, ok := hop.Params["branch"]
+	earlierBranch, earlierOk := earlierHop.Params["branch"]
+	if !ok || !earlierOk {
+		return false
+	}
+	return !utils.StrPtrEq(branch, earlierBranch) || !strings.EqualFold(hop.Host, earlierHop.Host) ||
+		portOrDefault(hop.Port) != portOrDefault(earlierHop.Port)
+}
+
+// Record on the top Via hop the address from which the request was actually received, as a server must
+// on receipt (RFC 3261 s. 18.2.1). A 'received' param holding the source IP is added if it differs from
+// the sent-by host. If the hop carries an 'rport' param with no value, the source port is filled in,
+// and 'received' is then added even if the host matches, as RFC 3581 s. 4 requires.
+// A request with no Via header is left unchanged.
+func (request *Request) FixupTopViaForReceipt(srcIP string, srcPort uint16) {
+	vias := request.Headers("Via")
+	if len(vias) == 0 {
+		return
+	}
+
+	var via ViaHeader
+	switch header := vias[0].(type) {
+	case ViaHeader:
+		via = header
+	case *ViaHeader:
+		via = *header
+	}
+	if len(via) == 0 {
+		return
+	}
+
+	request.cachedBytes = nil
+	hop := via[0]
+	if hop.Params == nil {
+		hop.Params = Params{}
+	}
+
+	addReceived := !sameIP(hop.Host, srcIP)
+	if rport, ok := hop.Params["rport"]; ok && (rport == nil || *rport == "") {
+		port := strconv.FormatUint(uint64(srcPort), 10)
+		hop.Params["rport"] = &port
+		addReceived = true
+	}
+	if addReceived {
+		received := strings.Trim(srcIP, "[]")
+		hop.Params["received"] = &received
+	}
+}
+
+// Determine if the given host is the IP address given, ignoring any brackets around IPv6 references
+// and the case of any hex digits.
+func sameIP(host string, ip string) bool {
+	return strings.EqualFold(strings.Trim(host, "[]"), strings.Trim(ip, "[]"))
+}
+
+// Check that the request has exactly one each of the Call-Id, CSeq, From, To and Max-Forwards headers,
+// at least one Via header, and at most one of any other header which may not be repeated.
+// A message which fails this check is malformed, and should be rejected rather than processed, since
+// elements which pick different instances of a duplicated header can be made to disagree about it.
+func (request *Request) CheckCardinality() error {
+	return request.headers.checkCardinality(append(singleInstanceHeaders, "Max-Forwards"))
+}
+
+// Get the wire representation of the request, as a byte slice.
+// The request is serialized on the first call, and the result cached for subsequent calls, which makes
+// this suitable for retransmissions. The cache is invalidated by any change made through the
+// AddHeader, RemoveHeader, SetBody, SetBodyWithType, SetSDP, SetViaPolicy or SetContentLengthPolicy
+// methods; changes made by modifying
+// fields or headers directly are not detected, so callers doing so must not rely on the cache.
+func (request *Request) CachedBytes() []byte {
+	if request.cachedBytes == nil {
+		request.cachedBytes = []byte(request.String())
+	}
+	return request.cachedBytes
+}
+
+// Compute the length in bytes of the request's wire representation, without serializing the whole request;
+// this is exactly len(request.CachedBytes()). A transport may use it to choose between UDP and a
+// congestion-controlled transport before sending the request (RFC 3261 s. 18.1.1).
+func (request *Request) EstimatedSize() int {
+	if request.cachedBytes != nil {
+		return len(request.cachedBytes)
+	}
+
+	scratch := appendString(make([]byte, 0, c_SERIALIZE_BUFFER_SIZE), request.Recipient)
+	size := len(request.Method) + len(" ") + len(scratch) + len(" ") + len(request.SipVersion) + len("\r\n")
+	size += request.headers.size(scratch)
+	size += len(request.headers.implicitContentLength(request.Body))
+	size += len("\r\n") + len(request.Body)
+	return size
+}
+
+// Add the given header to the request.
+func (request *Request) AddHeader(h SipHeader) {
+	request.cachedBytes = nil
+	request.headers.AddHeader(h)
+}
+
+// Replace all Via headers on the request with the given chain; see SetViaChain on the headers type.
+func (request *Request) SetViaChain(chain ViaHeader) {
+	request.cachedBytes = nil
+	request.headers.SetViaChain(chain)
+}
+
+// Set the policy deciding how the Via hops of the request are laid out when it is serialized.
+func (request *Request) SetViaPolicy(policy ViaPolicy) {
+	request.cachedBytes = nil
+	request.headers.SetViaPolicy(policy)
+}
+
+// Set the policy deciding whether a Content-Length header is added when the request is serialized without one.
+func (request *Request) SetContentLengthPolicy(policy ContentLengthPolicy) {
+	request.cachedBytes = nil
+	request.headers.SetContentLengthPolicy(policy)
+}
+
+// Add a header to the request ahead of any others with the same name; see PrependHeader on the headers type.
+func (request *Request) PrependHeader(h SipHeader) {
+	request.cachedBytes = nil
+	request.headers.PrependHeader(h)
+}
+
+// Replace all headers on the request with the given name, compared case-insensitively, with the given header.
+func (request *Request) SetHeader(name string, h SipHeader) {
+	request.cachedBytes = nil
+	request.headers.SetHeader(name, h)
+}
+
+// Remove all headers on the request with the given name, compared case-insensitively.
+func (request *Request) RemoveHeaders(name string) {
+	request.cachedBytes = nil
+	request.headers.RemoveHeaders(name)
+}
+
+// A URI referenced by a message, labelled with where in the message it came from; see AllURIs.
+type MessageUri struct {
+	// "Request-URI", or the name of the header the URI came from, e.g. "Contact".
+	Source string
+
+	Uri Uri
+}
+
+// Enumerate the URIs which address the request, so that policy can be applied to them uniformly: the
+// Request-URI, followed by those in the To, From, Contact, Route, Record-Route, Path and
+// P-Asserted-Identity headers, in the order they appear in the message. The wildcard Contact is skipped.
+// The URIs are those of the request rather than copies, so changing them changes the request.
+func (request *Request) AllURIs() []MessageUri {
+	uris := []MessageUri{{"Request-URI", request.Recipient}}
+	for _, header := range request.AllHeaders() {
+		for _, uri := range HeaderURIs(header) {
+			uris = append(uris, MessageUri{header.Name(), uri})
+		}
+	}
+	return uris
+}
+
+// Get the URIs in the given header, if it is a To, From, Contact, Route, Record-Route, Path or
+// P-Asserted-Identity header, in order; the wildcard Contact is skipped. Other headers have none.
+// The URIs are those of the header rather than copies.
+func HeaderURIs(header SipHeader) []Uri {
+	var uris []Uri
+	switch header := header.(type) {
+	case *ToHeader:
+		uris = append(uris, header.Address)
+	case *FromHeader:
+		uris = append(uris, header.Address)
+	case *ContactHeader:
+		if !header.Address.IsWildcard() {
+			uris = append(uris, header.Address)
+		}
+	case *RouteHeader:
+		uris = append(uris, header.Addresses...)
+	case *RecordRouteHeader:
+		uris = append(uris, header.Addresses...)
+	case *PathHeader:
+		uris = append(uris, header.Addresses...)
+	case *PAssertedIdentityHeader:
+		for _, identity := range header.Identities {
+			uris = append(uris, identity.Address)
+		}
+	}
+	return uris
+}
+
+// Remove the topmost Route entry if its URI equals the given one, as a proxy does on receiving a request
+// routed to it (RFC 3261 s. 16.4), and report whether an entry was removed. The URI should be the one the
+// proxy places in Record-Route; it is compared with Equals, so params such as 'lr' must match.
+// Only the first entry of the first Route header is considered: if the header has further entries, they
+// are kept, and otherwise the header itself is removed, leaving any later Route headers in place.
+func (request *Request) RemoveTopRouteIfMatches(uri *SipUri) bool {
+	routes := request.Headers("Route")
+	if len(routes) == 0 {
+		return false
+	}
+	top, ok := routes[0].(*RouteHeader)
+	if !ok || len(top.Addresses) == 0 || !top.Addresses[0].Equals(uri) {
+		return false
+	}
+
+	request.cachedBytes = nil
+	if len(top.Addresses) > 1 {
+		top.Addresses = top.Addresses[1:]
+	} else {
+		request.RemoveHeader(top)
+	}
+	return true
 }
 
 func (request *Request) Short() string {
@@ -209,6 +1077,7 @@ func (request *Request) AllHeaders() []SipHeader {
 }
 
 func (request *Request) RemoveHeader(header SipHeader) error {
+	request.cachedBytes = nil
 	errNoMatch := fmt.Errorf("cannot remove header '%s' from request '%s' as it is not present",
 		header.String(), request.Short())
 	name := header.Name()
@@ -223,6 +1092,7 @@ func (request *Request) RemoveHeader(header SipHeader) error {
 	for idx, hdr := range headersOfSameType {
 		if hdr == header {
 			request.headers.headers[name] = append(headersOfSameType[:idx], headersOfSameType[idx+1:]...)
+			request.headers.removeRawValue(name, idx)
 			found = true
 			break
 		}
@@ -237,9 +1107,10 @@ func (request *Request) RemoveHeader(header SipHeader) error {
 		// and removing the entry from the headerOrder list.
 		delete(request.headers.headers, name)
 
-		for idx, entry := range request.headerOrder {
+		for idx, entry := range request.headers.headerOrder {
 			if entry == name {
-				request.headers.headerOrder = append(request.headerOrder[:idx], request.headerOrder[idx+1:]...)
+				request.headers.headerOrder = append(request.headers.headerOrder[:idx], request.headers.headerOrder[idx+1:]...)
+				break
 			}
 		}
 	}
@@ -247,14 +1118,42 @@ func (request *Request) RemoveHeader(header SipHeader) error {
 	return nil
 }
 
+// Get the Request-URI of the request, from the request line.
+func (request *Request) GetRequestURI() Uri {
+	return request.Recipient
+}
+
+// Set the Request-URI of the request, e.g. when retargeting it. The To header is left unchanged.
+func (request *Request) SetRequestURI(uri Uri) {
+	request.cachedBytes = nil
+	request.Recipient = uri
+}
+
 func (request *Request) GetBody() string {
 	return request.Body
 }
 
 func (request *Request) SetBody(body string) {
+	request.cachedBytes = nil
 	request.Body = body
 }
 
+// Set the body of the request, along with a matching Content-Type header and Content-Length header.
+// Any existing Content-Type and Content-Length headers are replaced.
+func (request *Request) SetBodyWithType(body []byte, contentType *ContentType) {
+	contentLength := ContentLength(len(body))
+	request.cachedBytes = nil
+	request.Body = string(body)
+	request.replaceHeader(contentType)
+	request.replaceHeader(&contentLength)
+}
+
+// Set the body of the request to the given SDP, with a Content-Type of application/sdp.
+func (request *Request) SetSDP(sdp []byte) {
+	contentType := ContentType(SDP_CONTENT_TYPE)
+	request.SetBodyWithType(sdp, &contentType)
+}
+
 // A SIP response object  (c.f. RFC 3261 section 7.2).
 type Response struct {
 	// The version of SIP used in this message, e.g. "SIP/2.0".
@@ -292,22 +1191,165 @@ func NewResponse(sipVersion string, statusCode uint16, reason string, headers []
 	return
 }
 
+// Build a response as NewResponse does, from headers which carry the text they were parsed from, so that it
+// can be retrieved with RawValues. This is how the parser builds the responses it produces.
+func NewParsedResponse(sipVersion string, statusCode uint16, reason string, headers []ParsedHeader, body string) (response *Response) {
+	response = NewResponse(sipVersion, statusCode, reason, []SipHeader{}, body)
+	for _, header := range headers {
+		response.addParsedHeader(header)
+	}
+
+	return
+}
+
+// Build a 302 (Moved Temporarily) response to the given request, redirecting it to the given targets.
+// See NewRedirectResponseWithStatus.
+func NewRedirectResponse(req *Request, targets []*ContactHeader) *Response {
+	return NewRedirectResponseWithStatus(req, 302, "Moved Temporarily", targets)
+}
+
+// Build a 3xx response to the given request, redirecting it to the given targets, which are added as
+// Contact headers in order. Targets may carry 'q' params to indicate their relative preference
+// (RFC 3261 s. 8.3). The Via, From, To, Call-Id and CSeq headers are copied from the request, and a tag is
+// added to the To header if it has none.
+func NewRedirectResponseWithStatus(req *Request, statusCode uint16, reason string, targets []*ContactHeader) *Response {
+	response := newResponseTo(req, statusCode, reason)
+	for _, target := range targets {
+		response.AddHeader(target)
+	}
+	contentLength := ContentLength(0)
+	response.AddHeader(&contentLength)
+
+	return response
+}
+
+// Build a 421 (Extension Required) response to the given request, listing the extensions the request must
+// support in a Require header (RFC 3261 s. 21.4.15). The Via, From, To, Call-Id and CSeq headers are copied
+// from the request, and a tag is added to the To header if it has none.
+func New421Response(req *Request, requiredOptions []string) *Response {
+	response := newResponseTo(req, 421, "Extension Required")
+	options := make([]string, len(requiredOptions))
+	copy(options, requiredOptions)
+	response.AddHeader(&RequireHeader{options})
+	contentLength := ContentLength(0)
+	response.AddHeader(&contentLength)
+
+	return response
+}
+
+// Prepare a request to be retried after it was rejected with the given 421 (Extension Required) response,
+// by adding each of the extensions listed in the response's Require headers to the request's Supported
+// header, creating it if need be. Extensions which are already listed aren't repeated.
+// The caller remains responsible for the rest of the retry, such as incrementing the CSeq.
+func SupportRequiredExtensions(retry *Request, extensionRequired *Response) {
+	var options []string
+	for _, header := range retry.Headers("Supported") {
+		if supported, ok := header.(*SupportedHeader); ok {
+			options = append(options, supported.Options...)
+		}
+	}
+
+	for _, header := range extensionRequired.Headers("Require") {
+		if require, ok := header.(*RequireHeader); ok {
+			for _, option := range require.Options {
+				if !hasOption(options, option) {
+					options = append(options, option)
+				}
+			}
+		}
+	}
+
+	retry.SetHeader("Supported", &SupportedHeader{options})
+}
+
+// Build a response to the given request, with the Via, From, To, Call-Id and CSeq headers copied from it,
+// and a tag added to the To header if it has none.
+func newResponseTo(req *Request, statusCode uint16, reason string) *Response {
+	response := NewResponse("SIP/2.0", statusCode, reason, []SipHeader{}, "")
+
+	CopyHeaders("Via", req, response)
+	CopyHeaders("From", req, response)
+	CopyHeaders("To", req, response)
+	CopyHeaders("Call-Id", req, response)
+	CopyHeaders("CSeq", req, response)
+
+	for _, header := range response.Headers("To") {
+		if to, ok := header.(*ToHeader); ok {
+			if to.Params == nil {
+				to.Params = Params{}
+			}
+			if _, ok := to.Params["tag"]; !ok {
+				tag := GenerateTag()
+				to.Params["tag"] = &tag
+			}
+		}
+	}
+
+	return response
+}
+
+// Mark the given provisional response as one to be sent reliably (RFC 3262 s. 3), by adding '100rel' to its
+// Require header and giving it the given RSeq, replacing any existing RSeq. The RSeq must be between 1 and
+// 2**31 - 1, and should be one more than that of the previous reliable provisional response in the dialog.
+// A 100 (Trying) response can't be sent reliably, nor can a final response.
+func MakeReliable(response *Response, rseq RSeq) error {
+	if response.StatusCode <= 100 || response.StatusCode >= 200 {
+		return fmt.Errorf("cannot send a %d response reliably", response.StatusCode)
+	}
+	if rseq == 0 || uint32(rseq) > 1<<31-1 {
+		return fmt.Errorf("RSeq %d is out of range", rseq)
+	}
+
+	requires := response.Headers("Require")
+	if len(requires) == 0 {
+		response.AddHeader(&RequireHeader{[]string{OPTION_100REL}})
+	} else if require, ok := requires[0].(*RequireHeader); ok && !Requires100rel(require) {
+		require.Options = append(require.Options, OPTION_100REL)
+	}
+	response.SetHeader("RSeq", &rseq)
+
+	return nil
+}
+
 func (response *Response) String() string {
-	var buffer bytes.Buffer
+	return string(response.appendBytes(make([]byte, 0, c_SERIALIZE_BUFFER_SIZE+len(response.Body))))
+}
 
+// Write the wire representation of the response to the given writer, without building an intermediate
+// string; this implements io.WriterTo. The number of bytes written is returned, along with any error from
+// the writer.
+func (response *Response) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(response.appendBytes(make([]byte, 0, c_SERIALIZE_BUFFER_SIZE+len(response.Body))))
+	return int64(n), err
+}
+
+// Append the wire representation of the response to the given buffer. The whole response is serialized
+// into the one buffer.
+func (response *Response) appendBytes(buf []byte) []byte {
 	// Every SIP response starts with a Status Line - RFC 2361 7.2.
-	buffer.WriteString(fmt.Sprintf("%s %d %s\r\n",
-		response.SipVersion,
-		response.StatusCode,
-		response.Reason))
+	buf = append(buf, response.SipVersion...)
+	buf = append(buf, ' ')
+	buf = strconv.AppendUint(buf, uint64(response.StatusCode), 10)
+	buf = append(buf, ' ')
+	buf = append(buf, response.Reason...)
+	buf = append(buf, "\r\n"...)
 
 	// Write the headers.
-	buffer.WriteString(response.headers.String())
+	buf = response.headers.appendString(buf)
+	buf = append(buf, response.headers.implicitContentLength(response.Body)...)
 
 	// If the request has a message body, add it.
-	buffer.WriteString("\r\n" + response.Body)
+	buf = append(buf, "\r\n"...)
+	buf = append(buf, response.Body...)
 
-	return buffer.String()
+	return buf
+}
+
+// Check that the response has exactly one each of the Call-Id, CSeq, From and To headers, at least one
+// Via header, and at most one of any other header which may not be repeated.
+// See Request.CheckCardinality.
+func (response *Response) CheckCardinality() error {
+	return response.headers.checkCardinality(singleInstanceHeaders)
 }
 
 func (response *Response) Short() string {
@@ -326,6 +1368,13 @@ func (response *Response) Short() string {
 	return buffer.String()
 }
 
+// Determine if the response, given in answer to a request with the given method, must be acknowledged with an
+// ACK. Only final (2xx-6xx) responses to INVITE are; the ACK for a non-2xx response is part of the INVITE
+// client transaction, while that for a 2xx is sent end-to-end by the UAC core (RFC 3261 s. 17.1.1.3, 13.2.2.4).
+func (response *Response) RequiresAck(method Method) bool {
+	return method == INVITE && response.StatusCode >= 200 && response.StatusCode < 700
+}
+
 func (response *Response) AllHeaders() []SipHeader {
 	allHeaders := make([]SipHeader, 0)
 	for _, key := range response.headers.headerOrder {
@@ -350,6 +1399,7 @@ func (response *Response) RemoveHeader(header SipHeader) error {
 	for idx, hdr := range headersOfSameType {
 		if hdr == header {
 			response.headers.headers[name] = append(headersOfSameType[:idx], headersOfSameType[idx+1:]...)
+			response.headers.removeRawValue(name, idx)
 			found = true
 			break
 		}
@@ -367,6 +1417,7 @@ func (response *Response) RemoveHeader(header SipHeader) error {
 		for idx, entry := range response.headers.headerOrder {
 			if entry == name {
 				response.headers.headerOrder = append(response.headers.headerOrder[:idx], response.headers.headerOrder[idx+1:]...)
+				break
 			}
 		}
 	}
@@ -381,3 +1432,18 @@ func (response *Response) GetBody() string {
 func (response *Response) SetBody(body string) {
 	response.Body = body
 }
+
+// Set the body of the response, along with a matching Content-Type header and Content-Length header.
+// Any existing Content-Type and Content-Length headers are replaced.
+func (response *Response) SetBodyWithType(body []byte, contentType *ContentType) {
+	contentLength := ContentLength(len(body))
+	response.Body = string(body)
+	response.replaceHeader(contentType)
+	response.replaceHeader(&contentLength)
+}
+
+// Set the body of the response to the given SDP, with a Content-Type of application/sdp.
+func (response *Response) SetSDP(sdp []byte) {
+	contentType := ContentType(SDP_CONTENT_TYPE)
+	response.SetBodyWithType(sdp, &contentType)
+}
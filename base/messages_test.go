@@ -0,0 +1,1057 @@
+package base
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSetSDP(t *testing.T) {
+	request := NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{}, "")
+	sdp := []byte("v=0\r\no=bob 2890844527 2890844527 IN IP4 biloxi.com\r\n")
+	request.SetSDP(sdp)
+
+	if request.GetBody() != string(sdp) {
+		t.Errorf("unexpected body: %q", request.GetBody())
+	}
+	if contentType := request.GetContentType(); contentType == nil || *contentType != SDP_CONTENT_TYPE {
+		t.Errorf("unexpected Content-Type: %v", contentType)
+	}
+	if contentLengths := request.Headers("Content-Length"); len(contentLengths) != 1 ||
+		*(contentLengths[0].(*ContentLength)) != ContentLength(len(sdp)) {
+		t.Errorf("unexpected Content-Length headers: %v", contentLengths)
+	}
+
+	// Replacing the body must replace, rather than duplicate, the Content-Type and Content-Length.
+	contentType := ContentType("text/plain")
+	request.SetBodyWithType([]byte("Hello!"), &contentType)
+	if len(request.Headers("Content-Type")) != 1 || *request.GetContentType() != "text/plain" {
+		t.Errorf("unexpected Content-Type headers: %v", request.Headers("Content-Type"))
+	}
+	if contentLengths := request.Headers("Content-Length"); len(contentLengths) != 1 ||
+		*(contentLengths[0].(*ContentLength)) != 6 {
+		t.Errorf("unexpected Content-Length headers: %v", contentLengths)
+	}
+}
+
+func TestCachedBytes(t *testing.T) {
+	request := NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{}, "")
+	cached := request.CachedBytes()
+	if string(cached) != request.String() {
+		t.Fatalf("cached bytes %q differ from serialized request %q", cached, request.String())
+	}
+
+	cseq := &CSeq{1, INVITE}
+	request.AddHeader(cseq)
+	if string(request.CachedBytes()) != request.String() {
+		t.Errorf("cache not invalidated by AddHeader: got %q", request.CachedBytes())
+	}
+
+	request.RemoveHeader(cseq)
+	if string(request.CachedBytes()) != request.String() {
+		t.Errorf("cache not invalidated by RemoveHeader: got %q", request.CachedBytes())
+	}
+
+	request.SetBody("Hello!")
+	if string(request.CachedBytes()) != request.String() {
+		t.Errorf("cache not invalidated by SetBody: got %q", request.CachedBytes())
+	}
+
+	request.SetSDP([]byte("v=0\r\n"))
+	if string(request.CachedBytes()) != request.String() {
+		t.Errorf("cache not invalidated by SetSDP: got %q", request.CachedBytes())
+	}
+
+	request.AddHeader(&ViaHeader{NewViaHop("UDP", "p1.example.com", nil), NewViaHop("UDP", "pc33.atlanta.com", nil)})
+	request.CachedBytes()
+	request.SetViaPolicy(VIA_COALESCED)
+	if string(request.CachedBytes()) != request.String() {
+		t.Errorf("cache not invalidated by SetViaPolicy: got %q", request.CachedBytes())
+	}
+
+	request.RemoveHeaders("Content-Length")
+	request.CachedBytes()
+	request.SetContentLengthPolicy(CONTENT_LENGTH_AS_GIVEN)
+	if string(request.CachedBytes()) != request.String() {
+		t.Errorf("cache not invalidated by SetContentLengthPolicy: got %q", request.CachedBytes())
+	}
+}
+
+func TestRawValues(t *testing.T) {
+	first := &ViaHeader{NewViaHop("UDP", "pc33.atlanta.com", nil)}
+	second := &ViaHeader{NewViaHop("UDP", "bigbox3.site3.atlanta.com", nil)}
+	maxForwards := MaxForwards(70)
+	request := NewParsedRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []ParsedHeader{
+		{first, "Via:  SIP/2.0/UDP pc33.atlanta.com"},
+		{second, "v: SIP/2.0/UDP bigbox3.site3.atlanta.com"},
+		{&maxForwards, ""},
+	}, "")
+	checkRaws := func(context string, name string, expected ...string) {
+		raws := request.RawValues(name)
+		if len(raws) != len(expected) {
+			t.Errorf("%s: expected raw values %q for %s, got %q", context, expected, name, raws)
+			return
+		}
+		for idx := range raws {
+			if raws[idx] != expected[idx] {
+				t.Errorf("%s: expected raw values %q for %s, got %q", context, expected, name, raws)
+				return
+			}
+		}
+	}
+	checkRaws("parsed", "Via", "Via:  SIP/2.0/UDP pc33.atlanta.com", "v: SIP/2.0/UDP bigbox3.site3.atlanta.com")
+	checkRaws("parsed", "Max-Forwards", "")
+	checkRaws("parsed", "Contact")
+
+	// Headers added since have no raw value, and those of the others keep their places.
+	third := &ViaHeader{NewViaHop("TCP", "proxy.biloxi.com", nil)}
+	request.PrependHeader(third)
+	request.AddHeader(ViaHeader{NewViaHop("UDP", "client.biloxi.com", nil)})
+	checkRaws("added", "Via", "", "Via:  SIP/2.0/UDP pc33.atlanta.com", "v: SIP/2.0/UDP bigbox3.site3.atlanta.com", "")
+
+	// Removing a header removes its raw value.
+	if err := request.RemoveHeader(first); err != nil {
+		t.Fatalf("unexpected error removing header: %s", err.Error())
+	}
+	checkRaws("removed", "Via", "", "v: SIP/2.0/UDP bigbox3.site3.atlanta.com", "")
+	request.SetHeader("via", second)
+	checkRaws("set", "Via", "")
+	request.PrependHeader(third)
+	checkRaws("set", "Via", "", "")
+
+	if copied := request.Copy(); len(copied.rawValues) != 0 {
+		t.Errorf("expected no raw values on a copy of the request, got %v", copied.rawValues)
+	}
+}
+
+func TestEnsureMaxForwards(t *testing.T) {
+	request := NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{}, "")
+	request.EnsureMaxForwards()
+	if maxForwards := request.Headers("Max-Forwards"); len(maxForwards) != 1 || *(maxForwards[0].(*MaxForwards)) != 70 {
+		t.Errorf("unexpected Max-Forwards headers %v", maxForwards)
+	}
+
+	// An existing Max-Forwards must be left alone.
+	existing := MaxForwards(5)
+	request = NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{&existing}, "")
+	request.EnsureMaxForwards()
+	if maxForwards := request.Headers("Max-Forwards"); len(maxForwards) != 1 || *(maxForwards[0].(*MaxForwards)) != 5 {
+		t.Errorf("unexpected Max-Forwards headers %v", maxForwards)
+	}
+}
+
+func TestHasViaMatching(t *testing.T) {
+	port := uint16(5070)
+	defaultPort := uint16(5060)
+	request := NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{
+		&ViaHeader{&ViaHop{"SIP", "2.0", "UDP", "proxy1.example.com", &port, Params{}}},
+		&ViaHeader{
+			&ViaHop{"SIP", "2.0", "UDP", "proxy2.example.com", nil, Params{}},
+			&ViaHop{"SIP", "2.0", "TCP", "pc33.atlanta.com", nil, Params{}},
+		},
+	}, "")
+
+	if !request.HasViaMatching("proxy1.example.com", &port) {
+		t.Errorf("expected a match on the first Via header")
+	}
+	if !request.HasViaMatching("PC33.atlanta.com", nil) {
+		t.Errorf("expected a match on the last hop of the second Via header")
+	}
+	if !request.HasViaMatching("proxy2.example.com", &defaultPort) {
+		t.Errorf("expected an absent port to match the default port")
+	}
+	if request.HasViaMatching("proxy1.example.com", nil) {
+		t.Errorf("unexpected match with the wrong port")
+	}
+	if request.HasViaMatching("proxy3.example.com", nil) {
+		t.Errorf("unexpected match with the wrong host")
+	}
+}
+
+func TestSetHeader(t *testing.T) {
+	callId := CallId("abc")
+	maxForwards := MaxForwards(70)
+	request := NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{
+		&RouteHeader{[]Uri{&SipUri{Host: "p1.example.com"}}},
+		&callId,
+		&RouteHeader{[]Uri{&SipUri{Host: "p2.example.com"}}},
+		&maxForwards,
+	}, "")
+	request.CachedBytes()
+
+	request.SetHeader("route", &RouteHeader{[]Uri{&SipUri{Host: "p3.example.com"}}})
+	expected := "INVITE sip:bob@biloxi.com SIP/2.0\r\n" +
+		"Route: <sip:p3.example.com>\r\n" +
+		"Call-Id: abc\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	if request.String() != expected || string(request.CachedBytes()) != expected {
+		t.Errorf("unexpected request after SetHeader: %q", request.String())
+	}
+
+	request.RemoveHeaders("CALL-ID")
+	request.SetHeader("Contact", &ContactHeader{Address: &SipUri{User: &bob, Host: "pc33.biloxi.com"}, Params: Params{}})
+	expected = "INVITE sip:bob@biloxi.com SIP/2.0\r\n" +
+		"Route: <sip:p3.example.com>\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"Contact: <sip:bob@pc33.biloxi.com>\r\n" +
+		"Content-Length: 0\r\n\r\n"
+	if request.String() != expected {
+		t.Errorf("unexpected request after RemoveHeaders: %q", request.String())
+	}
+
+	// Removing the only header of a type and adding it back must not duplicate it.
+	request.RemoveHeader(&maxForwards)
+	request.AddHeader(&maxForwards)
+	if strings.Count(request.String(), "Max-Forwards") != 1 {
+		t.Errorf("unexpected request after re-adding Max-Forwards: %q", request.String())
+	}
+}
+
+func TestAdjustRegisterForMinExpires(t *testing.T) {
+	short := "30"
+	long := "7200"
+	expires := Expires(20)
+	brief := &ContactHeader{Address: &SipUri{User: &bob, Host: "pc33.biloxi.com"}, Params: Params{"expires": &short}}
+	lengthy := &ContactHeader{Address: &SipUri{User: &bob, Host: "pc34.biloxi.com"}, Params: Params{"expires": &long}}
+	plain := &ContactHeader{Address: &SipUri{User: &bob, Host: "pc35.biloxi.com"}, Params: Params{}}
+	register := NewRequest(REGISTER, &SipUri{Host: "biloxi.com"}, "SIP/2.0", []SipHeader{brief, lengthy, plain, &expires}, "")
+
+	AdjustRegisterForMinExpires(register, MinExpires(3600))
+	if EffectiveExpiry(brief, register.Headers("Expires")[0].(*Expires), 0) != 3600 {
+		t.Errorf("expected the short Contact expires param to be raised, got %s", brief)
+	}
+	if EffectiveExpiry(lengthy, register.Headers("Expires")[0].(*Expires), 0) != 7200 {
+		t.Errorf("expected the long Contact expires param to be unchanged, got %s", lengthy)
+	}
+	if EffectiveExpiry(plain, register.Headers("Expires")[0].(*Expires), 0) != 3600 {
+		t.Errorf("expected the Expires header to be raised, got %v", register.Headers("Expires"))
+	}
+
+	// A REGISTER without an Expires header gets one.
+	register = NewRequest(REGISTER, &SipUri{Host: "biloxi.com"}, "SIP/2.0", []SipHeader{plain}, "")
+	AdjustRegisterForMinExpires(register, MinExpires(600))
+	if expires := register.Headers("Expires"); len(expires) != 1 || *(expires[0].(*Expires)) != 600 {
+		t.Errorf("expected an Expires header of 600 to be added, got %v", expires)
+	}
+}
+
+func TestNewRedirectResponse(t *testing.T) {
+	callId := CallId("a84b4c76e66710")
+	fromTag := "1928301774"
+	request := NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{
+		&ViaHeader{NewViaHop("UDP", "pc33.atlanta.com", nil)},
+		&ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{}},
+		&FromHeader{Address: &SipUri{Host: "atlanta.com"}, Params: Params{"tag": &fromTag}},
+		&callId,
+		&CSeq{314159, INVITE},
+	}, "")
+
+	q1 := "1.0"
+	q2 := "0.5"
+	targets := []*ContactHeader{
+		&ContactHeader{Address: &SipUri{User: &bob, Host: "pc33.biloxi.com"}, Params: Params{"q": &q1}},
+		&ContactHeader{Address: &SipUri{User: &bob, Host: "voicemail.biloxi.com"}, Params: Params{"q": &q2}},
+	}
+	response := NewRedirectResponse(request, targets)
+
+	if response.StatusCode != 302 {
+		t.Errorf("unexpected status code %d", response.StatusCode)
+	}
+	contacts := response.Headers("Contact")
+	if len(contacts) != 2 || contacts[0].String() != "Contact: <sip:bob@pc33.biloxi.com>;q=1.0" ||
+		contacts[1].String() != "Contact: <sip:bob@voicemail.biloxi.com>;q=0.5" {
+		t.Errorf("unexpected Contact headers %v", contacts)
+	}
+	for _, name := range []string{"Via", "From", "Call-Id", "CSeq"} {
+		if len(response.Headers(name)) != 1 || response.Headers(name)[0].String() != request.Headers(name)[0].String() {
+			t.Errorf("expected %s header to be copied from the request", name)
+		}
+	}
+	if to := response.Headers("To")[0].(*ToHeader); to.Params["tag"] == nil {
+		t.Errorf("expected a To tag to be added, got %s", to)
+	}
+	if request.Headers("To")[0].(*ToHeader).Params["tag"] != nil {
+		t.Errorf("expected the request To header to be unchanged")
+	}
+
+	if response := NewRedirectResponseWithStatus(request, 301, "Moved Permanently", targets[:1]); response.StatusCode != 301 ||
+		len(response.Headers("Contact")) != 1 {
+		t.Errorf("unexpected 301 response %s", response.String())
+	}
+}
+
+func TestCheckCardinality(t *testing.T) {
+	newInvite := func() *Request {
+		callId := CallId("a84b4c76e66710")
+		maxForwards := MaxForwards(70)
+		return NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{
+			&ViaHeader{NewViaHop("UDP", "pc33.atlanta.com", nil)},
+			&maxForwards,
+			&ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{}},
+			&FromHeader{Address: &SipUri{Host: "atlanta.com"}, Params: Params{}},
+			&callId,
+			&CSeq{314159, INVITE},
+		}, "")
+	}
+
+	request := newInvite()
+	if err := request.CheckCardinality(); err != nil {
+		t.Errorf("unexpected error checking valid request: %s", err.Error())
+	}
+
+	request.AddHeader(&CSeq{314160, INVITE})
+	if err := request.CheckCardinality(); err == nil || !strings.Contains(err.Error(), "CSeq") {
+		t.Errorf("expected duplicate CSeq to be flagged, got %v", err)
+	}
+
+	request = newInvite()
+	request.AddHeader(&ToHeader{Address: &SipUri{User: &bob, Host: "evil.com"}, Params: Params{}})
+	if err := request.CheckCardinality(); err == nil || !strings.Contains(err.Error(), "To") {
+		t.Errorf("expected duplicate To to be flagged, got %v", err)
+	}
+
+	request = newInvite()
+	request.RemoveHeaders("Max-Forwards")
+	if err := request.CheckCardinality(); err == nil || !strings.Contains(err.Error(), "Max-Forwards") {
+		t.Errorf("expected missing Max-Forwards to be flagged, got %v", err)
+	}
+
+	request = newInvite()
+	request.RemoveHeaders("Via")
+	if err := request.CheckCardinality(); err == nil || !strings.Contains(err.Error(), "Via") {
+		t.Errorf("expected missing Via to be flagged, got %v", err)
+	}
+
+	request = newInvite()
+	first, second := ContentLength(0), ContentLength(10)
+	request.AddHeader(&first)
+	request.AddHeader(&second)
+	if err := request.CheckCardinality(); err == nil || !strings.Contains(err.Error(), "Content-Length") {
+		t.Errorf("expected duplicate Content-Length to be flagged, got %v", err)
+	}
+
+	response := NewResponse("SIP/2.0", 200, "OK", []SipHeader{}, "")
+	for _, name := range []string{"Via", "To", "From", "Call-Id", "CSeq"} {
+		CopyHeaders(name, newInvite(), response)
+	}
+	if err := response.CheckCardinality(); err != nil {
+		t.Errorf("unexpected error checking valid response: %s", err.Error())
+	}
+	response.AddHeader(&CSeq{314160, INVITE})
+	if err := response.CheckCardinality(); err == nil || !strings.Contains(err.Error(), "CSeq") {
+		t.Errorf("expected duplicate CSeq in response to be flagged, got %v", err)
+	}
+}
+
+func TestPrependHeader(t *testing.T) {
+	callId := CallId("a84b4c76e66710")
+	request := NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{
+		&callId,
+		&CSeq{314159, INVITE},
+	}, "")
+
+	request.PrependHeader(&RouteHeader{Addresses: []Uri{&SipUri{Host: "p1.example.com"}}})
+	request.PrependHeader(&ViaHeader{NewViaHop("UDP", "proxy.example.com", nil)})
+	request.PrependHeader(&RouteHeader{Addresses: []Uri{&SipUri{Host: "p0.example.com"}}})
+	request.PrependHeader(&ViaHeader{NewViaHop("UDP", "edge.example.com", nil)})
+	maxForwards := MaxForwards(70)
+	request.PrependHeader(&maxForwards)
+
+	var names []string
+	for _, header := range request.AllHeaders() {
+		names = append(names, header.Name())
+	}
+	if strings.Join(names, ",") != "Via,Via,Route,Route,Call-Id,CSeq,Max-Forwards" {
+		t.Errorf("unexpected header order %v", names)
+	}
+	if hop := (*request.Headers("Via")[0].(*ViaHeader))[0]; hop.Host != "edge.example.com" {
+		t.Errorf("expected the most recently prepended Via first, got %s", hop.Host)
+	}
+	if route := request.Headers("Route")[0].String(); route != "Route: <sip:p0.example.com>" {
+		t.Errorf("expected the most recently prepended Route first, got %s", route)
+	}
+}
+
+func TestMakeReliable(t *testing.T) {
+	if Supports100rel(nil) || !Supports100rel(&SupportedHeader{[]string{"timer", "100REL"}}) ||
+		Supports100rel(&SupportedHeader{[]string{"timer"}}) {
+		t.Errorf("unexpected result from Supports100rel")
+	}
+	if Requires100rel(nil) || !Requires100rel(&RequireHeader{[]string{"100rel"}}) ||
+		Requires100rel(&RequireHeader{[]string{}}) {
+		t.Errorf("unexpected result from Requires100rel")
+	}
+
+	response := NewResponse("SIP/2.0", 183, "Session Progress", []SipHeader{}, "")
+	if err := MakeReliable(response, 1); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if err := MakeReliable(response, 2); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	requires, rseqs := response.Headers("Require"), response.Headers("RSeq")
+	if len(requires) != 1 || requires[0].String() != "Require: 100rel" {
+		t.Errorf("unexpected Require headers %v", requires)
+	}
+	if len(rseqs) != 1 || rseqs[0].String() != "RSeq: 2" {
+		t.Errorf("unexpected RSeq headers %v", rseqs)
+	}
+
+	response = NewResponse("SIP/2.0", 180, "Ringing", []SipHeader{&RequireHeader{[]string{"timer"}}}, "")
+	if err := MakeReliable(response, 1); err != nil || response.Headers("Require")[0].String() != "Require: timer, 100rel" {
+		t.Errorf("unexpected result marking response with existing Require reliable: %v, %v", response.Headers("Require"), err)
+	}
+
+	for _, statusCode := range []uint16{100, 200, 486} {
+		if err := MakeReliable(NewResponse("SIP/2.0", statusCode, "", []SipHeader{}, ""), 1); err == nil {
+			t.Errorf("unexpected success marking %d response reliable", statusCode)
+		}
+	}
+	if err := MakeReliable(NewResponse("SIP/2.0", 180, "Ringing", []SipHeader{}, ""), 0); err == nil {
+		t.Errorf("unexpected success using RSeq 0")
+	}
+}
+
+func TestExtensionRequired(t *testing.T) {
+	callId := CallId("a84b4c76e66710")
+	request := NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{
+		&ViaHeader{NewViaHop("UDP", "pc33.atlanta.com", nil)},
+		&ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{}},
+		&FromHeader{Address: &SipUri{Host: "atlanta.com"}, Params: Params{}},
+		&callId,
+		&CSeq{314159, INVITE},
+		&SupportedHeader{[]string{"timer"}},
+	}, "")
+
+	response := New421Response(request, []string{"100rel", "timer"})
+	if response.StatusCode != 421 || response.Reason != "Extension Required" {
+		t.Errorf("unexpected status line %d %s", response.StatusCode, response.Reason)
+	}
+	if requires := response.Headers("Require"); len(requires) != 1 || requires[0].String() != "Require: 100rel, timer" {
+		t.Errorf("unexpected Require headers %v", requires)
+	}
+	if err := response.CheckCardinality(); err != nil {
+		t.Errorf("unexpected error checking 421 response: %s", err.Error())
+	}
+	if to := response.Headers("To")[0].(*ToHeader); to.Params["tag"] == nil {
+		t.Errorf("expected a To tag to be added, got %s", to)
+	}
+
+	SupportRequiredExtensions(request, response)
+	if supported := request.Headers("Supported"); len(supported) != 1 || supported[0].String() != "Supported: timer, 100rel" {
+		t.Errorf("unexpected Supported headers on retry %v", supported)
+	}
+
+	request.RemoveHeaders("Supported")
+	SupportRequiredExtensions(request, response)
+	if supported := request.Headers("Supported"); len(supported) != 1 || supported[0].String() != "Supported: 100rel, timer" {
+		t.Errorf("unexpected Supported headers on retry without Supported %v", supported)
+	}
+}
+
+func TestMethodCategories(t *testing.T) {
+	tests := []struct {
+		method        Method
+		dialog        bool
+		targetRefresh bool
+		body          bool
+	}{
+		{INVITE, true, true, true},
+		{ACK, false, false, true},
+		{CANCEL, false, false, false},
+		{BYE, false, false, true},
+		{REGISTER, false, false, true},
+		{OPTIONS, false, false, true},
+		{SUBSCRIBE, true, true, true},
+		{NOTIFY, false, true, true},
+		{REFER, true, false, true},
+		{INFO, false, false, true},
+		{MESSAGE, false, false, true},
+		{PRACK, false, false, true},
+		{PUBLISH, false, false, true},
+		{UPDATE, false, true, true},
+		{Method("invite"), true, true, true},
+		{Method("cancel"), false, false, false},
+		{Method("FOO"), false, false, true},
+	}
+
+	for _, test := range tests {
+		if test.method.IsDialogCreating() != test.dialog {
+			t.Errorf("unexpected IsDialogCreating() for %s", test.method)
+		}
+		if test.method.IsTargetRefresh() != test.targetRefresh {
+			t.Errorf("unexpected IsTargetRefresh() for %s", test.method)
+		}
+		if test.method.CanHaveBody() != test.body {
+			t.Errorf("unexpected CanHaveBody() for %s", test.method)
+		}
+	}
+
+	if INVITE.String() != "INVITE" {
+		t.Errorf("unexpected String() %q", INVITE.String())
+	}
+}
+
+func TestViaChain(t *testing.T) {
+	hop1 := NewViaHop("UDP", "p2.example.com", nil)
+	hop2 := NewViaHop("TCP", "p1.example.com", nil)
+	hop3 := NewViaHop("UDP", "pc33.atlanta.com", nil)
+	callId := CallId("a84b4c76e66710")
+	request := NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{
+		&ViaHeader{hop1, hop2},
+		&callId,
+		ViaHeader{hop3},
+	}, "")
+
+	chain := request.ViaChain()
+	if len(chain) != 3 || chain[0] != hop1 || chain[1] != hop2 || chain[2] != hop3 {
+		t.Errorf("unexpected Via chain %s", chain.String())
+	}
+	if flat := (ViaHeader{hop1, hop2}).Flatten(); len(flat) != 2 || flat[0] != hop1 || flat[1] != hop2 {
+		t.Errorf("unexpected flattened Via %s", flat.String())
+	}
+
+	lines := chain.Split()
+	if len(lines) != 3 || lines[0].String() != "Via: SIP/2.0/UDP p2.example.com" ||
+		lines[2].String() != "Via: SIP/2.0/UDP pc33.atlanta.com" {
+		t.Errorf("unexpected split Via lines %v", lines)
+	}
+
+	request.SetViaChain(ViaHeader{NewViaHop("UDP", "proxy.example.com", nil), hop1, hop2, hop3})
+	if vias := request.Headers("Via"); len(vias) != 1 || len(request.ViaChain()) != 4 {
+		t.Errorf("unexpected Via headers after setting the chain: %v", vias)
+	} else if _, ok := vias[0].(*ViaHeader); !ok {
+		t.Errorf("expected the chain to be stored as a *ViaHeader, got %T", vias[0])
+	}
+	if !strings.HasPrefix(request.String(), "INVITE sip:bob@biloxi.com SIP/2.0\r\nVia: SIP/2.0/UDP proxy.example.com\r\n"+
+		"Via: SIP/2.0/UDP p2.example.com\r\nVia: SIP/2.0/TCP p1.example.com\r\nVia: SIP/2.0/UDP pc33.atlanta.com\r\nCall-Id:") {
+		t.Errorf("unexpected request after setting the Via chain: %q", request.String())
+	}
+
+	request.SetViaChain(ViaHeader{})
+	if len(request.Headers("Via")) != 0 || len(request.ViaChain()) != 0 {
+		t.Errorf("expected an empty chain to remove the Via headers")
+	}
+}
+
+func TestFixupTopViaForReceipt(t *testing.T) {
+	tests := []struct {
+		sentBy   string
+		rport    bool
+		srcIP    string
+		expected string
+	}{
+		{"192.0.2.1", false, "192.0.2.1", "SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK776asdhds"},
+		{"192.0.2.1", false, "192.0.2.4", "SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK776asdhds;received=192.0.2.4"},
+		{"pc33.atlanta.com", false, "192.0.2.4", "SIP/2.0/UDP pc33.atlanta.com;branch=z9hG4bK776asdhds;received=192.0.2.4"},
+		{"[2001:DB8::1]", false, "2001:db8::1", "SIP/2.0/UDP [2001:DB8::1];branch=z9hG4bK776asdhds"},
+		{"[2001:DB8::1]", false, "[2001:db8::2]", "SIP/2.0/UDP [2001:DB8::1];branch=z9hG4bK776asdhds;received=2001:db8::2"},
+		{"192.0.2.1", true, "192.0.2.1", "SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK776asdhds;received=192.0.2.1;rport=9988"},
+		{"192.0.2.1", true, "192.0.2.4", "SIP/2.0/UDP 192.0.2.1;branch=z9hG4bK776asdhds;received=192.0.2.4;rport=9988"},
+	}
+
+	for _, test := range tests {
+		branch := "z9hG4bK776asdhds"
+		hop := NewViaHop("UDP", test.sentBy, nil)
+		hop.Params["branch"] = &branch
+		if test.rport {
+			hop.Params["rport"] = nil
+		}
+		proxyHop := NewViaHop("UDP", "proxy.example.com", nil)
+		request := NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0",
+			[]SipHeader{&ViaHeader{hop}, &ViaHeader{proxyHop}}, "")
+
+		request.FixupTopViaForReceipt(test.srcIP, 9988)
+		// Params are serialized in map order, so compare the canonical ordering.
+		result := hop.ProtocolName + "/" + hop.ProtocolVersion + "/" + hop.Transport + " " + hop.Host
+		for _, param := range OrderedParams(hop.Params) {
+			result += ";" + param.Key
+			if param.Value != nil {
+				result += "=" + *param.Value
+			}
+		}
+		if result != test.expected {
+			t.Errorf("expected top Via %q for source %s, got %q", test.expected, test.srcIP, result)
+		}
+		if len(proxyHop.Params) != 0 {
+			t.Errorf("expected only the top Via hop to be changed, got %s", proxyHop.String())
+		}
+	}
+
+	// An IPv6 source address is written bare, not as a quoted string.
+	hop := NewViaHop("UDP", "pc33.atlanta.com", nil)
+	request := NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{&ViaHeader{hop}}, "")
+	request.FixupTopViaForReceipt("[2001:db8::2]", 5060)
+	if hop.String() != "SIP/2.0/UDP pc33.atlanta.com;received=2001:db8::2" {
+		t.Errorf("unexpected top Via %s for an IPv6 source", hop.String())
+	}
+
+	request = NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{}, "")
+	request.FixupTopViaForReceipt("192.0.2.4", 5060)
+	if len(request.Headers("Via")) != 0 {
+		t.Errorf("expected a request with no Via to be unchanged")
+	}
+}
+
+func TestIsReInvite(t *testing.T) {
+	tag, empty := "a6c85cf", ""
+	tests := []struct {
+		method   Method
+		to       *ToHeader
+		inDialog bool
+		reInvite bool
+	}{
+		{INVITE, &ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{}}, false, false},
+		{INVITE, &ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{"tag": &tag}}, true, true},
+		{INVITE, &ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{"tag": &empty}}, false, false},
+		{INVITE, &ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{"tag": nil}}, false, false},
+		{BYE, &ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{"tag": &tag}}, true, false},
+		{OPTIONS, &ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{}}, false, false},
+		{INVITE, nil, false, false},
+	}
+
+	for _, test := range tests {
+		headers := []SipHeader{}
+		if test.to != nil {
+			headers = append(headers, test.to)
+		}
+		request := NewRequest(test.method, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", headers, "")
+		if request.IsInDialog() != test.inDialog || request.IsReInvite() != test.reInvite {
+			t.Errorf("%s with %v: expected IsInDialog %v and IsReInvite %v", test.method, test.to,
+				test.inDialog, test.reInvite)
+		}
+	}
+}
+
+func TestContentLengthPolicy(t *testing.T) {
+	callId := CallId("abc")
+	request := NewRequest(OPTIONS, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{&callId}, "")
+	if request.String() != "OPTIONS sip:bob@biloxi.com SIP/2.0\r\nCall-Id: abc\r\nContent-Length: 0\r\n\r\n" {
+		t.Errorf("expected Content-Length: 0 on a request with an empty body, got %q", request.String())
+	}
+	if err := request.CheckContentLength(TCP); err != nil {
+		t.Errorf("unexpected error checking a request which will be given a Content-Length: %s", err.Error())
+	}
+
+	response := NewResponse("SIP/2.0", 200, "OK", []SipHeader{&callId}, "v=0\r\n")
+	if response.String() != "SIP/2.0 200 OK\r\nCall-Id: abc\r\nContent-Length: 5\r\n\r\nv=0\r\n" {
+		t.Errorf("expected the body length on a response with no Content-Length, got %q", response.String())
+	}
+
+	// An explicit header is never duplicated.
+	contentType := ContentType("text/plain")
+	request.SetBodyWithType([]byte("hello"), &contentType)
+	if strings.Count(request.String(), "Content-Length") != 1 {
+		t.Errorf("unexpected Content-Length headers in %q", request.String())
+	}
+
+	request.RemoveHeaders("Content-Length")
+	request.SetContentLengthPolicy(CONTENT_LENGTH_AS_GIVEN)
+	if strings.Contains(request.String(), "Content-Length") {
+		t.Errorf("expected no Content-Length with CONTENT_LENGTH_AS_GIVEN, got %q", request.String())
+	}
+	if err := request.CheckContentLength(UDP); err != nil {
+		t.Errorf("unexpected error checking a request for UDP: %s", err.Error())
+	}
+	for _, transport := range []Transport{TCP, TLS} {
+		if err := request.CheckContentLength(transport); err == nil {
+			t.Errorf("expected an error checking a request with no Content-Length for %s", transport)
+		}
+	}
+}
+
+func TestFork(t *testing.T) {
+	alice, branch, tag := "alice", "z9hG4bK776asdhds", "1928301774"
+	clientHop := NewViaHop("UDP", "pc33.atlanta.com", nil)
+	clientHop.Params["branch"] = &branch
+	callId := CallId("a84b4c76e66710")
+	request := NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{
+		&ViaHeader{clientHop},
+		&ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{}},
+		&FromHeader{Address: &SipUri{User: &alice, Host: "atlanta.com"}, Params: Params{"tag": &tag}},
+		&callId,
+	}, "v=0\r\n")
+	original := request.String()
+
+	proxyHop := NewViaHop("UDP", "proxy.biloxi.com", nil)
+	targets := []Uri{
+		&SipUri{User: &bob, Host: "192.0.2.4"},
+		&SipUri{User: &bob, Host: "192.0.2.5"},
+	}
+	forks := request.Fork(targets, proxyHop)
+	if len(forks) != 2 {
+		t.Fatalf("expected 2 forks, got %d", len(forks))
+	}
+
+	branches := map[string]bool{}
+	for idx, fork := range forks {
+		if !fork.GetRequestURI().Equals(targets[idx]) {
+			t.Errorf("fork %d: expected Request-URI %s, got %s", idx, targets[idx].String(), fork.GetRequestURI().String())
+		}
+		chain := fork.ViaChain()
+		if len(chain) != 2 || chain[0].Host != "proxy.biloxi.com" || chain[1].Host != "pc33.atlanta.com" {
+			t.Errorf("fork %d: unexpected Via chain %s", idx, chain.String())
+			continue
+		}
+		forkBranch, ok := chain[0].Params["branch"]
+		if !ok || forkBranch == nil || !strings.HasPrefix(*forkBranch, RFC3261_BRANCH_MAGIC_COOKIE) {
+			t.Errorf("fork %d: expected a generated branch on the top Via, got %s", idx, chain[0].String())
+			continue
+		}
+		branches[*forkBranch] = true
+		if fork.Body != request.Body {
+			t.Errorf("fork %d: expected the body to be copied", idx)
+		}
+	}
+	if len(branches) != 2 {
+		t.Errorf("expected each fork to have a unique branch")
+	}
+	if len(proxyHop.Params) != 0 {
+		t.Errorf("expected the given Via hop to be left unchanged, got %s", proxyHop.String())
+	}
+
+	// Mutating one fork must affect neither the original nor the other fork.
+	other := forks[1].String()
+	toTag := "a6c85cf"
+	forks[0].Headers("To")[0].(*ToHeader).Params["tag"] = &toTag
+	forks[0].Headers("From")[0].(*FromHeader).Address.(*SipUri).Host = "evil.example.com"
+	*forks[0].ViaChain()[1].Params["branch"] = "z9hG4bKchanged"
+	forks[0].GetRequestURI().(*SipUri).Host = "elsewhere.example.com"
+	if request.String() != original {
+		t.Errorf("expected the original request to be unchanged, got %q", request.String())
+	}
+	if forks[1].String() != other {
+		t.Errorf("expected the other fork to be unchanged, got %q", forks[1].String())
+	}
+}
+
+func TestRequestCopy(t *testing.T) {
+	callId := CallId("a84b4c76e66710")
+	maxForwards := MaxForwards(70)
+	expires := Expires(3600)
+	minExpires := MinExpires(60)
+	rseq := RSeq(1)
+	contentLength := ContentLength(5)
+	contentType := ContentType("application/sdp")
+	request := NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{
+		&ViaHeader{NewViaHop("UDP", "pc33.atlanta.com", nil)},
+		&ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{}},
+		&callId,
+		&CSeq{1, INVITE},
+		&maxForwards,
+		&expires,
+		&minExpires,
+		&rseq,
+		&contentType,
+		&contentLength,
+	}, "v=0\r\n")
+
+	// Every copied header must have the same dynamic type as the original, so that code which asserts
+	// e.g. *ViaHeader works on copies too.
+	headers, copied := request.AllHeaders(), request.Copy().AllHeaders()
+	if len(copied) != len(headers) {
+		t.Fatalf("expected %d headers in the copy, got %d", len(headers), len(copied))
+	}
+	for idx, header := range headers {
+		if fmt.Sprintf("%T", copied[idx]) != fmt.Sprintf("%T", header) {
+			t.Errorf("expected the copied %s header to be a %T, got %T", header.Name(), header, copied[idx])
+		}
+		if copied[idx] == header {
+			t.Errorf("expected the %s header to be copied, not shared", header.Name())
+		}
+	}
+}
+
+func TestMergedRequests(t *testing.T) {
+	alice, tag := "alice", "1928301774"
+	newRequest := func(branch string, host string, cseq uint32) *Request {
+		hop := NewViaHop("UDP", host, nil)
+		hop.Params["branch"] = &branch
+		callId := CallId("a84b4c76e66710")
+		return NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{
+			&ViaHeader{hop},
+			&FromHeader{Address: &SipUri{User: &alice, Host: "atlanta.com"}, Params: Params{"tag": &tag}},
+			&ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{}},
+			&callId,
+			&CSeq{cseq, INVITE},
+		}, "")
+	}
+
+	original := newRequest("z9hG4bK74bf9", "p1.example.com", 1)
+	key, err := original.MergeKey()
+	if err != nil {
+		t.Fatalf("unexpected error getting the merge key of %s: %s", original.Short(), err.Error())
+	}
+	if key != (MergeKey{tag, CallId("a84b4c76e66710"), CSeq{1, INVITE}}) {
+		t.Errorf("unexpected merge key %v", key)
+	}
+
+	tests := []struct {
+		description string
+		request     *Request
+		merged      bool
+	}{
+		{"a retransmission", newRequest("z9hG4bK74bf9", "p1.example.com", 1), false},
+		{"a copy via another branch of the fork", newRequest("z9hG4bK8a2c1", "p2.example.com", 1), true},
+		{"a copy with the same branch from another proxy", newRequest("z9hG4bK74bf9", "p2.example.com", 1), true},
+		{"a new request in the same dialog", newRequest("z9hG4bK8a2c1", "p1.example.com", 2), false},
+	}
+	for _, test := range tests {
+		if IsMergedRequest(test.request, original) != test.merged {
+			t.Errorf("expected IsMergedRequest to be %v for %s", test.merged, test.description)
+		}
+	}
+
+	// Merge detection only applies outside a dialog, so an in-dialog request is never merged, even if its top Via
+	// has changed.
+	inDialog := newRequest("z9hG4bK8a2c1", "p2.example.com", 1)
+	toTag := "a6c85cf"
+	inDialog.Headers("To")[0].(*ToHeader).Params["tag"] = &toTag
+	if IsMergedRequest(inDialog, original) {
+		t.Errorf("expected an in-dialog request not to be a merged request")
+	}
+
+	untagged := newRequest("z9hG4bK8a2c1", "p2.example.com", 1)
+	untagged.Headers("From")[0].(*FromHeader).Params = Params{}
+	if _, err := untagged.MergeKey(); err == nil {
+		t.Errorf("expected an error getting the merge key of a request with no From tag")
+	}
+	if IsMergedRequest(untagged, original) {
+		t.Errorf("expected a request with no From tag not to be treated as merged")
+	}
+}
+
+func TestEstimatedSize(t *testing.T) {
+	alice, branch, tag := "alice", "z9hG4bK776asdhds", "1928301774"
+	hop := NewViaHop("UDP", "pc33.atlanta.com", nil)
+	hop.Params["branch"] = &branch
+	proxyHop := NewViaHop("TCP", "p1.example.com", nil)
+	callId := CallId("a84b4c76e66710")
+	contentType := ContentType("application/sdp")
+	contentLength := ContentLength(5)
+
+	newRequest := func(body string, headers ...SipHeader) *Request {
+		return NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", append([]SipHeader{
+			&ViaHeader{proxyHop, hop},
+			&ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{}},
+			&FromHeader{DisplayName: &alice, Address: &SipUri{User: &alice, Host: "atlanta.com"},
+				Params: Params{"tag": &tag}},
+			&callId,
+			&CSeq{314159, INVITE},
+		}, headers...), body)
+	}
+
+	coalesced := newRequest("")
+	coalesced.SetViaPolicy(VIA_COALESCED)
+	asGiven := newRequest("v=0\r\n", &contentType)
+	asGiven.SetContentLengthPolicy(CONTENT_LENGTH_AS_GIVEN)
+	requests := []*Request{
+		NewRequest(OPTIONS, &SipUri{Host: "biloxi.com"}, "SIP/2.0", nil, ""),
+		newRequest(""),
+		newRequest("v=0\r\n", &contentType),
+		newRequest("v=0\r\n", &contentType, &contentLength),
+		coalesced,
+		asGiven,
+	}
+	for idx, request := range requests {
+		if request.EstimatedSize() != len(request.String()) {
+			t.Errorf("request %d: estimated %d bytes, but %q has %d", idx, request.EstimatedSize(),
+				request.String(), len(request.String()))
+		}
+		if request.EstimatedSize() != len(request.CachedBytes()) {
+			t.Errorf("request %d: estimated %d bytes, but the cached bytes have %d", idx, request.EstimatedSize(),
+				len(request.CachedBytes()))
+		}
+	}
+}
+
+func TestRequiresAck(t *testing.T) {
+	tests := []struct {
+		statusCode uint16
+		method     Method
+		expected   bool
+	}{
+		{100, INVITE, false},
+		{180, INVITE, false},
+		{183, INVITE, false},
+		{200, INVITE, true},
+		{302, INVITE, true},
+		{486, INVITE, true},
+		{503, INVITE, true},
+		{603, INVITE, true},
+		{200, BYE, false},
+		{481, BYE, false},
+		{180, OPTIONS, false},
+		{200, ACK, false},
+		{487, CANCEL, false},
+	}
+	for _, test := range tests {
+		response := NewResponse("SIP/2.0", test.statusCode, "", []SipHeader{}, "")
+		if response.RequiresAck(test.method) != test.expected {
+			t.Errorf("expected RequiresAck to be %v for a %d response to %s", test.expected, test.statusCode, test.method)
+		}
+	}
+}
+
+func TestAppendString(t *testing.T) {
+	request := benchmarkRequest()
+	for _, header := range request.AllHeaders() {
+		appender, ok := header.(StringAppender)
+		if !ok {
+			t.Errorf("expected %s to implement StringAppender", header.Name())
+			continue
+		}
+		if result := string(appender.AppendString([]byte("x"))); result != "x"+header.String() {
+			t.Errorf("expected AppendString to append %q, got %q", header.String(), result)
+		}
+	}
+
+	expected := "INVITE sip:bob@biloxi.com SIP/2.0\r\n" +
+		"Via: " + request.ViaChain()[0].String() + "\r\n" +
+		"Via: " + request.ViaChain()[1].String() + "\r\n" +
+		"Max-Forwards: 70\r\n" +
+		"To: <sip:bob@biloxi.com>\r\n" +
+		"From: \"Alice\" <sip:alice@atlanta.com>;tag=1928301774\r\n" +
+		"Call-Id: a84b4c76e66710@pc33.atlanta.com\r\n" +
+		"CSeq: 314159 INVITE\r\n" +
+		"Contact: <sip:alice@pc33.atlanta.com>\r\n" +
+		"Content-Type: application/sdp\r\n" +
+		"Subject: Lunch\r\n" +
+		"Content-Length: 65\r\n" +
+		"\r\n" + request.Body
+	if request.String() != expected {
+		t.Errorf("unexpected serialization: expected %q, got %q", expected, request.String())
+	}
+
+	// Headers which don't implement StringAppender are serialized with String().
+	request.AddHeader(&RequireHeader{[]string{"100rel"}})
+	if !strings.Contains(request.String(), "\r\nRequire: 100rel\r\n") {
+		t.Errorf("expected a Require header in %q", request.String())
+	}
+
+	response := NewResponse("SIP/2.0", 486, "Busy Here", []SipHeader{&CSeq{1, INVITE}}, "")
+	if response.String() != "SIP/2.0 486 Busy Here\r\nCSeq: 1 INVITE\r\nContent-Length: 0\r\n\r\n" {
+		t.Errorf("unexpected serialization %q", response.String())
+	}
+}
+
+// A typical INVITE, for benchmarking serialization.
+func benchmarkRequest() *Request {
+	alice, aliceName, tag := "alice", "Alice", "1928301774"
+	port := uint16(5060)
+	hop := BuildVia(UDP, "pc33.atlanta.com", &port, false)
+	proxyHop := BuildVia(TCP, "p1.example.com", nil, false)
+	callId := CallId("a84b4c76e66710@pc33.atlanta.com")
+	maxForwards := MaxForwards(70)
+	contentType := ContentType(SDP_CONTENT_TYPE)
+	return NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", []SipHeader{
+		&ViaHeader{proxyHop, hop},
+		&maxForwards,
+		&ToHeader{Address: &SipUri{User: &bob, Host: "biloxi.com"}, Params: Params{}},
+		&FromHeader{DisplayName: &aliceName, Address: &SipUri{User: &alice, Host: "atlanta.com"},
+			Params: Params{"tag": &tag}},
+		&callId,
+		&CSeq{314159, INVITE},
+		&ContactHeader{Address: &SipUri{User: &alice, Host: "pc33.atlanta.com"}, Params: Params{}},
+		&contentType,
+		&GenericHeader{"Subject", "Lunch"},
+	}, "v=0\r\no=alice 2890844526 2890844526 IN IP4 pc33.atlanta.com\r\ns=-\r\n")
+}
+
+// Serialize the request into a single buffer, as String() does.
+func BenchmarkRequestString(b *testing.B) {
+	request := benchmarkRequest()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = request.String()
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	var _ io.WriterTo = (*Request)(nil)
+	var _ io.WriterTo = (*Response)(nil)
+
+	request := benchmarkRequest()
+	var buffer bytes.Buffer
+	n, err := request.WriteTo(&buffer)
+	if err != nil || n != int64(buffer.Len()) {
+		t.Errorf("unexpected result writing the request: %d bytes, error %v", n, err)
+	}
+	if !bytes.Equal(buffer.Bytes(), request.CachedBytes()) {
+		t.Errorf("expected %q to be written, got %q", request.CachedBytes(), buffer.Bytes())
+	}
+
+	// The request is serialized afresh even once its bytes are cached, so a change made directly to its
+	// fields, which doesn't invalidate the cache, is still written.
+	request.CachedBytes()
+	request.Method = OPTIONS
+	buffer.Reset()
+	if n, err := request.WriteTo(&buffer); err != nil || n != int64(len(request.String())) ||
+		buffer.String() != request.String() {
+		t.Errorf("unexpected result writing the request again: %q (%d bytes, error %v)", buffer.Bytes(), n, err)
+	}
+
+	response := NewResponse("SIP/2.0", 200, "OK", []SipHeader{&CSeq{1, INVITE}}, "v=0\r\n")
+	buffer.Reset()
+	if n, err := response.WriteTo(&buffer); err != nil || n != int64(len(response.String())) ||
+		buffer.String() != response.String() {
+		t.Errorf("unexpected result writing the response: %q (%d bytes, error %v)", buffer.String(), n, err)
+	}
+}
+
+func TestRemoveTopRouteIfMatches(t *testing.T) {
+	self := &SipUri{Host: "p1.example.com", UriParams: Params{"lr": nil}, Headers: Params{}}
+	other := &SipUri{Host: "p2.example.com", UriParams: Params{"lr": nil}, Headers: Params{}}
+	third := &SipUri{Host: "p3.example.com", UriParams: Params{"lr": nil}, Headers: Params{}}
+	newRequest := func(routes ...*RouteHeader) *Request {
+		callId := CallId("a84b4c76e66710")
+		headers := []SipHeader{&callId}
+		for _, route := range routes {
+			headers = append(headers, route)
+		}
+		return NewRequest(INVITE, &SipUri{User: &bob, Host: "biloxi.com"}, "SIP/2.0", headers, "")
+	}
+
+	tests := []struct {
+		description string
+		request     *Request
+		removed     bool
+		expected    string
+	}{
+		{"no Route", newRequest(), false, ""},
+		{"a single matching entry", newRequest(&RouteHeader{[]Uri{self.Copy()}}), true, ""},
+		{"a matching entry followed by another", newRequest(&RouteHeader{[]Uri{self.Copy(), other.Copy()}}), true,
+			"Route: <sip:p2.example.com;lr>"},
+		{"a matching line followed by others",
+			newRequest(&RouteHeader{[]Uri{self.Copy()}}, &RouteHeader{[]Uri{other.Copy(), third.Copy()}}), true,
+			"Route: <sip:p2.example.com;lr>, <sip:p3.example.com;lr>"},
+		{"a non-matching top entry", newRequest(&RouteHeader{[]Uri{other.Copy(), self.Copy()}}), false,
+			"Route: <sip:p2.example.com;lr>, <sip:p1.example.com;lr>"},
+		{"a match on the second line only",
+			newRequest(&RouteHeader{[]Uri{other.Copy()}}, &RouteHeader{[]Uri{self.Copy()}}), false,
+			"Route: <sip:p2.example.com;lr>\r\nRoute: <sip:p1.example.com;lr>"},
+		{"an entry without lr", newRequest(&RouteHeader{[]Uri{&SipUri{Host: "p1.example.com"}}}), false,
+			"Route: <sip:p1.example.com>"},
+	}
+
+	for _, test := range tests {
+		before := test.request.String()
+		if test.request.RemoveTopRouteIfMatches(self) != test.removed {
+			t.Errorf("%s: expected RemoveTopRouteIfMatches to return %v", test.description, test.removed)
+		}
+
+		routes := []string{}
+		for _, route := range test.request.Headers("Route") {
+			routes = append(routes, route.String())
+		}
+		if strings.Join(routes, "\r\n") != test.expected {
+			t.Errorf("%s: expected Route headers %q, got %q", test.description, test.expected, routes)
+		}
+		if !test.removed && test.request.String() != before {
+			t.Errorf("%s: expected the request to be unchanged, got %q", test.description, test.request.String())
+		}
+	}
+}
@@ -23,6 +23,10 @@ const c_ABNF_WS = " \t"
 // C.f. RFC 3261 S. 8.1.1.5.
 const MAX_CSEQ = 2147483647
 
+// The maximum permissible RSeq number in a SIP message (2**31 - 1).
+// C.f. RFC 3262 S. 7.1.
+const MAX_RSEQ = 2147483647
+
 // The buffer size of the parser input channel.
 const c_INPUT_CHAN_SIZE = 10
 
@@ -40,17 +44,62 @@ type Parser interface {
 	// If a parser is not available for a header type in a message, the parser will produce a base.GenericHeader struct.
 	SetHeaderParser(headerName string, headerParser HeaderParser)
 
+	// Register a channel on which keepalives received between messages will be reported.
+	// If no channel is registered, keepalives are silently discarded.
+	SetPingPongChan(pingPongs chan<- PingPong)
+
+	// Set whether the parser is strict. By default it is lenient: it accepts headers which deviate from the
+	// canonical form of RFC 3261 in ways that are common in practice, such as 'Call-ID:abc' with no space
+	// after the colon, and only logs them. A strict parser still parses such headers, but rejects the message
+	// containing them: instead of being output, the message is reported as an error on the errors channel,
+	// and parsing carries on with the next message.
+	SetStrict(strict bool)
+
+	// Set whether the parser records, on each message it produces, the text from which each header was parsed
+	// (see RawValues on base.Request and base.Response). This is off by default, as most applications only need the parsed headers.
+	SetKeepRawHeaders(keep bool)
+
 	Stop()
 }
 
+// A keepalive frame, sent between messages on a connection-oriented transport (RFC 5626 s. 4.4.1).
+type PingPong int
+
+const (
+	// A double CRLF, to which the recipient should respond with a Pong.
+	Ping PingPong = iota
+
+	// A single CRLF, sent in response to a Ping.
+	Pong
+)
+
+func (pingPong PingPong) String() string {
+	if pingPong == Ping {
+		return "Ping"
+	}
+	return "Pong"
+}
+
 // A HeaderParser is any function that turns raw header data into one or more SipHeader objects.
 // The HeaderParser will receive arguments of the form ("max-forwards", "70").
 // It should return a slice of headers, which should have length > 1 unless it also returns an error.
 type HeaderParser func(headerName string, headerData string) (
 	headers []base.SipHeader, err error)
 
+// The standard set of header parsers, keyed on lowercase header name, including compact forms.
+// Header names are dispatched with a single map lookup, so the cost of dispatch does not grow as
+// parsers for new header types are added. This must not be modified; parsers copy it on creation.
+var defaultParsers = defaultHeaderParsers()
+
 func defaultHeaderParsers() map[string]HeaderParser {
 	return map[string]HeaderParser{
+		"accept":         parseAcceptHeader,
+		"allow":          parseListHeader,
+		"require":        parseListHeader,
+		"proxy-require":  parseListHeader,
+		"supported":      parseListHeader,
+		"k":              parseListHeader,
+		"unsupported":    parseListHeader,
 		"to":             parseAddressHeader,
 		"t":              parseAddressHeader,
 		"from":           parseAddressHeader,
@@ -62,8 +111,56 @@ func defaultHeaderParsers() map[string]HeaderParser {
 		"via":            parseViaHeader,
 		"v":              parseViaHeader,
 		"max-forwards":   parseMaxForwards,
+		"min-expires":    parseMinExpires,
 		"content-length": parseContentLength,
 		"l":              parseContentLength,
+		"content-type":   parseContentType,
+		"c":              parseContentType,
+		"call-info":      parseCallInfoHeader,
+		"diversion":      parseDiversionHeader,
+		"expires":        parseExpires,
+		"history-info":   parseHistoryInfoHeader,
+		"info-package":   parseInfoPackageHeader,
+		"join":           parseJoinHeader,
+		"recv-info":      parseRecvInfoHeader,
+		"replaces":       parseReplacesHeader,
+		"route":          parseRouteHeader,
+		"record-route":   parseRouteHeader,
+		"path":           parseRouteHeader,
+		"rseq":           parseRSeq,
+
+		// Request authorization through dialog identification (RFC 4538).
+		"target-dialog": parseTargetDialogHeader,
+
+		// Digest authentication (RFC 3261 s. 22, RFC 2617).
+		"authentication-info": parseAuthenticationInfoHeader,
+		"authorization":       parseAuthorizationHeader,
+		"www-authenticate":    parseAuthorizationHeader,
+		"proxy-authenticate":  parseAuthorizationHeader,
+		"proxy-authorization": parseAuthorizationHeader,
+
+		// SIP-specific event notification (RFC 6665).
+		"allow-events":       parseListHeader,
+		"u":                  parseListHeader,
+		"subscription-state": parseSubscriptionStateHeader,
+
+		// Message bodies (RFC 3261 s. 20.11).
+		"content-disposition": parseContentDisposition,
+		"content-id":          parseContentId,
+
+		// Asserted identity within trusted networks (RFC 3325).
+		"p-asserted-identity": parsePAssertedIdentityHeader,
+
+		// Authenticated identity (RFC 8224).
+		"identity": parseIdentityHeader,
+		"y":        parseIdentityHeader,
+
+		// Feature-capability indicators (RFC 6809).
+		"feature-caps": parseFeatureCapsHeader,
+
+		// IMS private headers (RFC 7315).
+		"p-charging-vector":             parsePChargingVectorHeader,
+		"p-charging-function-addresses": parsePChargingFunctionAddressesHeader,
 	}
 }
 
@@ -71,7 +168,24 @@ func defaultHeaderParsers() map[string]HeaderParser {
 // This is more costly than reusing a parser, but is necessary when we do not
 // have a guarantee that all messages coming over a connection are from the
 // same endpoint (e.g. UDP).
-func ParseMessage(msgData []byte) (base.SipMessage, error) {
+//
+// The data should contain exactly one message, as in a UDP datagram. The number of bytes making up the
+// message (its headers, plus the body as given by its Content-Length) is returned, so that the caller can
+// detect any trailing bytes. If there is no Content-Length header, the body is taken to be the rest of
+// the data. A Content-Length larger than the data available is an error (RFC 3261 s. 18.3).
+func ParseMessage(msgData []byte) (msg base.SipMessage, consumed int, err error) {
+	if isKeepalive(msgData) {
+		err = fmt.Errorf("data is a keepalive, not a SIP message")
+		return
+	}
+
+	headerEnd := bytes.Index(msgData, []byte("\r\n\r\n"))
+	if headerEnd == -1 {
+		err = fmt.Errorf("incomplete message: no blank line at end of headers")
+		return
+	}
+	bodyStart := headerEnd + 4
+
 	output := make(chan base.SipMessage, 0)
 	errors := make(chan error, 0)
 	parser := NewParser(output, errors, false)
@@ -79,11 +193,55 @@ func ParseMessage(msgData []byte) (base.SipMessage, error) {
 
 	parser.Write(msgData)
 	select {
-	case msg := <-output:
-		return msg, nil
-	case err := <-errors:
-		return nil, err
+	case msg = <-output:
+	case err = <-errors:
+		return
+	}
+
+	consumed = len(msgData)
+	contentLengths := msg.Headers("Content-Length")
+	if len(contentLengths) > 0 {
+		contentLength := int(*(contentLengths[0].(*base.ContentLength)))
+		if bodyStart+contentLength > len(msgData) {
+			msg = nil
+			err = fmt.Errorf("content-length %d exceeds the %d bytes of body available",
+				contentLength, len(msgData)-bodyStart)
+			return
+		}
+		consumed = bodyStart + contentLength
+		msg.SetBody(string(msgData[bodyStart:consumed]))
+	}
+
+	return
+}
+
+// Parse a complete SIP message and serialize it again, as a check that gossip neither drops nor mangles
+// any part of it. Any data after the end of the message is ignored; see ParseMessage.
+//
+// The output is semantically identical to the input, but is not always byte-for-byte identical. The
+// following transformations are made, so comparisons against the input should tolerate them:
+//   - Header names are canonicalized, e.g. 'v:' and 'VIA:' become 'Via:'; headers gossip doesn't
+//     understand are emitted with lower-case names.
+//   - Runs of whitespace are collapsed to a single space outside quoted strings, and folded header
+//     lines are unfolded.
+//   - The params of a header or URI may be emitted in a different order.
+//   - Param values are only quoted when they need to be, e.g. 'x="tok"' becomes 'x=tok'.
+//   - Display names are always quoted, and the URIs of To, From and Contact headers are always
+//     enclosed in angle brackets.
+//   - Comma-separated Contact headers are split into one header per line, as are Via hops (by default;
+//     see base.ViaPolicy and SetViaPolicy). Other comma-separated headers, such as Route, stay on one line.
+//   - Headers with the same name are grouped together at the position of the first of them.
+//   - The request method is upper-cased.
+//   - A Content-Length header is added at the end if there is none (by default; see
+//     base.ContentLengthPolicy and SetContentLengthPolicy).
+//
+// Serializing the output again yields the same output, so a second pass can be compared exactly.
+func ParseAndString(raw string) (string, error) {
+	msg, _, err := ParseMessage([]byte(raw))
+	if err != nil {
+		return "", err
 	}
+	return msg.String(), nil
 }
 
 // Create a new Parser.
@@ -105,7 +263,7 @@ func NewParser(output chan<- base.SipMessage, errs chan<- error, streamed bool)
 
 	// Configure the parser with the standard set of header parsers.
 	p.headerParsers = make(map[string]HeaderParser)
-	for headerName, headerParser := range defaultHeaderParsers() {
+	for headerName, headerParser := range defaultParsers {
 		p.SetHeaderParser(headerName, headerParser)
 	}
 
@@ -134,6 +292,9 @@ type parser struct {
 	bodyLengths   utils.ElasticChan
 	output        chan<- base.SipMessage
 	errs          chan<- error
+	pingPongs     chan<- PingPong
+	strict        bool
+	keepRaw       bool
 	terminalErr   error
 	stopped       bool
 }
@@ -147,7 +308,7 @@ func (p *parser) Write(data []byte) (n int, err error) {
 		return 0, fmt.Errorf("Cannot write data to stopped parser %p", p)
 	}
 
-	if !p.streamed {
+	if !p.streamed && !isKeepalive(data) {
 		l := getBodyLength(data)
 		p.bodyLengths.In <- l
 	}
@@ -156,6 +317,18 @@ func (p *parser) Write(data []byte) (n int, err error) {
 	return len(data), nil
 }
 
+func (p *parser) SetPingPongChan(pingPongs chan<- PingPong) {
+	p.pingPongs = pingPongs
+}
+
+func (p *parser) SetStrict(strict bool) {
+	p.strict = strict
+}
+
+func (p *parser) SetKeepRawHeaders(keep bool) {
+	p.keepRaw = keep
+}
+
 // Stop parser processing, and allow all resources to be garbage collected.
 // The parser will not release its resources until Stop() is called,
 // even if the parser object itself is garbage collected.
@@ -179,8 +352,28 @@ func (p *parser) parse(requireContentLength bool) {
 			break
 		}
 
+		if len(startLine) == 0 {
+			// A CRLF where a message should start is a keepalive. If it arrived together with a
+			// second CRLF, the pair is a Ping; otherwise it is a Pong.
+			pingPong := Pong
+			if p.input.ConsumeBufferedCRLF() {
+				pingPong = Ping
+			}
+			log.Debug("Parser %p received keepalive %s", p, pingPong)
+			if p.pingPongs != nil {
+				p.pingPongs <- pingPong
+			}
+			continue
+		}
+
+		// The first deviation from RFC 3261 found in the message, if the parser is strict; see SetStrict.
+		var strictErr error
+
 		if isRequest(startLine) {
 			method, recipient, sipVersion, err := parseRequestLine(startLine)
+			if err == nil && p.strict {
+				strictErr = checkStrictUri(recipient)
+			}
 			message = base.NewRequest(method, recipient, sipVersion, []base.SipHeader{}, "")
 			p.terminalErr = err
 		} else if isResponse(startLine) {
@@ -200,18 +393,31 @@ func (p *parser) parse(requireContentLength bool) {
 		// Parse the header section.
 		// Headers can be split across lines (marked by whitespace at the start of subsequent lines),
 		// so store lines into a buffer, and then flush and parse it when we hit the end of the header.
+		// If we're keeping raw headers, the lines of each header are also stored as they were received.
 		var buffer bytes.Buffer
-		headers := make([]base.SipHeader, 0)
+		var rawBuffer bytes.Buffer
+		headers := make([]base.ParsedHeader, 0)
 
 		flushBuffer := func() {
 			if buffer.Len() > 0 {
 				newHeaders, err := p.parseHeader(buffer.String())
+				if _, ok := err.(*strictError); ok {
+					// The header is still parsed, so that the message can be read to its end, but the
+					// message is rejected once it has been.
+					if strictErr == nil {
+						strictErr = err
+					}
+					err = nil
+				}
 				if err == nil {
-					headers = append(headers, newHeaders...)
+					for _, header := range newHeaders {
+						headers = append(headers, base.ParsedHeader{Header: header, Raw: rawBuffer.String()})
+					}
 				} else {
 					log.Debug("Skipping header '%s' due to error: %s", buffer.String(), err.Error())
 				}
 				buffer.Reset()
+				rawBuffer.Reset()
 			}
 		}
 
@@ -235,10 +441,19 @@ func (p *parser) parse(requireContentLength bool) {
 				// Parse anything currently in the buffer, then store the new header line in the buffer.
 				flushBuffer()
 				buffer.WriteString(line)
+				if p.keepRaw {
+					rawBuffer.WriteString(line)
+				}
 			} else if buffer.Len() > 0 {
 				// This is a continuation line, so just add it to the buffer.
+				// The line fold and any leading whitespace are replaced with a single space,
+				// so that the header is unfolded to a single line (RFC 3261 s. 7.3.1).
 				buffer.WriteString(" ")
-				buffer.WriteString(line)
+				buffer.WriteString(strings.TrimLeft(line, c_ABNF_WS))
+				if p.keepRaw {
+					rawBuffer.WriteString("\r\n")
+					rawBuffer.WriteString(line)
+				}
 			} else {
 				// This is a continuation line, but also the first line of the whole header section.
 				// Discard it and log.
@@ -248,9 +463,12 @@ func (p *parser) parse(requireContentLength bool) {
 			}
 		}
 
-		// Store the headers in the message object.
-		for _, header := range headers {
-			message.AddHeader(header)
+		// Store the headers in the message object, along with the text of each if we're keeping it.
+		switch msg := message.(type) {
+		case *base.Request:
+			message = base.NewParsedRequest(msg.Method, msg.Recipient, msg.SipVersion, headers, "")
+		case *base.Response:
+			message = base.NewParsedResponse(msg.SipVersion, msg.StatusCode, msg.Reason, headers, "")
 		}
 
 		var contentLength int
@@ -299,6 +517,11 @@ func (p *parser) parse(requireContentLength bool) {
 		default:
 			log.Severe("Internal error - message %s is neither a request type nor a response type", message.Short())
 		}
+
+		if strictErr != nil {
+			p.errs <- fmt.Errorf("strict parser rejected message %s: %s", message.Short(), strictErr.Error())
+			continue
+		}
 		p.output <- message
 	}
 
@@ -316,6 +539,11 @@ func (p *parser) SetHeaderParser(headerName string, headerParser HeaderParser) {
 	p.headerParsers[headerName] = headerParser
 }
 
+// Determine if the given data is a keepalive: that is, if it consists only of CRLFs.
+func isKeepalive(data []byte) bool {
+	return len(data) > 0 && len(bytes.Replace(data, []byte("\r\n"), nil, -1)) == 0
+}
+
 // Calculate the size of a SIP message's body, given the entire contents of the message as a byte array.
 func getBodyLength(data []byte) int {
 	s := string(data)
@@ -394,7 +622,9 @@ func parseRequestLine(requestLine string) (
 //   SIP/1.0 403 Forbidden
 func parseStatusLine(statusLine string) (
 	sipVersion string, statusCode uint16, reasonPhrase string, err error) {
-	parts := strings.Split(statusLine, " ")
+	// The reason phrase is everything after the second space, kept verbatim: it may contain spaces and
+	// UTF-8 text, or be empty (RFC 3261 s. 25.1).
+	parts := strings.SplitN(statusLine, " ", 3)
 	if len(parts) < 3 {
 		err = fmt.Errorf("status line has too few spaces: '%s'", statusLine)
 		return
@@ -403,7 +633,7 @@ func parseStatusLine(statusLine string) (
 	sipVersion = parts[0]
 	statusCodeRaw, err := strconv.ParseUint(parts[1], 10, 16)
 	statusCode = uint16(statusCodeRaw)
-	reasonPhrase = strings.Join(parts[2:], "")
+	reasonPhrase = parts[2]
 
 	return
 }
@@ -440,19 +670,55 @@ func ParseUri(uriStr string) (uri base.Uri, err error) {
 	return
 }
 
+// Determine if the given URI text has the 'sip' or 'sips' scheme, compared case-insensitively.
+func isSipScheme(uriStr string) bool {
+	colonIdx := strings.Index(uriStr, ":")
+	if colonIdx == -1 {
+		return false
+	}
+	scheme := strings.ToLower(strings.TrimSpace(uriStr[:colonIdx]))
+	return scheme == "sip" || scheme == "sips"
+}
+
+// Parse a URI with a scheme gossip doesn't understand into an AbsoluteUri, which holds it verbatim.
+// Only the scheme is validated: it must be a letter followed by letters, digits, '+', '-' or '.' (RFC 3986 s. 3.1).
+func parseAbsoluteUri(uriStr string) (uri *base.AbsoluteUri, err error) {
+	uriStr = strings.TrimSpace(uriStr)
+	colonIdx := strings.Index(uriStr, ":")
+	if colonIdx <= 0 {
+		err = fmt.Errorf("no scheme in URI '%s'", uriStr)
+		return
+	}
+
+	scheme := uriStr[:colonIdx]
+	for idx := 0; idx < len(scheme); idx++ {
+		char := scheme[idx]
+		letter := (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+		if !letter && (idx == 0 || !base.IsAlphanumeric(char) && strings.IndexByte("+-.", char) == -1) {
+			err = fmt.Errorf("invalid scheme '%s' in URI '%s'", scheme, uriStr)
+			return
+		}
+	}
+
+	uri = &base.AbsoluteUri{Scheme: scheme, Opaque: uriStr[colonIdx+1:]}
+	return
+}
+
 // ParseSipUri converts a string representation of a SIP or SIPS URI into a SipUri object.
+// A ttl param which has no value or is out of range is tolerated, as the parser is lenient unless it is strict;
+// SipUri.Ttl reports no ttl for it.
 func ParseSipUri(uriStr string) (uri base.SipUri, err error) {
 	// Store off the original URI in case we need to print it in an error.
 	uriStrCopy := uriStr
 
 	// URI should start 'sip' or 'sips'. Check the first 3 chars.
-	if strings.ToLower(uriStr[:3]) != "sip" {
+	if len(uriStr) < 4 || strings.ToLower(uriStr[:3]) != "sip" {
 		err = fmt.Errorf("invalid SIP uri protocol name in '%s'", uriStrCopy)
 		return
 	}
 	uriStr = uriStr[3:]
 
-	if strings.ToLower(uriStr[0:1]) == "s" {
+	if strings.ToLower(uriStr[0:1]) == "s" && len(uriStr) > 1 {
 		// URI started 'sips', so it's encrypted.
 		uri.IsEncrypted = true
 		uriStr = uriStr[1:]
@@ -488,6 +754,12 @@ func ParseSipUri(uriStr string) (uri base.SipUri, err error) {
 			uri.User = &user
 			uri.Password = &pwd
 		}
+
+		// The user is mandatory within a user-info part, even when a password is given.
+		if len(*uri.User) == 0 {
+			err = fmt.Errorf("empty user part in SIP uri '%s'", uriStrCopy)
+			return
+		}
 		uriStr = uriStr[endOfUserInfoPart+1:]
 	}
 
@@ -504,6 +776,9 @@ func ParseSipUri(uriStr string) (uri base.SipUri, err error) {
 
 	uri.Host, uri.Port, err = parseHostPort(uriStr[:endOfUriPart])
 	uriStr = uriStr[endOfUriPart:]
+	if err == nil && len(uri.Host) == 0 {
+		err = fmt.Errorf("no host in SIP uri '%s'", uriStrCopy)
+	}
 	if err != nil || len(uriStr) == 0 {
 		return
 	}
@@ -515,20 +790,27 @@ func ParseSipUri(uriStr string) (uri base.SipUri, err error) {
 	var uriParams map[string]*string
 	var n int
 	if uriStr[0] == ';' {
-		uriParams, n, err = parseParams(uriStr, ';', ';', '?', true, true)
+		uriParams, n, err = base.ParseParams(uriStr, ';', ';', '?', true, true)
 		if err != nil {
 			return
 		}
+		if ttl, ok := uriParams["ttl"]; ok && (ttl == nil || !validTtl(*ttl)) {
+			// Unless the parser is strict, we're lenient; see checkStrictUri.
+			log.Fine("Tolerated invalid ttl param in SIP uri '%s'", uriStrCopy)
+		}
 	} else {
 		uriParams, n = map[string]*string{}, 0
 	}
 	uri.UriParams = uriParams
 	uriStr = uriStr[n:]
+	if !uri.TransportSchemeConsistent() {
+		log.Fine("Tolerated transport param inconsistent with scheme in SIP uri '%s'", uriStrCopy)
+	}
 
 	// Finally parse any URI headers.
 	// These are key-value pairs, starting with a '?' and separated by '&'.
 	var headers map[string]*string
-	headers, n, err = parseParams(uriStr, '?', '&', 0, true, false)
+	headers, n, err = base.ParseParams(uriStr, '?', '&', 0, true, false)
 	if err != nil {
 		return
 	}
@@ -564,168 +846,124 @@ func parseHostPort(rawText string) (host string, port *uint16, err error) {
 	return
 }
 
-// General utility method for parsing 'key=value' parameters.
-// Takes a string (source), ensures that it begins with the 'start' character provided,
-// and then parses successive key/value pairs separated with 'sep',
-// until either 'end' is reached or there are no characters remaining.
-// A map of keys to values will be returned, along with the number of characters consumed.
-// Provide 0 for start or end to indicate that there is no starting/ending delimiter.
-// If quoteValues is true, values can be enclosed in double-quotes which will be validated by the
-// parser and omitted from the returned map.
-// If permitSingletons is true, keys with no values are permitted.
-// These will result in a nil value in the returned map.
-func parseParams(source string,
-	start uint8, sep uint8, end uint8,
-	quoteValues bool, permitSingletons bool) (
-	params map[string]*string, consumed int, err error) {
-
-	params = make(map[string]*string)
+// Parse a header string, producing one or more SipHeader objects.
+// (SIP messages containing multiple headers of the same type can express them as a
+// single header containing a comma-separated argument list).
+// If the parser is strict and the header deviates from RFC 3261, the headers are returned together with a
+// *strictError describing the deviation.
+func (p *parser) parseHeader(headerText string) (headers []base.SipHeader, err error) {
+	log.Debug("Parser %p parsing header \"%s\"", p, headerText)
+	headers = make([]base.SipHeader, 0)
 
-	if len(source) == 0 {
-		// Key-value section is completely empty; return defaults.
+	colonIdx := strings.Index(headerText, ":")
+	if colonIdx == -1 {
+		err = fmt.Errorf("Field name with no value in header: %s", headerText)
 		return
 	}
 
-	// Ensure the starting character is correct.
-	if start != 0 {
-		if source[0] != start {
-			err = fmt.Errorf("expected %c at start of key-value section; got %c. section was %s",
-				start, source[0], source)
-			return
-		}
-		consumed++
+	// LWS around the colon is optional, and any run of LWS in the value is equivalent to a single SP
+	// (RFC 3261 s. 7.3.1), so unless we're strict we accept any amount of it, but note when the sender
+	// wasn't canonical.
+	fieldName := strings.ToLower(strings.TrimSpace(headerText[:colonIdx]))
+	fieldText := collapseWhitespace(strings.TrimSpace(headerText[colonIdx+1:]))
+	canonicalValue := headerText[colonIdx+1:] == " "+fieldText || (fieldText == "" && colonIdx+1 == len(headerText))
+	canonical := canonicalValue && headerText[:colonIdx] == strings.TrimSpace(headerText[:colonIdx])
+	if !canonical && !p.strict {
+		log.Fine("Parser %p tolerated non-canonical whitespace in header \"%s\"", p, headerText)
 	}
 
-	// Statefully parse the given string one character at a time.
-	var buffer bytes.Buffer
-	var key string
-	parsingKey := true // false implies we are parsing a value
-	inQuotes := false
-parseLoop:
-	for ; consumed < len(source); consumed++ {
-		switch source[consumed] {
-		case end:
-			if inQuotes {
-				// We read an end character, but since we're inside quotations we should
-				// treat it as a literal part of the value.
-				buffer.WriteString(string(end))
-				continue
-			}
-
-			break parseLoop
-
-		case sep:
-			if inQuotes {
-				// We read a separator character, but since we're inside quotations
-				// we should treat it as a literal part of the value.
-				buffer.WriteString(string(sep))
-				continue
-			}
-			if parsingKey && permitSingletons {
-				params[buffer.String()] = nil
-			} else if parsingKey {
-				err = fmt.Errorf("Singleton param '%s' when parsing params which disallow singletons: \"%s\"",
-					buffer.String(), source)
-				return
-			} else {
-				value := buffer.String()
-				params[key] = &value
-			}
-			buffer.Reset()
-			parsingKey = true
-
-		case '"':
-			if !quoteValues {
-				// We hit a quote character, but since quoting is turned off we treat it as a literal.
-				buffer.WriteString("\"")
-				continue
-			}
-
-			if parsingKey {
-				// Quotes are never allowed in keys.
-				err = fmt.Errorf("Unexpected '\"' in parameter key in params \"%s\"", source)
-				return
-			}
-
-			if !inQuotes && buffer.Len() != 0 {
-				// We hit an initial quote midway through a value; that's not allowed.
-				err = fmt.Errorf("unexpected '\"' in params \"%s\"", source)
-				return
-			}
-
-			if inQuotes &&
-				consumed != len(source)-1 &&
-				source[consumed+1] != sep {
-				// We hit an end-quote midway through a value; that's not allowed.
-				err = fmt.Errorf("unexpected character %c after quoted param in \"%s\"",
-					source[consumed+1], source)
+	headers, err = parseHeaderValue(p.headerParsers, fieldName, fieldText)
+	if err != nil || !p.strict {
+		return
+	}
+	if !canonical {
+		err = &strictError{fmt.Sprintf("non-canonical whitespace in header '%s'", headerText)}
+	} else {
+		err = checkStrict(headers)
+	}
+	return
+}
 
-				return
-			}
+// A deviation from RFC 3261 which is tolerated unless the parser is strict; see Parser.SetStrict.
+type strictError struct {
+	reason string
+}
 
-			inQuotes = !inQuotes
+func (err *strictError) Error() string {
+	return err.reason
+}
 
-		case '=':
-			if buffer.Len() == 0 {
-				err = fmt.Errorf("Key of length 0 in params \"%s\"", source)
-				return
-			}
-			if !parsingKey {
-				err = fmt.Errorf("Unexpected '=' char in value token: \"%s\"", source)
-				return
+// Check the given parsed headers for deviations from RFC 3261 which are tolerated unless the parser is strict,
+// returning a *strictError describing the first one found.
+func checkStrict(headers []base.SipHeader) error {
+	for _, header := range headers {
+		for _, uri := range base.HeaderURIs(header) {
+			if err := checkStrictUri(uri); err != nil {
+				return &strictError{fmt.Sprintf("%s in %s header", err.Error(), header.Name())}
 			}
-			key = buffer.String()
-			buffer.Reset()
-			parsingKey = false
-
-		default:
-			if !inQuotes && strings.Contains(c_ABNF_WS, string(source[consumed])) {
-				// Skip unquoted whitespace.
-				continue
+		}
+		if via, ok := header.(*base.ViaHeader); ok {
+			for _, hop := range *via {
+				if !strings.EqualFold(hop.ProtocolName, "SIP") || hop.ProtocolVersion != "2.0" {
+					return &strictError{fmt.Sprintf("non-standard sent-protocol %s/%s in via header '%s'",
+						hop.ProtocolName, hop.ProtocolVersion, via.String())}
+				}
 			}
-
-			buffer.WriteString(string(source[consumed]))
 		}
 	}
+	return nil
+}
 
-	// The param string has ended. Check that it ended in a valid place, and then store off the
-	// contents of the buffer.
-	if inQuotes {
-		err = fmt.Errorf("Unclosed quotes in parameter string: %s", source)
-	} else if parsingKey && permitSingletons {
-		params[buffer.String()] = nil
-	} else if parsingKey {
-		err = fmt.Errorf("Singleton param '%s' when parsing params which disallow singletons: \"%s\"",
-			buffer.String(), source)
-	} else {
-		value := buffer.String()
-		params[key] = &value
+// Check the given parsed URI for deviations from RFC 3261 which are tolerated unless the parser is strict: a
+// ttl param which has no value, or whose value isn't from 0 to 255.
+func checkStrictUri(uri base.Uri) error {
+	sipUri, ok := uri.(*base.SipUri)
+	if !ok {
+		return nil
 	}
-	return
+	if ttl, ok := sipUri.UriParams["ttl"]; ok && (ttl == nil || !validTtl(*ttl)) {
+		return fmt.Errorf("invalid ttl param in SIP uri '%s'", sipUri.String())
+	}
+	return nil
 }
 
-// Parse a header string, producing one or more SipHeader objects.
-// (SIP messages containing multiple headers of the same type can express them as a
-// single header containing a comma-separated argument list).
-func (p *parser) parseHeader(headerText string) (headers []base.SipHeader, err error) {
-	log.Debug("Parser %p parsing header \"%s\"", p, headerText)
-	headers = make([]base.SipHeader, 0)
+// Determine whether the given text is a valid ttl value; see base.ParseTtl.
+func validTtl(text string) bool {
+	_, err := base.ParseTtl(text)
+	return err == nil
+}
 
-	colonIdx := strings.Index(headerText, ":")
-	if colonIdx == -1 {
-		err = fmt.Errorf("Field name with no value in header: %s", headerText)
+// Parse the value of a single header, given its name, using the registered parser for that header type.
+// The value should not include the 'Name:' prefix; e.g. ParseHeader("Max-Forwards", "70").
+// Headers with no registered parser are returned as a base.GenericHeader.
+// This is useful for parsing headers embedded elsewhere, such as in the headers part of a URI.
+// Header values which represent more than one header (e.g. a comma-separated list of Contacts)
+// will result in an error.
+func ParseHeader(name string, value string) (header base.SipHeader, err error) {
+	fieldName := strings.ToLower(strings.TrimSpace(name))
+	headers, err := parseHeaderValue(defaultParsers, fieldName, collapseWhitespace(strings.TrimSpace(value)))
+	if err != nil {
+		return
+	}
+	if len(headers) != 1 {
+		err = fmt.Errorf("expected a single %s header, but '%s' contains %d", name, value, len(headers))
 		return
 	}
 
-	fieldName := strings.ToLower(strings.TrimSpace(headerText[:colonIdx]))
-	fieldText := strings.TrimSpace(headerText[colonIdx+1:])
-	if headerParser, ok := p.headerParsers[fieldName]; ok {
+	header = headers[0]
+	return
+}
+
+// Dispatch the given (lowercase) header name and value to the appropriate parser from those given.
+func parseHeaderValue(headerParsers map[string]HeaderParser, fieldName string, fieldText string) (
+	headers []base.SipHeader, err error) {
+	if headerParser, ok := headerParsers[fieldName]; ok {
 		// We have a registered parser for this header type - use it.
 		headers, err = headerParser(fieldName, fieldText)
 	} else {
 		// We have no registered parser for this header type,
 		// so we encapsulate the header data in a GenericHeader struct.
-		log.Debug("Parser %p has no parser for header type %s", p, fieldName)
+		log.Debug("No parser for header type %s", fieldName)
 		header := base.GenericHeader{fieldName, fieldText}
 		headers = []base.SipHeader{&header}
 	}
@@ -777,9 +1015,9 @@ func parseAddressHeader(headerName string, headerText string) (
 						"header: %s", headerText)
 					return
 				default:
-					toHeader := base.ToHeader{displayNames[idx],
-						uris[idx],
-						paramSets[idx]}
+					toHeader := base.ToHeader{DisplayName: displayNames[idx],
+						Address: uris[idx],
+						Params:  paramSets[idx]}
 					header = &toHeader
 				}
 			} else if headerName == "from" || headerName == "f" {
@@ -796,9 +1034,9 @@ func parseAddressHeader(headerName string, headerText string) (
 						"header: %s", headerText)
 					return
 				default:
-					fromHeader := base.FromHeader{displayNames[idx],
-						uris[idx],
-						paramSets[idx]}
+					fromHeader := base.FromHeader{DisplayName: displayNames[idx],
+						Address: uris[idx],
+						Params:  paramSets[idx]}
 					header = &fromHeader
 				}
 			} else if headerName == "contact" || headerName == "m" {
@@ -830,140 +1068,411 @@ func parseAddressHeader(headerName string, headerText string) (
 	return
 }
 
-// Parse a string representation of a CSeq header, returning a slice of at most one CSeq.
-func parseCSeq(headerName string, headerText string) (
+// Parse a Route or Record-Route header line, producing a single header containing all the listed URIs in order.
+// Any display names or header parameters are discarded.
+func parseRouteHeader(headerName string, headerText string) (
 	headers []base.SipHeader, err error) {
-	var cseq base.CSeq
-
-	parts := splitByWhitespace(headerText)
-	if len(parts) != 2 {
-		err = fmt.Errorf("CSeq field should have precisely one whitespace section: '%s'",
-			headerText)
-		return
-	}
-
-	var seqno uint64
-	seqno, err = strconv.ParseUint(parts[0], 10, 32)
+	var uris []base.Uri
+	_, uris, _, err = parseAddressValues(headerText)
 	if err != nil {
 		return
 	}
 
-	if seqno > MAX_CSEQ {
-		err = fmt.Errorf("invalid CSeq %d: exceeds maximum permitted value "+
-			"2**31 - 1", seqno)
-		return
+	for _, uri := range uris {
+		if _, ok := uri.(base.WildcardUri); ok {
+			err = fmt.Errorf("wildcard uri not permitted in %s: header: %s", headerName, headerText)
+			return
+		}
 	}
 
-	cseq.SeqNo = uint32(seqno)
-	cseq.MethodName = base.Method(strings.TrimSpace(parts[1]))
-
-	if strings.Contains(string(cseq.MethodName), ";") {
-		err = fmt.Errorf("unexpected ';' in CSeq body: %s", headerText)
-		return
+	switch headerName {
+	case "route":
+		headers = []base.SipHeader{&base.RouteHeader{uris}}
+	case "record-route":
+		headers = []base.SipHeader{&base.RecordRouteHeader{uris}}
+	case "path":
+		headers = []base.SipHeader{&base.PathHeader{uris}}
 	}
-
-	headers = []base.SipHeader{&cseq}
-
 	return
 }
 
-// Parse a string representation of a Call-Id header, returning a slice of at most one CallId.
-func parseCallId(headerName string, headerText string) (
+// Parse a P-Asserted-Identity header, which is a comma-separated list of name-addrs or addr-specs with no
+// params (RFC 3325 s. 9.1).
+func parsePAssertedIdentityHeader(headerName string, headerText string) (
 	headers []base.SipHeader, err error) {
-	headerText = strings.TrimSpace(headerText)
-	var callId base.CallId = base.CallId(headerText)
-
-	if strings.ContainsAny(string(callId), c_ABNF_WS) {
-		err = fmt.Errorf("unexpected whitespace in CallId header body '%s'", headerText)
+	var displayNames []*string
+	var uris []base.Uri
+	var paramSets []map[string]*string
+	displayNames, uris, paramSets, err = parseAddressValues(headerText)
+	if err != nil {
 		return
 	}
-	if strings.Contains(string(callId), ";") {
-		err = fmt.Errorf("unexpected semicolon in CallId header body '%s'", headerText)
-		return
+
+	var identity base.PAssertedIdentityHeader
+	for idx, uri := range uris {
+		if _, ok := uri.(base.WildcardUri); ok {
+			err = fmt.Errorf("wildcard uri not permitted in %s: header: %s", headerName, headerText)
+			return
+		} else if len(paramSets[idx]) > 0 {
+			err = fmt.Errorf("unexpected params in %s: header: %s", headerName, headerText)
+			return
+		}
+		identity.Identities = append(identity.Identities, &base.AssertedIdentity{displayNames[idx], uri})
 	}
-	if len(string(callId)) == 0 {
-		err = fmt.Errorf("empty Call-Id body")
+	if len(identity.Identities) == 0 {
+		err = fmt.Errorf("no identities in %s: header: %s", headerName, headerText)
 		return
 	}
 
-	headers = []base.SipHeader{&callId}
-
+	headers = []base.SipHeader{&identity}
 	return
 }
 
-// Parse a string representation of a Via header, returning a slice of at most one ViaHeader.
-// Note that although Via headers may contain a comma-separated list, RFC 3261 makes it clear that
-// these should not be treated as separate logical Via headers, but as multiple values on a single
-// Via header.
-func parseViaHeader(headerName string, headerText string) (
+// Parse an Identity header (RFC 8224 s. 4), whose value is a token followed by params, of which 'info' is
+// mandatory and holds a URI in angle brackets.
+func parseIdentityHeader(headerName string, headerText string) (
 	headers []base.SipHeader, err error) {
-	sections := strings.Split(headerText, ",")
-	var via base.ViaHeader = base.ViaHeader{}
-	for _, section := range sections {
-		var hop base.ViaHop
-		parts := strings.Split(section, "/")
+	semicolonIdx := strings.Index(headerText, ";")
+	if semicolonIdx == -1 {
+		err = fmt.Errorf("no info param in %s: header: %s", headerName, headerText)
+		return
+	}
 
-		if len(parts) < 3 {
-			err = fmt.Errorf("not enough protocol parts in via header: '%s'",
-				parts)
-			return
+	identity := base.IdentityHeader{Token: strings.TrimSpace(headerText[:semicolonIdx])}
+	if len(identity.Token) == 0 || strings.ContainsAny(identity.Token, c_ABNF_WS+",;\"<>") {
+		err = fmt.Errorf("invalid token in %s: header: %s", headerName, headerText)
+		return
+	}
+
+	// The info URI may itself contain semicolons, so it is found by hand; the other params are parsed together.
+	var otherParams []string
+	rest := headerText[semicolonIdx+1:]
+	for len(rest) > 0 {
+		param := rest
+		rest = ""
+		if endIdx := findUnescaped(param, ';', quotes_delim, angles_delim); endIdx != -1 {
+			param, rest = param[:endIdx], param[endIdx+1:]
 		}
 
-		parts[2] = strings.Join(parts[2:], "/")
+		equalsIdx := strings.Index(param, "=")
+		if equalsIdx == -1 || !strings.EqualFold(strings.TrimSpace(param[:equalsIdx]), "info") {
+			otherParams = append(otherParams, strings.TrimSpace(param))
+			continue
+		}
 
-		// The transport part ends when whitespace is reached, but may also start with
-		// whitespace.
-		// So the end of the transport part is the first whitespace char following the
-		// first non-whitespace char.
-		initialSpaces := len(parts[2]) - len(strings.TrimLeft(parts[2], c_ABNF_WS))
-		sentByIdx := strings.IndexAny(parts[2][initialSpaces:], c_ABNF_WS) + initialSpaces + 1
-		if sentByIdx == 0 {
-			err = fmt.Errorf("expected whitespace after sent-protocol part "+
-				"in via header '%s'", section)
+		if identity.Info != nil {
+			err = fmt.Errorf("more than one info param in %s: header: %s", headerName, headerText)
 			return
-		} else if sentByIdx == 1 {
-			err = fmt.Errorf("empty transport field in via header '%s'", section)
+		}
+		info := strings.TrimSpace(param[equalsIdx+1:])
+		if !strings.HasPrefix(info, "<") || !strings.HasSuffix(info, ">") {
+			err = fmt.Errorf("expected a URI in angle brackets in info param of %s: header: %s", headerName, headerText)
 			return
 		}
-
-		hop.ProtocolName = strings.TrimSpace(parts[0])
-		hop.ProtocolVersion = strings.TrimSpace(parts[1])
-		hop.Transport = strings.TrimSpace(parts[2][:sentByIdx-1])
-
-		if len(hop.ProtocolName) == 0 {
-			err = fmt.Errorf("no protocol name provided in via header '%s'", section)
-		} else if len(hop.ProtocolVersion) == 0 {
-			err = fmt.Errorf("no version provided in via header '%s'", section)
-		} else if len(hop.Transport) == 0 {
-			err = fmt.Errorf("no transport provided in via header '%s'", section)
+		info = info[1 : len(info)-1]
+		if isSipScheme(info) {
+			identity.Info, err = ParseUri(info)
+		} else {
+			identity.Info, err = parseAbsoluteUri(info)
 		}
 		if err != nil {
 			return
 		}
+	}
+	if identity.Info == nil {
+		err = fmt.Errorf("no info param in %s: header: %s", headerName, headerText)
+		return
+	}
 
-		viaBody := parts[2][sentByIdx:]
-
-		paramsIdx := strings.Index(viaBody, ";")
-		var host string
-		var port *uint16
-		if paramsIdx == -1 {
-			// There are no header parameters, so the rest of the Via body is part of the host[:post].
-			host, port, err = parseHostPort(viaBody)
-			hop.Host = host
-			hop.Port = port
-			if err != nil {
+	identity.Params = base.Params{}
+	if len(otherParams) > 0 {
+		identity.Params, _, err = base.ParseParams(";"+strings.Join(otherParams, ";"), ';', ';', 0, true, true)
+		if err != nil {
+			return
+		}
+	}
+	for _, name := range []string{"alg", "ppt"} {
+		if value, ok := identity.Params[name]; ok && value == nil {
+			err = fmt.Errorf("no value for %s param in %s: header: %s", name, headerName, headerText)
+			return
+		}
+	}
+	identity.Alg = identity.Params["alg"]
+	delete(identity.Params, "alg")
+	identity.Ppt = identity.Params["ppt"]
+	delete(identity.Params, "ppt")
+
+	headers = []base.SipHeader{&identity}
+	return
+}
+
+// Parse a Feature-Caps header (RFC 6809 s. 4), producing one header for each comma-separated value. Each value
+// is a '*' followed by feature-capability indicators: a '+' and a name, with an optional value which must be
+// enclosed in double quotes.
+func parseFeatureCapsHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	for len(strings.TrimSpace(headerText)) > 0 {
+		valueText := headerText
+		headerText = ""
+		if commaIdx := findUnescaped(valueText, ',', quotes_delim); commaIdx != -1 {
+			valueText, headerText = valueText[:commaIdx], valueText[commaIdx+1:]
+		}
+
+		valueText = strings.TrimSpace(valueText)
+		if !strings.HasPrefix(valueText, "*") {
+			err = fmt.Errorf("expected '*' at start of value '%s' of %s: header", valueText, headerName)
+			return
+		}
+		valueText = strings.TrimSpace(valueText[1:])
+
+		var featureCaps base.FeatureCapsHeader
+		for len(valueText) > 0 {
+			if valueText[0] != ';' {
+				err = fmt.Errorf("expected ';' before '%s' in %s: header", valueText, headerName)
 				return
 			}
-		} else {
-			host, port, err = parseHostPort(viaBody[:paramsIdx])
+			capText := valueText[1:]
+			valueText = ""
+			if semicolonIdx := findUnescaped(capText, ';', quotes_delim); semicolonIdx != -1 {
+				capText, valueText = capText[:semicolonIdx], capText[semicolonIdx:]
+			}
+
+			var fcap *base.FeatureCap
+			fcap, err = parseFeatureCap(strings.TrimSpace(capText))
 			if err != nil {
+				err = fmt.Errorf("%s in %s: header", err.Error(), headerName)
 				return
 			}
-			hop.Host = host
-			hop.Port = port
+			featureCaps.Caps = append(featureCaps.Caps, fcap)
+		}
+		headers = append(headers, &featureCaps)
+	}
+
+	if len(headers) == 0 {
+		err = fmt.Errorf("empty %s: header", headerName)
+	}
+	return
+}
+
+// Remove the backslash from each quoted-pair in the given text, taken from within a quoted-string, leaving the
+// character it escapes (RFC 3261 s. 25.1).
+func unescapeQuotedPairs(text string) string {
+	if strings.IndexByte(text, '\\') == -1 {
+		return text
+	}
+	var buffer bytes.Buffer
+	for idx := 0; idx < len(text); idx++ {
+		if text[idx] == '\\' && idx+1 < len(text) {
+			idx++
+		}
+		buffer.WriteByte(text[idx])
+	}
+	return buffer.String()
+}
+
+// Parse a single feature-capability indicator, e.g. '+g.3gpp.srvcc-alerting' or '+sip.extensions="100rel"'.
+func parseFeatureCap(text string) (fcap *base.FeatureCap, err error) {
+	name := text
+	var value *string
+	if equalsIdx := strings.Index(text, "="); equalsIdx != -1 {
+		name = strings.TrimSpace(text[:equalsIdx])
+		quoted := strings.TrimSpace(text[equalsIdx+1:])
+		if len(quoted) < 2 || quoted[0] != '"' || quoted[len(quoted)-1] != '"' {
+			err = fmt.Errorf("expected a quoted value for feature-capability indicator '%s'", text)
+			return
+		}
+		unquoted := unescapeQuotedPairs(quoted[1 : len(quoted)-1])
+		value = &unquoted
+	}
+
+	if len(name) < 2 || name[0] != '+' {
+		err = fmt.Errorf("feature-capability indicator '%s' doesn't start with '+' and a name", text)
+		return
+	}
+	for idx := 1; idx < len(name); idx++ {
+		if !base.IsTokenChar(name[idx]) {
+			err = fmt.Errorf("invalid character '%c' in feature-capability indicator '%s'", name[idx], text)
+			return
+		}
+	}
+
+	fcap = &base.FeatureCap{Name: name, Value: value}
+	return
+}
+
+// Parse a string representation of a CSeq header, returning a slice of at most one CSeq.
+func parseCSeq(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	var cseq base.CSeq
+
+	// The CSeq is a sequence number and a method, separated by LWS (RFC 3261 s. 20.16).
+	parts := splitByWhitespace(headerText)
+	if len(parts) != 2 {
+		err = fmt.Errorf("CSeq field should be a sequence number and a method separated by whitespace: '%s'",
+			headerText)
+		return
+	}
+
+	if !isDigits(parts[0]) {
+		if isDigits(parts[1]) {
+			err = fmt.Errorf("CSeq field has its method before its sequence number: '%s'", headerText)
+		} else {
+			err = fmt.Errorf("CSeq sequence number '%s' is not a decimal number", parts[0])
+		}
+		return
+	}
+
+	var seqno uint64
+	seqno, err = strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		err = fmt.Errorf("CSeq sequence number '%s' overflows 32 bits", parts[0])
+		return
+	}
+
+	if seqno > MAX_CSEQ {
+		err = fmt.Errorf("invalid CSeq %d: exceeds maximum permitted value "+
+			"2**31 - 1", seqno)
+		return
+	}
+
+	cseq.SeqNo = uint32(seqno)
+	cseq.MethodName = base.Method(parts[1])
+
+	for idx := 0; idx < len(parts[1]); idx++ {
+		if !base.IsTokenChar(parts[1][idx]) {
+			err = fmt.Errorf("CSeq method '%s' is not a token: %s", parts[1], headerText)
+			return
+		}
+	}
+
+	headers = []base.SipHeader{&cseq}
+
+	return
+}
+
+// Determine if the given string is a non-empty run of decimal digits.
+func isDigits(text string) bool {
+	if len(text) == 0 {
+		return false
+	}
+	for idx := 0; idx < len(text); idx++ {
+		if text[idx] < '0' || text[idx] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse a string representation of a Call-Id header, returning a slice of at most one CallId.
+func parseCallId(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	headerText = strings.TrimSpace(headerText)
+	var callId base.CallId = base.CallId(headerText)
+
+	if strings.ContainsAny(string(callId), c_ABNF_WS) {
+		err = fmt.Errorf("unexpected whitespace in CallId header body '%s'", headerText)
+		return
+	}
+	if strings.Contains(string(callId), ";") {
+		err = fmt.Errorf("unexpected semicolon in CallId header body '%s'", headerText)
+		return
+	}
+	if len(string(callId)) == 0 {
+		err = fmt.Errorf("empty Call-Id body")
+		return
+	}
+
+	headers = []base.SipHeader{&callId}
+
+	return
+}
+
+// Parse a string representation of a Via header, returning a slice of at most one ViaHeader.
+// Note that although Via headers may contain a comma-separated list, RFC 3261 makes it clear that
+// these should not be treated as separate logical Via headers, but as multiple values on a single
+// Via header.
+func parseViaHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	sections := strings.Split(headerText, ",")
+	var via base.ViaHeader = base.ViaHeader{}
+	for _, section := range sections {
+		var hop base.ViaHop
+		parts := strings.Split(section, "/")
+
+		if len(parts) < 3 {
+			err = fmt.Errorf("not enough protocol parts in via header: '%s'",
+				parts)
+			return
+		}
+
+		parts[2] = strings.Join(parts[2:], "/")
+
+		// The transport part ends when whitespace is reached, but may also start with
+		// whitespace.
+		// So the end of the transport part is the first whitespace char following the
+		// first non-whitespace char.
+		initialSpaces := len(parts[2]) - len(strings.TrimLeft(parts[2], c_ABNF_WS))
+		sentByIdx := strings.IndexAny(parts[2][initialSpaces:], c_ABNF_WS) + initialSpaces + 1
+		if sentByIdx == 0 {
+			err = fmt.Errorf("no sent-by address after sent-protocol part "+
+				"in via header '%s'", section)
+			return
+		} else if sentByIdx == 1 {
+			err = fmt.Errorf("empty transport field in via header '%s'", section)
+			return
+		}
+
+		hop.ProtocolName = strings.TrimSpace(parts[0])
+		hop.ProtocolVersion = strings.TrimSpace(parts[1])
+		hop.Transport = strings.TrimSpace(parts[2][:sentByIdx-1])
+
+		if len(hop.ProtocolName) == 0 {
+			err = fmt.Errorf("no protocol name provided in via header '%s'", section)
+		} else if len(hop.ProtocolVersion) == 0 {
+			err = fmt.Errorf("no version provided in via header '%s'", section)
+		} else if len(hop.Transport) == 0 {
+			err = fmt.Errorf("no transport provided in via header '%s'", section)
+		}
+		if err != nil {
+			return
+		}
+		if !strings.EqualFold(hop.ProtocolName, "SIP") || hop.ProtocolVersion != "2.0" {
+			// RFC 3261 only defines SIP/2.0, but unless the parser is strict, we're lenient; see checkStrict.
+			log.Fine("Tolerated non-standard sent-protocol %s/%s in via header '%s'",
+				hop.ProtocolName, hop.ProtocolVersion, section)
+		}
+
+		viaBody := parts[2][sentByIdx:]
+
+		paramsIdx := strings.Index(viaBody, ";")
+		if paramsIdx == -1 {
+			// There are no header parameters, so the rest of the Via body is part of the host[:post].
+			paramsIdx = len(viaBody)
+		}
+		hop.Host, hop.Port, err = parseHostPort(strings.TrimSpace(viaBody[:paramsIdx]))
+		if err != nil {
+			err = fmt.Errorf("bad sent-by address in via header '%s': %s", section, err.Error())
+			return
+		} else if len(hop.Host) == 0 {
+			err = fmt.Errorf("no host in sent-by address of via header '%s'", section)
+			return
+		}
 
-			hop.Params, _, err = parseParams(viaBody[paramsIdx:],
+		hop.Params = base.Params{}
+		if paramsIdx < len(viaBody) {
+			// The params include branch, received, rport, ttl, maddr and comp (RFC 3261 s. 20.42, RFC 3581,
+			// RFC 3486), which are read through the typed accessors on ViaHop.
+			hop.Params, _, err = base.ParseParams(viaBody[paramsIdx:],
 				';', ';', 0, true, true)
+			if err != nil {
+				return
+			}
+			for name, value := range hop.Params {
+				if name == "" || (value != nil && *value == "") {
+					err = fmt.Errorf("empty param in via header '%s'", section)
+					return
+				}
+			}
 		}
 		via = append(via, &hop)
 	}
@@ -972,6 +1481,49 @@ func parseViaHeader(headerName string, headerText string) (
 	return
 }
 
+// Parse a string representation of an Expires header into a slice of at most one Expires header object.
+func parseExpires(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	var expires base.Expires
+	var value uint32
+	value, err = base.ParseDeltaSeconds(strings.TrimSpace(headerText))
+	expires = base.Expires(value)
+
+	headers = []base.SipHeader{&expires}
+	return
+}
+
+// Parse a string representation of an RSeq header into a slice of at most one RSeq header object.
+// The number must be between 1 and 2**31 - 1 (RFC 3262 s. 7.1).
+func parseRSeq(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	var rseq base.RSeq
+	var value uint64
+	value, err = strconv.ParseUint(strings.TrimSpace(headerText), 10, 32)
+	if err != nil {
+		return
+	} else if value == 0 || value > MAX_RSEQ {
+		err = fmt.Errorf("RSeq %d is out of range in %s: header: %s", value, headerName, headerText)
+		return
+	}
+	rseq = base.RSeq(value)
+
+	headers = []base.SipHeader{&rseq}
+	return
+}
+
+// Parse a string representation of a Min-Expires header into a slice of at most one MinExpires header object.
+func parseMinExpires(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	var minExpires base.MinExpires
+	var value uint32
+	value, err = base.ParseDeltaSeconds(strings.TrimSpace(headerText))
+	minExpires = base.MinExpires(value)
+
+	headers = []base.SipHeader{&minExpires}
+	return
+}
+
 // Parse a string representation of a Max-Forwards header into a slice of at most one MaxForwards header object.
 func parseMaxForwards(headerName string, headerText string) (
 	headers []base.SipHeader, err error) {
@@ -996,248 +1548,1013 @@ func parseContentLength(headerName string, headerText string) (
 	return
 }
 
-// parseAddressValues parses a comma-separated list of addresses, returning
-// any display names and header params, as well as the SIP URIs themselves.
-// parseAddressValues is aware of < > bracketing and quoting, and will not
-// break on commas within these structures.
-func parseAddressValues(addresses string) (
-	displayNames []*string, uris []base.Uri,
-	headerParams []map[string]*string,
-	err error) {
+// Parse a string representation of a Content-Type header into a slice of at most one ContentType header object.
+func parseContentType(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	headerText = strings.TrimSpace(headerText)
+	if len(headerText) == 0 {
+		err = fmt.Errorf("empty Content-Type body")
+		return
+	}
 
-	prevIdx := 0
-	inBrackets := false
-	inQuotes := false
+	contentType := base.ContentType(headerText)
+	headers = []base.SipHeader{&contentType}
+	return
+}
 
-	// Append a comma to simplify the parsing code; we split address sections
-	// on commas, so use a comma to signify the end of the final address section.
-	addresses = addresses + ","
+// Parse a string representation of a Content-Disposition header into a slice of at most one header object.
+func parseContentDisposition(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	headerText = strings.TrimSpace(headerText)
+	paramsIdx := strings.Index(headerText, ";")
+	if paramsIdx == -1 {
+		paramsIdx = len(headerText)
+	}
 
-	for idx, char := range addresses {
-		if char == '<' && !inQuotes {
-			inBrackets = true
-		} else if char == '>' && !inQuotes {
-			inBrackets = false
-		} else if char == '"' {
-			inQuotes = !inQuotes
-		} else if !inQuotes && !inBrackets && char == ',' {
-			var displayName *string
-			var uri base.Uri
-			var params map[string]*string
-			displayName, uri, params, err =
-				parseAddressValue(addresses[prevIdx:idx])
-			if err != nil {
-				return
-			}
-			prevIdx = idx + 1
+	disposition := base.ContentDispositionHeader{strings.TrimSpace(headerText[:paramsIdx]), base.Params{}}
+	if len(disposition.DispositionType) == 0 {
+		err = fmt.Errorf("no disposition type in Content-Disposition: '%s'", headerText)
+		return
+	}
+	if paramsIdx < len(headerText) {
+		disposition.Params, _, err = base.ParseParams(headerText[paramsIdx:], ';', ';', 0, true, true)
+		if err != nil {
+			return
+		}
+	}
+
+	headers = []base.SipHeader{&disposition}
+	return
+}
+
+// Parse a string representation of a Content-ID header into a slice of at most one header object.
+// The id is normally enclosed in angle brackets (RFC 2045 s. 7), but a bare id is also accepted.
+func parseContentId(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	headerText = strings.TrimSpace(headerText)
+	if strings.HasPrefix(headerText, "<") != strings.HasSuffix(headerText, ">") {
+		err = fmt.Errorf("unbalanced angle brackets in Content-ID: '%s'", headerText)
+		return
+	}
+
+	contentId := base.NewContentIDHeader(headerText)
+	if len(contentId.Id) == 0 || strings.ContainsAny(contentId.Id, "<> \t") {
+		err = fmt.Errorf("invalid Content-ID: '%s'", headerText)
+		return
+	}
+
+	headers = []base.SipHeader{contentId}
+	return
+}
+
+// Parse a multipart body (RFC 2046 s. 5.1), such as a multipart/mixed body carrying SDP alongside another
+// payload, into its parts. The given Content-Type must be a multipart type with a 'boundary' param.
+// The headers of each part are parsed as those of a SIP message are, and its Content-Type,
+// Content-Disposition and Content-ID are picked out; any preamble and epilogue are discarded.
+func ParseMultipart(contentType base.ContentType, body string) (parts []base.BodyPart, err error) {
+	if !strings.HasPrefix(contentType.MediaType(), "multipart/") {
+		err = fmt.Errorf("'%s' is not a multipart content type", string(contentType))
+		return
+	}
+
+	var params base.Params
+	if paramsIdx := strings.Index(string(contentType), ";"); paramsIdx != -1 {
+		params, _, err = base.ParseParams(string(contentType)[paramsIdx:], ';', ';', 0, true, true)
+		if err != nil {
+			return
+		}
+	}
+	boundary, ok := params["boundary"]
+	if !ok || boundary == nil || len(*boundary) == 0 {
+		err = fmt.Errorf("no boundary in multipart content type '%s'", string(contentType))
+		return
+	}
+
+	// Each delimiter is a line of its own, so is preceded by a CRLF unless it starts the body;
+	// the CRLF is part of the delimiter rather than of the preceding part.
+	delimiter := "\r\n--" + *boundary
+	body = "\r\n" + body
+	idx := strings.Index(body, delimiter)
+	if idx == -1 {
+		err = fmt.Errorf("no '--%s' delimiter in multipart body", *boundary)
+		return
+	}
+	rest := body[idx+len(delimiter):]
+
+	for !strings.HasPrefix(rest, "--") {
+		// The delimiter may be followed by whitespace before the end of its line.
+		lineEnd := strings.Index(rest, "\r\n")
+		if lineEnd == -1 || len(strings.Trim(rest[:lineEnd], c_ABNF_WS)) != 0 {
+			err = fmt.Errorf("malformed '--%s' delimiter line in multipart body", *boundary)
+			return
+		}
+		rest = rest[lineEnd+2:]
+
+		end := strings.Index(rest, delimiter)
+		if end == -1 {
+			err = fmt.Errorf("no closing '--%s--' delimiter in multipart body", *boundary)
+			return
+		}
+
+		var part base.BodyPart
+		part, err = parseBodyPart(rest[:end])
+		if err != nil {
+			return
+		}
+		parts = append(parts, part)
+		rest = rest[end+len(delimiter):]
+	}
+
+	return
+}
+
+// Parse a single part of a multipart body: a block of headers, a blank line, and the content.
+// The block of headers may be empty, in which case the part starts with the blank line.
+func parseBodyPart(text string) (part base.BodyPart, err error) {
+	var headerText string
+	if strings.HasPrefix(text, "\r\n") {
+		part.Content = []byte(text[2:])
+	} else if headerEnd := strings.Index(text, "\r\n\r\n"); headerEnd != -1 {
+		headerText = text[:headerEnd]
+		part.Content = []byte(text[headerEnd+4:])
+	} else {
+		err = fmt.Errorf("no blank line at end of headers in body part '%s'", text)
+		return
+	}
+
+	// Unfold the headers as in a SIP message, so that each is on a single line (RFC 3261 s. 7.3.1).
+	lines := []string{}
+	for _, line := range strings.Split(headerText, "\r\n") {
+		if len(line) > 0 && strings.IndexByte(c_ABNF_WS, line[0]) != -1 && len(lines) > 0 {
+			lines[len(lines)-1] += " " + strings.TrimLeft(line, c_ABNF_WS)
+		} else if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+
+	headerParsers := defaultHeaderParsers()
+	for _, line := range lines {
+		colonIdx := strings.Index(line, ":")
+		if colonIdx == -1 {
+			err = fmt.Errorf("field name with no value in body part header: %s", line)
+			return
+		}
+		fieldName := strings.ToLower(strings.TrimSpace(line[:colonIdx]))
+		fieldText := collapseWhitespace(strings.TrimSpace(line[colonIdx+1:]))
+
+		var headers []base.SipHeader
+		headers, err = parseHeaderValue(headerParsers, fieldName, fieldText)
+		if err != nil {
+			return
+		}
+		for _, header := range headers {
+			switch header := header.(type) {
+			case *base.ContentType:
+				part.ContentType = header
+			case *base.ContentDispositionHeader:
+				part.ContentDisposition = header
+			case *base.ContentIDHeader:
+				part.ContentId = header
+			}
+		}
+		part.Headers = append(part.Headers, headers...)
+	}
+
+	return
+}
+
+// parseAddressValues parses a comma-separated list of addresses, returning
+// any display names and header params, as well as the SIP URIs themselves.
+// parseAddressValues is aware of < > bracketing and quoting, and will not
+// break on commas within these structures.
+func parseAddressValues(addresses string) (
+	displayNames []*string, uris []base.Uri,
+	headerParams []map[string]*string,
+	err error) {
+
+	prevIdx := 0
+	inBrackets := false
+	inQuotes := false
+
+	// Append a comma to simplify the parsing code; we split address sections
+	// on commas, so use a comma to signify the end of the final address section.
+	addresses = addresses + ","
+
+	escaped := false
+	for idx, char := range addresses {
+		if escaped {
+			// The character after a backslash in a quoted string is taken literally.
+			escaped = false
+		} else if char == '\\' && inQuotes {
+			escaped = true
+		} else if char == '<' && !inQuotes {
+			inBrackets = true
+		} else if char == '>' && !inQuotes {
+			inBrackets = false
+		} else if char == '"' {
+			inQuotes = !inQuotes
+		} else if !inQuotes && !inBrackets && char == ',' {
+			var displayName *string
+			var uri base.Uri
+			var params map[string]*string
+			displayName, uri, params, err =
+				parseAddressValue(addresses[prevIdx:idx])
+			if err != nil {
+				return
+			}
+			prevIdx = idx + 1
+
+			displayNames = append(displayNames, displayName)
+			uris = append(uris, uri)
+			headerParams = append(headerParams, params)
+		}
+	}
+
+	if inQuotes {
+		err = fmt.Errorf("unclosed quotes in address list: %s", addresses[:len(addresses)-1])
+	}
+
+	return
+}
+
+// parseAddressValue parses an address - such as from a From, To, or
+// Contact header. It returns:
+//   - a pointer to the display name (or nil if there was none present)
+//   - a parsed SipUri object
+//   - a map containing any header parameters present
+//   - the error object
+// See RFC 3261 section 20.10 for details on parsing an address.
+// Note that this method will not accept a comma-separated list of addresses;
+// addresses in that form should be handled by parseAddressValues.
+func parseAddressValue(addressText string) (
+	displayName *string, uri base.Uri,
+	headerParams map[string]*string,
+	err error) {
+
+	if len(addressText) == 0 {
+		err = fmt.Errorf("address-type header has empty body")
+		return
+	}
+
+	addressTextCopy := addressText
+	addressText = strings.TrimSpace(addressText)
+
+	firstAngleBracket := findUnescaped(addressText, '<', quotes_delim)
+	firstSpace := findAnyUnescaped(addressText, c_ABNF_WS, quotes_delim, angles_delim)
+	if firstAngleBracket != -1 && firstSpace != -1 &&
+		firstSpace < firstAngleBracket {
+		// There is a display name present. Let's parse it.
+		if addressText[0] == '"' {
+			// The display name is within quotations.
+			// It may contain UTF-8 text and backslash-escaped characters.
+			addressText = addressText[1:]
+			var nameBuffer bytes.Buffer
+			nextQuote := -1
+			for idx := 0; idx < len(addressText); idx++ {
+				if addressText[idx] == '\\' && idx+1 < len(addressText) {
+					idx++
+				} else if addressText[idx] == '"' {
+					nextQuote = idx
+					break
+				}
+				nameBuffer.WriteByte(addressText[idx])
+			}
+
+			if nextQuote == -1 {
+				// Unclosed quotes - parse error.
+				err = fmt.Errorf("Unclosed quotes in header text: %s",
+					addressTextCopy)
+				return
+			}
+
+			nameField := nameBuffer.String()
+			displayName = &nameField
+			addressText = addressText[nextQuote+1:]
+		} else {
+			// The display name is unquoted, so match until the next whitespace
+			// character.
+			nameField := addressText[:firstSpace]
+			displayName = &nameField
+			addressText = addressText[firstSpace+1:]
+		}
+	}
+
+	// Work out where the SIP URI starts and ends.
+	addressText = strings.TrimSpace(addressText)
+	var endOfUri int
+	var startOfParams int
+	bracketed := addressText[0] == '<'
+	if !bracketed {
+		if displayName != nil {
+			// The address must be in <angle brackets> if a display name is
+			// present, so this is an invalid address line.
+			err = fmt.Errorf("Invalid character '%c' following display "+
+				"name in address line; expected '<': %s",
+				addressText[0], addressTextCopy)
+			return
+		}
+
+		endOfUri = strings.Index(addressText, ";")
+		if endOfUri == -1 {
+			endOfUri = len(addressText)
+		}
+		startOfParams = endOfUri
+
+	} else {
+		addressText = addressText[1:]
+		endOfUri = strings.Index(addressText, ">")
+		if endOfUri == 0 {
+			err = fmt.Errorf("'<' without closing '>' in address %s",
+				addressTextCopy)
+			return
+		}
+		startOfParams = endOfUri + 1
+
+	}
+
+	// Now parse the URI. A URI in angle brackets may have any scheme; those gossip doesn't understand are kept
+	// as they are, so that headers containing them can be relayed.
+	uriText := addressText[:endOfUri]
+	if bracketed && !isSipScheme(uriText) {
+		uri, err = parseAbsoluteUri(uriText)
+	} else {
+		uri, err = ParseUri(uriText)
+	}
+	if err != nil {
+		return
+	}
+
+	if startOfParams >= len(addressText) {
+		return
+	}
+
+	// Finally, parse any header parameters and then return.
+	addressText = addressText[startOfParams:]
+	headerParams, _, err = base.ParseParams(addressText, ';', ';', ',', true, true)
+	return
+}
+
+// Extract the next logical header line from the message.
+// This may run over several actual lines; lines that start with whitespace are
+// a continuation of the previous line.
+// Therefore also return how many lines we consumed so the parent parser can
+// keep track of progress through the message.
+func getNextHeaderLine(contents []string) (headerText string, consumed int) {
+	if len(contents) == 0 {
+		return
+	}
+	if len(contents[0]) == 0 {
+		return
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(contents[0])
+
+	for consumed = 1; consumed < len(contents); consumed++ {
+		firstChar, _ := utf8.DecodeRuneInString(contents[consumed])
+		if !unicode.IsSpace(firstChar) {
+			break
+		} else if len(contents[consumed]) == 0 {
+			break
+		}
+
+		buffer.WriteString(" " + strings.TrimSpace(contents[consumed]))
+	}
+
+	headerText = buffer.String()
+	return
+}
+
+// A delimiter is any pair of characters used for quoting text (i.e. bulk escaping literals).
+type delimiter struct {
+	start uint8
+	end   uint8
+}
+
+// Define common quote characters needed in parsing.
+var quotes_delim = delimiter{'"', '"'}
+var angles_delim = delimiter{'<', '>'}
+
+// Find the first instance of the target in the given text which is not enclosed in any delimiters
+// from the list provided.
+func findUnescaped(text string, target uint8, delims ...delimiter) int {
+	return findAnyUnescaped(text, string(target), delims...)
+}
+
+// Find the first instance of any of the targets in the given text that are not enclosed in any delimiters
+// from the list provided.
+func findAnyUnescaped(text string, targets string, delims ...delimiter) int {
+	escaped := false
+	var endEscape uint8 = 0
+
+	// This is called on every address, so it makes a single pass over the text with no allocations.
+	for idx := 0; idx < len(text); idx++ {
+		if !escaped && strings.IndexByte(targets, text[idx]) != -1 {
+			return idx
+		}
+
+		if escaped {
+			if endEscape == '"' && text[idx] == '\\' {
+				// Skip over a quoted-pair, so that an escaped quote doesn't end the string.
+				idx++
+				continue
+			}
+			escaped = (text[idx] != endEscape)
+			continue
+		} else {
+			for _, delim := range delims {
+				if text[idx] == delim.start {
+					endEscape, escaped = delim.end, true
+					break
+				}
+			}
+		}
+	}
+
+	return -1
+}
+
+// Replace each run of characters from c_ABNF_WS in the given text with a single space,
+// except within quoted strings, where whitespace is significant.
+func collapseWhitespace(text string) string {
+	var buffer bytes.Buffer
+	inQuotes := false
+	inWhitespace := false
+
+	for idx := 0; idx < len(text); idx++ {
+		char := text[idx]
+		if !inQuotes && strings.IndexByte(c_ABNF_WS, char) != -1 {
+			if !inWhitespace {
+				buffer.WriteByte(' ')
+			}
+			inWhitespace = true
+			continue
+		}
+
+		inWhitespace = false
+		if char == '"' {
+			inQuotes = !inQuotes
+		} else if char == '\\' && inQuotes && idx+1 < len(text) {
+			// A quoted-pair; copy the escaped character verbatim.
+			buffer.WriteByte(char)
+			idx++
+			char = text[idx]
+		}
+		buffer.WriteByte(char)
+	}
+
+	return buffer.String()
+}
+
+// Splits the given string into sections, separated by one or more characters
+// from c_ABNF_WS.
+func splitByWhitespace(text string) []string {
+	var buffer bytes.Buffer
+	var inString bool = true
+	result := make([]string, 0)
+
+	for _, char := range text {
+		s := string(char)
+		if strings.Contains(c_ABNF_WS, s) {
+			if inString {
+				// First whitespace char following text; flush buffer to the results array.
+				result = append(result, buffer.String())
+				buffer.Reset()
+			}
+			inString = false
+		} else {
+			buffer.WriteString(s)
+			inString = true
+		}
+	}
+
+	if buffer.Len() > 0 {
+		result = append(result, buffer.String())
+	}
+
+	return result
+}
+
+// Parse a Join header, which references a dialog by its Call-ID and tags.
+func parseJoinHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	var join base.JoinHeader
+	join.DialogReference, err = parseDialogReference(headerText)
+	if err != nil {
+		return
+	}
+
+	headers = []base.SipHeader{&join}
+	return
+}
+
+// Parse a Replaces header, which references the dialog to be replaced by its Call-ID and tags (RFC 3891).
+func parseReplacesHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	var replaces base.ReplacesHeader
+	replaces.DialogReference, err = parseDialogReference(headerText)
+	if err != nil {
+		return
+	}
+
+	headers = []base.SipHeader{&replaces}
+	return
+}
+
+// Parse a Target-Dialog header, which identifies a dialog by its Call-ID and its local and remote tags
+// (RFC 4538).
+func parseTargetDialogHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	var targetDialog base.TargetDialogHeader
+	targetDialog.CallId, targetDialog.LocalTag, targetDialog.RemoteTag, targetDialog.Params, err =
+		parseDialogId(headerText, "local-tag", "remote-tag")
+	if err != nil {
+		return
+	}
+
+	headers = []base.SipHeader{&targetDialog}
+	return
+}
+
+// Parse the body of a header which references a dialog, e.g. 'Join: callid;to-tag=x;from-tag=y'.
+// The to-tag and from-tag params are mandatory, and are removed from the params of the result.
+func parseDialogReference(headerText string) (ref base.DialogReference, err error) {
+	ref.CallId, ref.ToTag, ref.FromTag, ref.Params, err = parseDialogId(headerText, "to-tag", "from-tag")
+	return
+}
+
+// Parse the body of a header which identifies a dialog by its Call-ID, followed by params including its two tags
+// under the given names. Both tags are mandatory, and are removed from the params returned.
+func parseDialogId(headerText string, firstTagName string, secondTagName string) (
+	callId base.CallId, firstTag string, secondTag string, params base.Params, err error) {
+	headerText = strings.TrimSpace(headerText)
+	paramsIdx := strings.Index(headerText, ";")
+	if paramsIdx == -1 {
+		err = fmt.Errorf("no tags in dialog reference '%s'", headerText)
+		return
+	}
+
+	callIdText := strings.TrimSpace(headerText[:paramsIdx])
+	if len(callIdText) == 0 || strings.ContainsAny(callIdText, c_ABNF_WS) {
+		err = fmt.Errorf("invalid call-id '%s' in dialog reference '%s'", callIdText, headerText)
+		return
+	}
+	callId = base.CallId(callIdText)
+
+	params, _, err = base.ParseParams(headerText[paramsIdx:], ';', ';', 0, true, true)
+	if err != nil {
+		return
+	}
+
+	first, ok := params[firstTagName]
+	if !ok || first == nil {
+		err = fmt.Errorf("missing %s in dialog reference '%s'", firstTagName, headerText)
+		return
+	}
+	second, ok := params[secondTagName]
+	if !ok || second == nil {
+		err = fmt.Errorf("missing %s in dialog reference '%s'", secondTagName, headerText)
+		return
+	}
+
+	firstTag = *first
+	secondTag = *second
+	delete(params, firstTagName)
+	delete(params, secondTagName)
+	return
+}
 
-			displayNames = append(displayNames, displayName)
-			uris = append(uris, uri)
-			headerParams = append(headerParams, params)
+// Parse a History-Info header, which is a list of name-addrs each carrying an 'index' param.
+func parseHistoryInfoHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	var displayNames []*string
+	var uris []base.Uri
+	var paramSets []map[string]*string
+	displayNames, uris, paramSets, err = parseAddressValues(headerText)
+	if err != nil {
+		return
+	}
+
+	var historyInfo base.HistoryInfoHeader
+	for idx, uri := range uris {
+		if _, ok := uri.(base.WildcardUri); ok {
+			err = fmt.Errorf("wildcard uri not permitted in %s: header: %s", headerName, headerText)
+			return
+		}
+
+		params := base.Params(paramSets[idx])
+		index, ok := params["index"]
+		if !ok || index == nil || !isHistoryIndex(*index) {
+			err = fmt.Errorf("missing or invalid index in %s: header: %s", headerName, headerText)
+			return
 		}
+		delete(params, "index")
+
+		historyInfo.Entries = append(historyInfo.Entries,
+			&base.HistoryInfoEntry{displayNames[idx], uri, *index, params})
 	}
 
+	headers = []base.SipHeader{&historyInfo}
 	return
 }
 
-// parseAddressValue parses an address - such as from a From, To, or
-// Contact header. It returns:
-//   - a pointer to the display name (or nil if there was none present)
-//   - a parsed SipUri object
-//   - a map containing any header parameters present
-//   - the error object
-// See RFC 3261 section 20.10 for details on parsing an address.
-// Note that this method will not accept a comma-separated list of addresses;
-// addresses in that form should be handled by parseAddressValues.
-func parseAddressValue(addressText string) (
-	displayName *string, uri base.Uri,
-	headerParams map[string]*string,
-	err error) {
+// Determine if the given string is a valid History-Info index; i.e. one or more dot-separated integers.
+func isHistoryIndex(index string) bool {
+	for _, part := range strings.Split(index, ".") {
+		if len(part) == 0 || strings.Trim(part, "0123456789") != "" {
+			return false
+		}
+	}
+	return true
+}
 
-	if len(addressText) == 0 {
-		err = fmt.Errorf("address-type header has empty body")
+// Parse a Diversion header, which is a list of name-addrs with params.
+func parseDiversionHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	var displayNames []*string
+	var uris []base.Uri
+	var paramSets []map[string]*string
+	displayNames, uris, paramSets, err = parseAddressValues(headerText)
+	if err != nil {
 		return
 	}
 
-	addressTextCopy := addressText
-	addressText = strings.TrimSpace(addressText)
+	var diversion base.DiversionHeader
+	for idx, uri := range uris {
+		if _, ok := uri.(base.WildcardUri); ok {
+			err = fmt.Errorf("wildcard uri not permitted in %s: header: %s", headerName, headerText)
+			return
+		}
+		diversion.Entries = append(diversion.Entries,
+			&base.DiversionEntry{displayNames[idx], uri, paramSets[idx]})
+	}
 
-	firstAngleBracket := findUnescaped(addressText, '<', quotes_delim)
-	firstSpace := findAnyUnescaped(addressText, c_ABNF_WS, quotes_delim, angles_delim)
-	if firstAngleBracket != -1 && firstSpace != -1 &&
-		firstSpace < firstAngleBracket {
-		// There is a display name present. Let's parse it.
-		if addressText[0] == '"' {
-			// The display name is within quotations.
-			addressText = addressText[1:]
-			nextQuote := strings.Index(addressText, "\"")
+	headers = []base.SipHeader{&diversion}
+	return
+}
 
-			if nextQuote == -1 {
-				// Unclosed quotes - parse error.
-				err = fmt.Errorf("Unclosed quotes in header text: %s",
-					addressTextCopy)
-				return
-			}
+// Parse a Call-Info header, which is a comma-separated list of entries, each consisting of an absolute URI
+// in angle brackets followed by optional params.
+func parseCallInfoHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	var callInfo base.CallInfoHeader
+	for len(strings.TrimSpace(headerText)) > 0 {
+		entryText := headerText
+		headerText = ""
+		if commaIdx := findUnescaped(entryText, ',', quotes_delim, angles_delim); commaIdx != -1 {
+			entryText, headerText = entryText[:commaIdx], entryText[commaIdx+1:]
+		}
 
-			nameField := addressText[:nextQuote]
-			displayName = &nameField
-			addressText = addressText[nextQuote+1:]
-		} else {
-			// The display name is unquoted, so match until the next whitespace
-			// character.
-			nameField := addressText[:firstSpace]
-			displayName = &nameField
-			addressText = addressText[firstSpace+1:]
+		entryText = strings.TrimSpace(entryText)
+		endIdx := strings.Index(entryText, ">")
+		if !strings.HasPrefix(entryText, "<") || endIdx == -1 {
+			err = fmt.Errorf("expected a URI in angle brackets in %s: header: %s", headerName, entryText)
+			return
+		}
+
+		entry := base.CallInfoEntry{Address: entryText[1:endIdx]}
+		entry.Params, _, err = base.ParseParams(strings.TrimSpace(entryText[endIdx+1:]), ';', ';', 0, true, true)
+		if err != nil {
+			return
 		}
+		callInfo.Entries = append(callInfo.Entries, &entry)
 	}
 
-	// Work out where the SIP URI starts and ends.
-	addressText = strings.TrimSpace(addressText)
-	var endOfUri int
-	var startOfParams int
-	if addressText[0] != '<' {
-		if displayName != nil {
-			// The address must be in <angle brackets> if a display name is
-			// present, so this is an invalid address line.
-			err = fmt.Errorf("Invalid character '%c' following display "+
-				"name in address line; expected '<': %s",
-				addressText[0], addressTextCopy)
+	if len(callInfo.Entries) == 0 {
+		err = fmt.Errorf("empty %s: header", headerName)
+		return
+	}
+
+	headers = []base.SipHeader{&callInfo}
+	return
+}
+
+// Parse a Recv-Info header, which is a comma-separated list of INFO package names and may be empty.
+func parseRecvInfoHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	recvInfo := base.RecvInfoHeader{splitList(headerText)}
+	for _, pkg := range recvInfo.Packages {
+		if strings.ContainsAny(pkg, c_ABNF_WS) {
+			err = fmt.Errorf("invalid package name '%s' in %s: header: %s", pkg, headerName, headerText)
 			return
 		}
+	}
 
-		endOfUri = strings.Index(addressText, ";")
-		if endOfUri == -1 {
-			endOfUri = len(addressText)
+	headers = []base.SipHeader{&recvInfo}
+	return
+}
+
+// Parse an Info-Package header, which is a single INFO package name with optional params.
+func parseInfoPackageHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	var infoPackage base.InfoPackageHeader
+	headerText = strings.TrimSpace(headerText)
+	paramsIdx := strings.Index(headerText, ";")
+	if paramsIdx == -1 {
+		infoPackage.Package = headerText
+		infoPackage.Params = base.Params{}
+	} else {
+		infoPackage.Package = strings.TrimSpace(headerText[:paramsIdx])
+		infoPackage.Params, _, err = base.ParseParams(headerText[paramsIdx:], ';', ';', 0, true, true)
+		if err != nil {
+			return
 		}
-		startOfParams = endOfUri
+	}
+
+	if len(infoPackage.Package) == 0 || strings.ContainsAny(infoPackage.Package, c_ABNF_WS+",") {
+		err = fmt.Errorf("invalid package name in %s: header: %s", headerName, headerText)
+		return
+	}
+
+	headers = []base.SipHeader{&infoPackage}
+	return
+}
 
+// Parse a Subscription-State header, which is a substate value with optional params.
+func parseSubscriptionStateHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	var subscriptionState base.SubscriptionStateHeader
+	headerText = strings.TrimSpace(headerText)
+	paramsIdx := strings.Index(headerText, ";")
+	if paramsIdx == -1 {
+		subscriptionState.State = headerText
+		subscriptionState.Params = base.Params{}
 	} else {
-		addressText = addressText[1:]
-		endOfUri = strings.Index(addressText, ">")
-		if endOfUri == 0 {
-			err = fmt.Errorf("'<' without closing '>' in address %s",
-				addressTextCopy)
+		subscriptionState.State = strings.TrimSpace(headerText[:paramsIdx])
+		subscriptionState.Params, _, err = base.ParseParams(headerText[paramsIdx:], ';', ';', 0, true, true)
+		if err != nil {
 			return
 		}
-		startOfParams = endOfUri + 1
+	}
 
+	if len(subscriptionState.State) == 0 || strings.ContainsAny(subscriptionState.State, c_ABNF_WS+",") {
+		err = fmt.Errorf("invalid substate in %s: header: %s", headerName, headerText)
+		return
 	}
 
-	// Now parse the SIP URI.
-	uri, err = ParseUri(addressText[:endOfUri])
+	headers = []base.SipHeader{&subscriptionState}
+	return
+}
+
+// Parse an Authentication-Info header, which is a comma-separated list of directives (RFC 2617 s. 3.2.3).
+func parseAuthenticationInfoHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	var directives base.Params
+	directives, err = parseDirectives(headerName, headerText)
 	if err != nil {
 		return
 	}
 
-	if startOfParams >= len(addressText) {
+	headers = []base.SipHeader{&base.AuthenticationInfoHeader{directives}}
+	return
+}
+
+// Parse a WWW-Authenticate, Proxy-Authenticate, Authorization or Proxy-Authorization header, which is an
+// authentication scheme followed by a comma-separated list of directives. A WWW-Authenticate or
+// Proxy-Authenticate header may carry several challenges, one after another, each beginning with its scheme,
+// and a header is produced for each of them.
+func parseAuthorizationHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	challenges := splitChallenges(headerText)
+	if len(challenges) > 1 && (headerName == "authorization" || headerName == "proxy-authorization") {
+		err = fmt.Errorf("more than one set of credentials in %s: header: %s", headerName, headerText)
 		return
 	}
 
-	// Finally, parse any header parameters and then return.
-	addressText = addressText[startOfParams:]
-	headerParams, _, err = parseParams(addressText, ';', ';', ',', true, true)
+	for _, challenge := range challenges {
+		challenge = strings.TrimSpace(challenge)
+		schemeEnd := strings.IndexAny(challenge, c_ABNF_WS)
+		if schemeEnd == -1 {
+			err = fmt.Errorf("no directives after the authentication scheme in %s: header: %s", headerName, challenge)
+			return
+		}
+
+		scheme := challenge[:schemeEnd]
+		var directives base.Params
+		directives, err = parseDirectives(headerName, challenge[schemeEnd:])
+		if err != nil {
+			return
+		}
+
+		switch headerName {
+		case "www-authenticate":
+			headers = append(headers, &base.WWWAuthenticateHeader{scheme, directives})
+		case "authorization":
+			headers = append(headers, &base.AuthorizationHeader{scheme, directives})
+		case "proxy-authenticate":
+			headers = append(headers, &base.ProxyAuthenticateHeader{scheme, directives})
+		case "proxy-authorization":
+			headers = append(headers, &base.ProxyAuthorizationHeader{scheme, directives})
+		}
+	}
 	return
 }
 
-// Extract the next logical header line from the message.
-// This may run over several actual lines; lines that start with whitespace are
-// a continuation of the previous line.
-// Therefore also return how many lines we consumed so the parent parser can
-// keep track of progress through the message.
-func getNextHeaderLine(contents []string) (headerText string, consumed int) {
-	if len(contents) == 0 {
-		return
+// Split the text of an authentication header into its challenges. Each challenge starts with a scheme,
+// followed by whitespace and a directive, and runs up to the comma before the next one; commas also separate
+// the directives within a challenge, so a comma-separated element only starts a new challenge when it is of
+// the form 'scheme directive'. Commas within quoted strings are ignored.
+func splitChallenges(headerText string) []string {
+	challenges := []string{}
+	start := 0
+	for idx := 0; idx <= len(headerText); {
+		commaIdx := findUnescaped(headerText[idx:], ',', quotes_delim)
+		end := len(headerText)
+		if commaIdx != -1 {
+			end = idx + commaIdx
+		}
+
+		element := strings.TrimSpace(headerText[idx:end])
+		if idx > start && startsChallenge(element) {
+			challenges = append(challenges, headerText[start:idx-1])
+			start = idx
+		}
+		idx = end + 1
 	}
-	if len(contents[0]) == 0 {
+	return append(challenges, headerText[start:])
+}
+
+// Determine if the given element of an authentication header begins a new challenge: that is, if it is a
+// token followed by whitespace and something other than the '=' of a directive.
+func startsChallenge(element string) bool {
+	schemeEnd := strings.IndexAny(element, c_ABNF_WS)
+	if schemeEnd == -1 {
+		return false
+	}
+	rest := strings.TrimSpace(element[schemeEnd:])
+	return len(rest) > 0 && rest[0] != '=' && !strings.Contains(element[:schemeEnd], "=")
+}
+
+// Parse the comma-separated 'name=value' directives of an authentication header, removing the quotes from any
+// quoted values. Directive names are case-insensitive, so they are lower-cased.
+func parseDirectives(headerName string, headerText string) (directives base.Params, err error) {
+	if len(strings.TrimSpace(headerText)) == 0 {
+		err = fmt.Errorf("empty %s: header", headerName)
 		return
 	}
 
-	var buffer bytes.Buffer
-	buffer.WriteString(contents[0])
+	directives = make(base.Params)
+	for len(headerText) > 0 {
+		directiveText := headerText
+		headerText = ""
+		if commaIdx := findUnescaped(directiveText, ',', quotes_delim); commaIdx != -1 {
+			directiveText, headerText = directiveText[:commaIdx], directiveText[commaIdx+1:]
+		}
 
-	for consumed = 1; consumed < len(contents); consumed++ {
-		firstChar, _ := utf8.DecodeRuneInString(contents[consumed])
-		if !unicode.IsSpace(firstChar) {
-			break
-		} else if len(contents[consumed]) == 0 {
-			break
+		directiveText = strings.TrimSpace(directiveText)
+		if len(directiveText) == 0 {
+			continue
 		}
 
-		buffer.WriteString(" " + strings.TrimSpace(contents[consumed]))
+		var params base.Params
+		params, _, err = base.ParseParams(directiveText, 0, ',', 0, true, false)
+		if err != nil {
+			return
+		}
+		for key, value := range params {
+			key = strings.ToLower(key)
+			if _, ok := directives[key]; ok {
+				err = fmt.Errorf("repeated directive '%s' in %s: header", key, headerName)
+				return
+			}
+			directives[key] = value
+		}
 	}
-
-	headerText = buffer.String()
 	return
 }
 
-// A delimiter is any pair of characters used for quoting text (i.e. bulk escaping literals).
-type delimiter struct {
-	start uint8
-	end   uint8
+// Parse an Accept header, which is a comma-separated list of media ranges and may be empty.
+func parseAcceptHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	accept := base.AcceptHeader{splitList(headerText)}
+	for _, mediaRange := range accept.MediaRanges {
+		if !strings.Contains(strings.SplitN(mediaRange, ";", 2)[0], "/") {
+			err = fmt.Errorf("invalid media range '%s' in %s: header: %s", mediaRange, headerName, headerText)
+			return
+		}
+	}
+
+	headers = []base.SipHeader{&accept}
+	return
 }
 
-// Define common quote characters needed in parsing.
-var quotes_delim = delimiter{'"', '"'}
-var angles_delim = delimiter{'<', '>'}
+// Parse a P-Charging-Vector header, which is a list of params including the mandatory 'icid-value'.
+func parsePChargingVectorHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	var vector base.PChargingVectorHeader
+	vector.Params, _, err = base.ParseParams(";"+strings.TrimSpace(headerText), ';', ';', 0, true, true)
+	if err != nil {
+		return
+	}
 
-// Find the first instance of the target in the given text which is not enclosed in any delimiters
-// from the list provided.
-func findUnescaped(text string, target uint8, delims ...delimiter) int {
-	return findAnyUnescaped(text, string(target), delims...)
+	icidValue, ok := vector.Params["icid-value"]
+	if !ok || icidValue == nil || len(*icidValue) == 0 {
+		err = fmt.Errorf("missing icid-value in %s: header: %s", headerName, headerText)
+		return
+	}
+	vector.IcidValue = *icidValue
+	delete(vector.Params, "icid-value")
+
+	headers = []base.SipHeader{&vector}
+	return
 }
 
-// Find the first instance of any of the targets in the given text that are not enclosed in any delimiters
-// from the list provided.
-func findAnyUnescaped(text string, targets string, delims ...delimiter) int {
-	escaped := false
-	var endEscape uint8 = 0
+// Parse a P-Charging-Function-Addresses header, which is a list of params in which 'ccf' and 'ecf'
+// may be repeated.
+func parsePChargingFunctionAddressesHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	addresses := base.PChargingFunctionAddressesHeader{Params: base.Params{}}
+	remaining := strings.TrimSpace(headerText)
+	for len(remaining) > 0 {
+		end := findUnescaped(remaining, ';', quotes_delim)
+		if end == -1 {
+			end = len(remaining)
+		}
 
-	endChars := make(map[uint8]uint8)
-	for _, delim := range delims {
-		endChars[delim.start] = delim.end
-	}
+		name, value := remaining[:end], ""
+		hasValue := false
+		if eqIdx := strings.Index(name, "="); eqIdx != -1 {
+			name, value = name[:eqIdx], strings.TrimSpace(name[eqIdx+1:])
+			value = strings.TrimSuffix(strings.TrimPrefix(value, "\""), "\"")
+			hasValue = true
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if len(name) == 0 {
+			err = fmt.Errorf("empty parameter in %s: header: %s", headerName, headerText)
+			return
+		}
 
-	for idx := 0; idx < len(text); idx++ {
-		if !escaped && strings.Contains(targets, string(text[idx])) {
-			return idx
+		switch {
+		case (name == "ccf" || name == "ecf") && (!hasValue || len(value) == 0):
+			err = fmt.Errorf("missing value for %s in %s: header: %s", name, headerName, headerText)
+			return
+		case name == "ccf":
+			addresses.Ccf = append(addresses.Ccf, value)
+		case name == "ecf":
+			addresses.Ecf = append(addresses.Ecf, value)
+		case hasValue:
+			addresses.Params[name] = &value
+		default:
+			addresses.Params[name] = nil
 		}
 
-		if escaped {
-			escaped = (text[idx] != endEscape)
-			continue
-		} else {
-			endEscape, escaped = endChars[text[idx]]
+		if end == len(remaining) {
+			break
 		}
+		remaining = remaining[end+1:]
 	}
 
-	return -1
-}
+	if len(addresses.Ccf) == 0 && len(addresses.Ecf) == 0 {
+		err = fmt.Errorf("no ccf or ecf in %s: header: %s", headerName, headerText)
+		return
+	}
 
-// Splits the given string into sections, separated by one or more characters
-// from c_ABNF_WS.
-func splitByWhitespace(text string) []string {
-	var buffer bytes.Buffer
-	var inString bool = true
-	result := make([]string, 0)
+	headers = []base.SipHeader{&addresses}
+	return
+}
 
-	for _, char := range text {
-		s := string(char)
-		if strings.Contains(c_ABNF_WS, s) {
-			if inString {
-				// First whitespace char following text; flush buffer to the results array.
-				result = append(result, buffer.String())
-				buffer.Reset()
-			}
-			inString = false
-		} else {
-			buffer.WriteString(s)
-			inString = true
+// Parse a header which is a comma-separated list of tokens: Allow, Require, Proxy-Require, Supported
+// or Unsupported.
+func parseListHeader(headerName string, headerText string) (
+	headers []base.SipHeader, err error) {
+	options := splitList(headerText)
+	for _, option := range options {
+		if strings.ContainsAny(option, c_ABNF_WS) {
+			err = fmt.Errorf("invalid value '%s' in %s: header: %s", option, headerName, headerText)
+			return
 		}
 	}
 
-	if buffer.Len() > 0 {
-		result = append(result, buffer.String())
+	switch headerName {
+	case "allow":
+		methods := make([]base.Method, 0, len(options))
+		for _, option := range options {
+			methods = append(methods, base.Method(option))
+		}
+		headers = []base.SipHeader{&base.AllowHeader{methods}}
+	case "require":
+		headers = []base.SipHeader{&base.RequireHeader{options}}
+	case "proxy-require":
+		headers = []base.SipHeader{&base.ProxyRequireHeader{options}}
+	case "supported", "k":
+		headers = []base.SipHeader{&base.SupportedHeader{options}}
+	case "unsupported":
+		headers = []base.SipHeader{&base.UnsupportedHeader{options}}
+	case "allow-events", "u":
+		headers = []base.SipHeader{&base.AllowEventsHeader{options}}
 	}
+	return
+}
 
-	return result
+// Split a comma-separated list header into its elements, trimming whitespace from each.
+// Empty elements, such as those produced by a trailing or doubled comma, are skipped.
+func splitList(headerText string) []string {
+	elements := []string{}
+	for _, element := range strings.Split(headerText, ",") {
+		element = strings.TrimSpace(element)
+		if len(element) > 0 {
+			elements = append(elements, element)
+		}
+	}
+	return elements
 }
@@ -84,6 +84,22 @@ func (pb *parserBuffer) NextChunk(n int) (response string, err error) {
 	return
 }
 
+// If the buffer already holds a CRLF at its start, delete it and return true.
+// Unlike the other read methods, this never blocks waiting for more data.
+func (pb *parserBuffer) ConsumeBufferedCRLF() bool {
+	if pb.reader.Buffered() < 2 {
+		return false
+	}
+
+	next, err := pb.reader.Peek(2)
+	if err != nil || string(next) != "\r\n" {
+		return false
+	}
+
+	pb.reader.Discard(2)
+	return true
+}
+
 // Stop the parser buffer.
 func (pb *parserBuffer) Stop() {
 	pb.pipeReader.Close()
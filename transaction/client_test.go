@@ -166,7 +166,8 @@ func assertNoError(t *testing.T, err error) {
 }
 
 func message(rawMsg []string) (base.SipMessage, error) {
-	return parser.ParseMessage([]byte(strings.Join(rawMsg, "\r\n")))
+	msg, _, err := parser.ParseMessage([]byte(strings.Join(rawMsg, "\r\n")))
+	return msg, err
 }
 
 func request(rawMsg []string) (*base.Request, error) {
@@ -16,6 +16,7 @@ type connection struct {
 	parser         parser.Parser
 	parsedMessages chan base.SipMessage
 	parserErrors   chan error
+	pingPongs      chan parser.PingPong
 	output         chan base.SipMessage
 }
 
@@ -35,10 +36,12 @@ func NewConn(baseConn net.Conn, output chan base.SipMessage) *connection {
 
 	connection.parsedMessages = make(chan base.SipMessage)
 	connection.parserErrors = make(chan error)
+	connection.pingPongs = make(chan parser.PingPong)
 	connection.output = output
 	connection.parser = parser.NewParser(connection.parsedMessages,
 		connection.parserErrors,
 		connection.isStreamed)
+	connection.parser.SetPingPongChan(connection.pingPongs)
 
 	go connection.read()
 	go connection.pipeOutput()
@@ -101,12 +104,20 @@ func (connection *connection) pipeOutput() {
 			} else {
 				break
 			}
+		case pingPong := <-connection.pingPongs:
+			if pingPong == parser.Ping {
+				// Respond to a keepalive ping with a pong (RFC 5626 s. 4.4.1).
+				if _, err := connection.baseConn.Write([]byte("\r\n")); err != nil {
+					log.Debug("Failed to send pong on connection %p: %s", connection, err.Error())
+				}
+			}
 		case err, ok := <-connection.parserErrors:
 			if ok {
 				// The parser has hit a terminal error. We need to restart it.
 				log.Warn("Failed to parse SIP message: %s", err.Error())
 				connection.parser = parser.NewParser(connection.parsedMessages,
 					connection.parserErrors, connection.isStreamed)
+				connection.parser.SetPingPongChan(connection.pingPongs)
 			} else {
 				break
 			}
@@ -78,10 +78,13 @@ func (udp *Udp) listen(conn *net.UDPConn) {
 
 		pkt := append([]byte(nil), buffer[:num]...)
 		go func() {
-			msg, err := parser.ParseMessage(pkt)
+			msg, consumed, err := parser.ParseMessage(pkt)
 			if err != nil {
 				log.Warn("Failed to parse SIP message: %s", err.Error())
 			} else {
+				if consumed < len(pkt) {
+					log.Info("Ignoring %d trailing bytes after SIP message %s", len(pkt)-consumed, msg.Short())
+				}
 				udp.output <- msg
 			}
 		}()